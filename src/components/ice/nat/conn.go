@@ -0,0 +1,272 @@
+package nat
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "sync"
+    "time"
+
+    "github.com/pion/stun/v3"
+)
+
+const (
+    messageHeaderSize  = 20
+    maxMessageSize     = 64 * 1024              // UDP 数据包最大长度
+    defaultRTO         = 500 * time.Millisecond // RFC 5389 7.2.1 建议的初始重传超时
+    maxPendingRequests = 8                      // 最多缓存的未处理 STUN 请求(hairpin 检测)
+)
+
+var (
+    errConnClosed = errors.New("stun connection closed")
+    errTimedOut   = errors.New("timed out waiting for response")
+)
+
+// ErrorResponse STUN 服务器返回的错误响应, 例如不支持 CHANGE-REQUEST 或 RESPONSE-PORT 时返回 420
+type ErrorResponse struct {
+    Code   stun.ErrorCode
+    Reason string
+}
+
+func (e *ErrorResponse) Error() string {
+    return fmt.Sprintf("stun error response: %d %s", e.Code, e.Reason)
+}
+
+// errorResponse 错误响应转换为 ErrorResponse, 没有 ERROR-CODE 属性时 Code 为 0
+func errorResponse(msg *stun.Message) *ErrorResponse {
+    errorCode := stun.ErrorCodeAttribute{}
+    if err := errorCode.GetFrom(msg); err != nil {
+        return &ErrorResponse{Reason: msg.Type.String()}
+    }
+    return &ErrorResponse{Code: errorCode.Code, Reason: string(errorCode.Reason)}
+}
+
+// stunServerConn 与 STUN 服务器通信的 UDP socket
+// 响应按事务ID分发给对应的请求, 同一个 socket 上可以同时进行多个事务, 无法解析的数据包和已超时事务的响应直接丢弃
+type stunServerConn struct {
+    conn       net.PacketConn
+    LocalAddr  net.Addr
+    RemoteAddr *net.UDPAddr
+    OtherAddr  *net.UDPAddr
+    rto        time.Duration
+    pending    map[[stun.TransactionIDSize]byte]chan *stun.Message // 等待响应的事务
+    requests   chan *stun.Message                                  // 收到的 STUN 请求, 用于 hairpin 检测
+    done       chan struct{}                                       // 读循环退出
+    mu         sync.Mutex
+}
+
+func (c *stunServerConn) Close() error {
+    return c.conn.Close()
+}
+
+// Parse a STUN message
+func parse(msg *stun.Message) (ret struct {
+    xorAddr    *stun.XORMappedAddress
+    otherAddr  *stun.OtherAddress
+    respOrigin *stun.ResponseOrigin
+    mappedAddr *stun.MappedAddress
+    software   *stun.Software
+},
+) {
+    ret.mappedAddr = &stun.MappedAddress{}
+    ret.xorAddr = &stun.XORMappedAddress{}
+    ret.respOrigin = &stun.ResponseOrigin{}
+    ret.otherAddr = &stun.OtherAddress{}
+    ret.software = &stun.Software{}
+    if ret.xorAddr.GetFrom(msg) != nil {
+        ret.xorAddr = nil
+    }
+    if ret.otherAddr.GetFrom(msg) != nil {
+        ret.otherAddr = nil
+    }
+    if ret.respOrigin.GetFrom(msg) != nil {
+        ret.respOrigin = nil
+    }
+    if ret.mappedAddr.GetFrom(msg) != nil {
+        ret.mappedAddr = nil
+    }
+    if ret.software.GetFrom(msg) != nil {
+        ret.software = nil
+    }
+    log.Debugf("%v", msg)
+    log.Debugf("\tMAPPED-ADDRESS:     %v", ret.mappedAddr)
+    log.Debugf("\tXOR-MAPPED-ADDRESS: %v", ret.xorAddr)
+    log.Debugf("\tRESPONSE-ORIGIN:    %v", ret.respOrigin)
+    log.Debugf("\tOTHER-ADDRESS:      %v", ret.otherAddr)
+    log.Debugf("\tSOFTWARE: %v", ret.software)
+    for _, attr := range msg.Attributes {
+        switch attr.Type {
+        case
+            stun.AttrXORMappedAddress,
+            stun.AttrOtherAddress,
+            stun.AttrResponseOrigin,
+            stun.AttrMappedAddress,
+            stun.AttrSoftware:
+            break //nolint:staticcheck
+        default:
+            log.Debugf("\t%v (l=%v)", attr, attr.Length)
+        }
+    }
+    return ret
+}
+
+// Given an address string, returns a StunServerConn, network 为 udp4 或 udp6, rto <= 0 使用默认初始重传超时
+func connect(addrStr, network string, rto time.Duration) (*stunServerConn, error) {
+    log.Infof("Connecting to STUN server: %s (%s)", addrStr, network)
+    addr, err := net.ResolveUDPAddr(network, addrStr)
+    if err != nil {
+        log.Warnf("Error resolving address: %s", err)
+        return nil, err
+    }
+
+    c, err := net.ListenUDP(network, nil)
+    if err != nil {
+        return nil, err
+    }
+    log.Infof("Local address: %s", c.LocalAddr())
+    log.Infof("Remote address: %s", addr.String())
+    return newStunServerConn(c, addr, rto), nil
+}
+
+func newStunServerConn(conn net.PacketConn, remoteAddr *net.UDPAddr, rto time.Duration) *stunServerConn {
+    if rto <= 0 {
+        rto = defaultRTO
+    }
+    c := &stunServerConn{
+        conn:       conn,
+        LocalAddr:  conn.LocalAddr(),
+        RemoteAddr: remoteAddr,
+        rto:        rto,
+        pending:    make(map[[stun.TransactionIDSize]byte]chan *stun.Message),
+        requests:   make(chan *stun.Message, maxPendingRequests),
+        done:       make(chan struct{}),
+    }
+    go c.listen()
+    return c
+}
+
+// roundTrip 发送请求并等待事务ID匹配的响应, 未收到响应时按 RFC 5389 7.2.1 重传, 重传间隔从 RTO 开始每次翻倍,
+// 超过 timeout 或 ctx 结束返回错误, 收到错误响应返回 *ErrorResponse
+func (c *stunServerConn) roundTrip(ctx context.Context, msg *stun.Message, addr net.Addr, timeout time.Duration) (*stun.Message, error) {
+    resp, _, err := c.roundTripTo(ctx, msg, addr, timeout, c)
+    return resp, err
+}
+
+// roundTripTo 同 roundTrip, 请求从 c 发送, 响应由 c 或 receiver 收到, 返回成功响应和收到响应的连接
+// 请求带 RESPONSE-PORT 指向 receiver 的映射端口时, 服务器把响应发给 receiver; 不支持 RESPONSE-PORT 的服务器仍然响应 c
+func (c *stunServerConn) roundTripTo(ctx context.Context, msg *stun.Message, addr net.Addr, timeout time.Duration,
+    receiver *stunServerConn) (*stun.Message, *stunServerConn, error) {
+    _ = msg.NewTransactionID()
+    respChan := c.expect(msg.TransactionID)
+    defer c.forget(msg.TransactionID)
+    recvChan := respChan
+    if receiver != c {
+        recvChan = receiver.expect(msg.TransactionID)
+        defer receiver.forget(msg.TransactionID)
+    }
+
+    deadline := time.NewTimer(timeout)
+    defer deadline.Stop()
+    rto := c.rto
+    for {
+        log.Infof("Sending to %v: (%v bytes)", addr, msg.Length+messageHeaderSize)
+        log.Debugf("%v", msg)
+        if _, err := c.conn.WriteTo(msg.Raw, addr); err != nil {
+            log.Warnf("Error sending request to %v", addr)
+            return nil, nil, err
+        }
+
+        retransmit := time.NewTimer(rto)
+        select {
+        case m := <-respChan:
+            retransmit.Stop()
+            return checkResponse(m, c)
+        case m := <-recvChan:
+            retransmit.Stop()
+            return checkResponse(m, receiver)
+        case <-retransmit.C:
+            rto *= 2
+        case <-deadline.C:
+            retransmit.Stop()
+            log.Infof("Timed out waiting for response from server %v", addr)
+            return nil, nil, errTimedOut
+        case <-c.done:
+            retransmit.Stop()
+            return nil, nil, errConnClosed
+        case <-receiver.done:
+            retransmit.Stop()
+            return nil, nil, errConnClosed
+        case <-ctx.Done():
+            retransmit.Stop()
+            return nil, nil, ctx.Err()
+        }
+    }
+}
+
+// checkResponse 错误响应返回 *ErrorResponse, 调用方只需要处理成功响应
+func checkResponse(m *stun.Message, conn *stunServerConn) (*stun.Message, *stunServerConn, error) {
+    if m.Type.Class == stun.ClassErrorResponse {
+        err := errorResponse(m)
+        log.Infof("Received error response: %v", err)
+        return nil, conn, err
+    }
+    return m, conn, nil
+}
+
+// expect 登记等待响应的事务
+func (c *stunServerConn) expect(id [stun.TransactionIDSize]byte) chan *stun.Message {
+    respChan := make(chan *stun.Message, 1)
+    c.mu.Lock()
+    c.pending[id] = respChan
+    c.mu.Unlock()
+    return respChan
+}
+
+func (c *stunServerConn) forget(id [stun.TransactionIDSize]byte) {
+    c.mu.Lock()
+    delete(c.pending, id)
+    c.mu.Unlock()
+}
+
+// listen 读取 socket 上的数据包, 响应交给等待的事务, 请求放入 requests, 其他数据包丢弃
+func (c *stunServerConn) listen() {
+    defer close(c.done)
+    buf := make([]byte, maxMessageSize)
+    for {
+        n, addr, err := c.conn.ReadFrom(buf)
+        if err != nil {
+            return
+        }
+        if !stun.IsMessage(buf[:n]) {
+            log.Debugf("Drop non-STUN packet from %v: (%v bytes)", addr, n)
+            continue
+        }
+        m := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+        if err := m.Decode(); err != nil {
+            log.Infof("Error decoding message from %v: %v", addr, err)
+            continue
+        }
+        log.Infof("Message from %v: (%v bytes)", addr, n)
+
+        if m.Type.Class == stun.ClassRequest {
+            select {
+            case c.requests <- m:
+            default:
+            }
+            continue
+        }
+        c.mu.Lock()
+        respChan, ok := c.pending[m.TransactionID]
+        c.mu.Unlock()
+        if !ok {
+            log.Debugf("Drop message with unknown transaction from %v", addr)
+            continue
+        }
+        // 重传可能收到多个响应, 只取第一个
+        select {
+        case respChan <- m:
+        default:
+        }
+    }
+}
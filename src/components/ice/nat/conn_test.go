@@ -0,0 +1,182 @@
+package nat
+
+import (
+    "context"
+    "errors"
+    "net"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/pion/stun/v3"
+)
+
+// newFakeServer 回环地址上的 STUN 服务器, 每个请求交给 handler 处理
+func newFakeServer(t *testing.T, handler func(conn *net.UDPConn, req *stun.Message, from *net.UDPAddr)) *net.UDPConn {
+    conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        buf := make([]byte, 1500)
+        for {
+            n, from, err := conn.ReadFromUDP(buf)
+            if err != nil {
+                return
+            }
+            req := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+            if err := req.Decode(); err != nil {
+                continue
+            }
+            handler(conn, req, from)
+        }
+    }()
+    t.Cleanup(func() {
+        _ = conn.Close()
+        <-done
+    })
+    return conn
+}
+
+func reply(conn *net.UDPConn, req *stun.Message, to *net.UDPAddr) {
+    resp := stun.MustBuild(stun.NewTransactionIDSetter(req.TransactionID), stun.BindingSuccess,
+        &stun.XORMappedAddress{IP: to.IP, Port: to.Port})
+    _, _ = conn.WriteToUDP(resp.Raw, to)
+}
+
+func newTestConn(t *testing.T, server *net.UDPConn, rto time.Duration) *stunServerConn {
+    c, err := connect(server.LocalAddr().String(), NetworkUDP4, rto)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        _ = c.Close()
+    })
+    return c
+}
+
+func TestRoundTripRetransmit(t *testing.T) {
+    t.Parallel()
+    // 丢弃前两次请求, 第三次(重传)才响应
+    var received atomic.Int32
+    var sent []time.Time
+    var mu sync.Mutex
+    server := newFakeServer(t, func(conn *net.UDPConn, req *stun.Message, from *net.UDPAddr) {
+        mu.Lock()
+        sent = append(sent, time.Now())
+        mu.Unlock()
+        if received.Add(1) < 3 {
+            return
+        }
+        reply(conn, req, from)
+    })
+    c := newTestConn(t, server, 50*time.Millisecond)
+    if _, err := c.roundTrip(context.Background(), stun.MustBuild(stun.TransactionID, stun.BindingRequest), c.RemoteAddr, 2*time.Second); err != nil {
+        t.Fatal(err)
+    }
+    mu.Lock()
+    defer mu.Unlock()
+    if len(sent) != 3 {
+        t.Fatalf("expected 3 transmissions, got %d", len(sent))
+    }
+    // 重传间隔翻倍: 50ms, 100ms
+    if first, second := sent[1].Sub(sent[0]), sent[2].Sub(sent[1]); second < first+first/2 {
+        t.Fatalf("rto should double, got %v then %v", first, second)
+    }
+
+    // 一直没有响应时在 timeout 后返回
+    silent := newFakeServer(t, func(*net.UDPConn, *stun.Message, *net.UDPAddr) {})
+    c = newTestConn(t, silent, 20*time.Millisecond)
+    start := time.Now()
+    if _, err := c.roundTrip(context.Background(), stun.MustBuild(stun.TransactionID, stun.BindingRequest), c.RemoteAddr, 200*time.Millisecond); !errors.Is(err, errTimedOut) {
+        t.Fatalf("expected timeout, got: %v", err)
+    }
+    if elapsed := time.Since(start); elapsed > time.Second {
+        t.Fatalf("timeout took %v", elapsed)
+    }
+}
+
+func TestRoundTripIgnoresJunkAndLateResponses(t *testing.T) {
+    t.Parallel()
+    var late *stun.Message
+    var mu sync.Mutex
+    server := newFakeServer(t, func(conn *net.UDPConn, req *stun.Message, from *net.UDPAddr) {
+        // 先发送垃圾数据、截断的 STUN 消息、其他事务的响应和上一个超时事务的响应
+        _, _ = conn.WriteToUDP([]byte("not a stun message"), from)
+        other := stun.MustBuild(stun.TransactionID, stun.BindingSuccess, &stun.XORMappedAddress{IP: net.IPv4(192, 0, 2, 1), Port: 1})
+        _, _ = conn.WriteToUDP(other.Raw[:messageHeaderSize+4], from)
+        _, _ = conn.WriteToUDP(other.Raw, from)
+        mu.Lock()
+        if late == nil {
+            // 第一个事务不响应, 让它超时
+            late = req
+            mu.Unlock()
+            return
+        }
+        lateReq := late
+        mu.Unlock()
+        lateResp := stun.MustBuild(stun.NewTransactionIDSetter(lateReq.TransactionID), stun.BindingSuccess,
+            &stun.XORMappedAddress{IP: net.IPv4(192, 0, 2, 2), Port: 2})
+        _, _ = conn.WriteToUDP(lateResp.Raw, from)
+        reply(conn, req, from)
+    })
+    c := newTestConn(t, server, time.Second)
+    if _, err := c.roundTrip(context.Background(), stun.MustBuild(stun.TransactionID, stun.BindingRequest), c.RemoteAddr, 100*time.Millisecond); !errors.Is(err, errTimedOut) {
+        t.Fatalf("expected timeout, got: %v", err)
+    }
+    resp, err := c.roundTrip(context.Background(), stun.MustBuild(stun.TransactionID, stun.BindingRequest), c.RemoteAddr, time.Second)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if xorAddr := parse(resp).xorAddr; xorAddr == nil || !xorAddr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+        t.Fatalf("response of another transaction accepted: %v", xorAddr)
+    }
+}
+
+func TestConcurrentRoundTrips(t *testing.T) {
+    t.Parallel()
+    // 乱序响应
+    var mu sync.Mutex
+    var queued []*stun.Message
+    server := newFakeServer(t, func(conn *net.UDPConn, req *stun.Message, from *net.UDPAddr) {
+        mu.Lock()
+        defer mu.Unlock()
+        queued = append(queued, req)
+        if len(queued) < 4 {
+            return
+        }
+        for i := len(queued) - 1; i >= 0; i-- {
+            resp := stun.MustBuild(stun.NewTransactionIDSetter(queued[i].TransactionID), stun.BindingSuccess,
+                &stun.XORMappedAddress{IP: net.IPv4(192, 0, 2, byte(i)), Port: 1000 + int(queued[i].TransactionID[0])})
+            _, _ = conn.WriteToUDP(resp.Raw, from)
+        }
+        queued = nil
+    })
+    c := newTestConn(t, server, time.Second)
+
+    var wg sync.WaitGroup
+    errs := make(chan error, 4)
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            request := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+            resp, err := c.roundTrip(context.Background(), request, c.RemoteAddr, 2*time.Second)
+            if err != nil {
+                errs <- err
+                return
+            }
+            if resp.TransactionID != request.TransactionID || parse(resp).xorAddr.Port != 1000+int(request.TransactionID[0]) {
+                errs <- errors.New("response of another transaction")
+            }
+        }()
+    }
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        t.Fatal(err)
+    }
+}
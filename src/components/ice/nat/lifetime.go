@@ -0,0 +1,203 @@
+package nat
+
+import (
+    "context"
+    "errors"
+    "time"
+
+    "github.com/pion/stun/v3"
+)
+
+const (
+    defaultMinInterval = 5 * time.Second
+    defaultMaxInterval = 5 * time.Minute
+    defaultPrecision   = 5 * time.Second
+    minKeepalive       = time.Second
+)
+
+// LifetimeOptions 映射存活时间探测配置
+type LifetimeOptions struct {
+    Timeout     time.Duration // 单个请求等待响应的时间, 默认 3s
+    RTO         time.Duration // 初始重传超时, 默认 500ms
+    Network     string        // udp4 或 udp6, 默认 udp4
+    MinInterval time.Duration // 第一次空闲等待时间, 之后每次翻倍, 默认 5s
+    MaxInterval time.Duration // 最长空闲等待时间, 映射超过该时间仍未变化则停止探测, 默认 5min
+    Precision   time.Duration // 找到映射变化的区间后二分查找, 区间小于该值停止, 默认 5s
+}
+
+// BindingLifetime NAT UDP 映射存活时间探测结果
+type BindingLifetime struct {
+    Server               string        `json:"server"`
+    Network              string        `json:"network"`
+    LocalAddr            string        `json:"localAddr,omitempty"`
+    ExternalAddr         string        `json:"externalAddr,omitempty"` // 第一次 Binding 得到的外部地址
+    ResponsePort         bool          `json:"responsePort"`           // 服务器支持 RESPONSE-PORT, 按 RFC 5780 4.6 检测映射是否过期
+    Expired              bool          `json:"expired"`                // 探测期间映射过期
+    Lifetime             time.Duration `json:"lifetime"`               // 映射保持不变的最长空闲时间, 未过期时为 MaxInterval
+    ExpiredAfter         time.Duration `json:"expiredAfter,omitempty"` // 映射过期的最短空闲时间
+    RecommendedKeepalive time.Duration `json:"recommendedKeepalive"`   // 建议的保活间隔, 取 Lifetime 的一半
+}
+
+// ProbeLifetime 探测 NAT UDP 映射的存活时间
+// 按 RFC 5780 4.6: 主 socket X 先 Binding 得到映射, 空闲等待一段时间后从另一个 socket Y 发送带 RESPONSE-PORT(X 的映射端口)的请求,
+// 服务器把响应发到 X 的映射, X 收到说明映射仍然存在, 超时未收到说明映射已过期; Y 的请求不会刷新 X 的映射,
+// 每次检测后 X 重新 Binding 刷新(或重新创建)映射. 这样端口保持(过期后重新分配相同端口)的 NAT 也能检测到过期.
+// 服务器不支持 RESPONSE-PORT 时退化为比较 X 重新 Binding 前后的外部地址, 只能检测到外部地址变化的过期.
+// 空闲时间每次翻倍直到映射过期, 找到存活和过期之间的区间后二分查找, 用于调整空闲会话的保活间隔,
+// 探测时间最长约为 MaxInterval 的 2 倍加二分查找时间
+func ProbeLifetime(ctx context.Context, server string, options LifetimeOptions) (*BindingLifetime, error) {
+    if options.Timeout <= 0 {
+        options.Timeout = defaultTimeout
+    }
+    if options.MinInterval <= 0 {
+        options.MinInterval = defaultMinInterval
+    }
+    if options.MaxInterval <= 0 {
+        options.MaxInterval = defaultMaxInterval
+    }
+    if options.Precision <= 0 {
+        options.Precision = defaultPrecision
+    }
+    result := &BindingLifetime{Server: server, Network: options.Network}
+    if err := checkNetwork(&options.Network); err != nil {
+        return result, err
+    }
+    result.Network = options.Network
+
+    conn, err := connect(server, options.Network, options.RTO)
+    if err != nil {
+        return result, err
+    }
+    defer conn.Close()
+    result.LocalAddr = conn.LocalAddr.String()
+    checker, err := connect(server, options.Network, options.RTO)
+    if err != nil {
+        return result, err
+    }
+    defer checker.Close()
+
+    query := func() (*stun.XORMappedAddress, error) {
+        request := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+        resp, err := conn.roundTrip(ctx, request, conn.RemoteAddr, options.Timeout)
+        if err != nil {
+            return nil, err
+        }
+        xorAddr := parse(resp).xorAddr
+        if xorAddr == nil {
+            return nil, ErrNoMappedAddress
+        }
+        return xorAddr, nil
+    }
+    mapped, err := query()
+    if err != nil {
+        return result, err
+    }
+    result.ExternalAddr = mapped.String()
+    result.ResponsePort = true
+
+    // check 检测 X 的映射是否存在, 服务器不支持 RESPONSE-PORT 时返回 ok 为 false
+    check := func() (alive bool, ok bool, err error) {
+        request := stun.MustBuild(stun.TransactionID, stun.BindingRequest, responsePort(mapped.Port))
+        _, receiver, err := checker.roundTripTo(ctx, request, checker.RemoteAddr, options.Timeout, conn)
+        if errors.Is(err, errTimedOut) {
+            return false, true, nil
+        }
+        var respErr *ErrorResponse
+        if errors.As(err, &respErr) {
+            log.Infof("Lifetime probe: server does not support RESPONSE-PORT, response %v", respErr)
+            return false, false, nil
+        }
+        if err != nil {
+            return false, false, err
+        }
+        if receiver != conn {
+            log.Info("Lifetime probe: server does not support RESPONSE-PORT, response sent to the checker")
+            return false, false, nil
+        }
+        return true, true, nil
+    }
+    // probe 空闲 idle 后检测映射是否存在, 之后重新 Binding, 每次 Binding 都会刷新(或重新创建)映射
+    probe := func(idle time.Duration) (bool, error) {
+        log.Infof("Lifetime probe: idle %v", idle)
+        timer := time.NewTimer(idle)
+        defer timer.Stop()
+        select {
+        case <-timer.C:
+        case <-ctx.Done():
+            return false, ctx.Err()
+        }
+        alive := false
+        if result.ResponsePort {
+            checked, ok, err := check()
+            if err != nil {
+                return false, err
+            }
+            alive, result.ResponsePort = checked, ok
+        }
+        current, err := query()
+        if err != nil {
+            return false, err
+        }
+        if !result.ResponsePort {
+            alive = current.String() == mapped.String()
+        }
+        log.Infof("Lifetime probe: idle %v, alive %v, mapping %s -> %s", idle, alive, mapped, current)
+        mapped = current
+        return alive, nil
+    }
+
+    // 空闲时间翻倍直到映射过期
+    var alive, expired time.Duration
+    for idle := options.MinInterval; expired == 0; idle *= 2 {
+        if idle > options.MaxInterval {
+            idle = options.MaxInterval
+        }
+        ok, err := probe(idle)
+        if err != nil {
+            return result, err
+        }
+        if !ok {
+            expired = idle
+            break
+        }
+        alive = idle
+        if idle == options.MaxInterval {
+            break
+        }
+    }
+
+    // 在 (alive, expired) 区间二分查找
+    for expired != 0 && expired-alive > options.Precision {
+        mid := alive + (expired-alive)/2
+        ok, err := probe(mid)
+        if err != nil {
+            return result, err
+        }
+        if ok {
+            alive = mid
+        } else {
+            expired = mid
+        }
+    }
+
+    result.Expired = expired != 0
+    result.Lifetime = alive
+    result.ExpiredAfter = expired
+    result.RecommendedKeepalive = recommendedKeepalive(alive)
+    log.Infof("=> NAT binding lifetime: %v, recommended keepalive: %v", alive, result.RecommendedKeepalive)
+    return result, nil
+}
+
+// recommendedKeepalive 保活间隔取存活时间的一半, 容忍一次保活包丢失
+func recommendedKeepalive(lifetime time.Duration) time.Duration {
+    keepalive := lifetime / 2
+    if keepalive < minKeepalive {
+        keepalive = minKeepalive
+    }
+    return keepalive
+}
+
+// responsePort RFC 5780 RESPONSE-PORT 属性, 服务器把响应发到请求来源 IP 的 port 端口
+func responsePort(port int) stun.RawAttribute {
+    return stun.RawAttribute{Type: stun.AttrResponsePort, Value: []byte{byte(port >> 8), byte(port), 0, 0}}
+}
@@ -0,0 +1,68 @@
+package nat
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestProbeLifetime(t *testing.T) {
+    t.Parallel()
+    options := LifetimeOptions{
+        Timeout:     200 * time.Millisecond,
+        RTO:         50 * time.Millisecond,
+        MinInterval: 50 * time.Millisecond,
+        MaxInterval: 800 * time.Millisecond,
+        Precision:   25 * time.Millisecond,
+    }
+
+    cases := []struct {
+        name         string
+        nat          testNAT
+        responsePort bool
+    }{
+        // 映射空闲 300ms 后过期
+        {"expire", testNAT{mapping: EndpointIndependent, mappingTimeout: 300 * time.Millisecond}, true},
+        // 过期后重新分配相同的外部端口, 只能通过 RESPONSE-PORT 检测
+        {"port preserving", testNAT{mapping: EndpointIndependent, mappingTimeout: 300 * time.Millisecond, portPreserving: true}, true},
+        // 服务器不支持 RESPONSE-PORT 时比较外部地址
+        {"no response port", testNAT{mapping: EndpointIndependent, mappingTimeout: 300 * time.Millisecond, noOtherAddress: true}, false},
+    }
+    for _, c := range cases {
+        server := newTestSTUNServer(t, c.nat)
+        lifetime, err := ProbeLifetime(context.Background(), server.Addr(), options)
+        if err != nil {
+            t.Fatalf("%s: %v", c.name, err)
+        }
+        if !lifetime.Expired || lifetime.ResponsePort != c.responsePort ||
+            lifetime.Lifetime < 200*time.Millisecond || lifetime.Lifetime > 300*time.Millisecond ||
+            lifetime.ExpiredAfter-lifetime.Lifetime > options.Precision {
+            t.Fatalf("%s: unexpected lifetime: %+v", c.name, lifetime)
+        }
+        if lifetime.RecommendedKeepalive != minKeepalive {
+            t.Fatalf("%s: unexpected keepalive: %v", c.name, lifetime.RecommendedKeepalive)
+        }
+    }
+
+    // 映射不过期
+    server := newTestSTUNServer(t, testNAT{mapping: EndpointIndependent})
+    lifetime, err := ProbeLifetime(context.Background(), server.Addr(), options)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if lifetime.Expired || !lifetime.ResponsePort || lifetime.Lifetime != options.MaxInterval {
+        t.Fatalf("unexpected lifetime: %+v", lifetime)
+    }
+}
+
+func TestRecommendedKeepalive(t *testing.T) {
+    for lifetime, expected := range map[time.Duration]time.Duration{
+        0:                minKeepalive,
+        30 * time.Second: 15 * time.Second,
+        2 * time.Minute:  time.Minute,
+    } {
+        if keepalive := recommendedKeepalive(lifetime); keepalive != expected {
+            t.Fatalf("recommendedKeepalive(%v) = %v, want %v", lifetime, keepalive, expected)
+        }
+    }
+}
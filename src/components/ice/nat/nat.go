@@ -0,0 +1,350 @@
+// Package nat 按 RFC 5780 检测 NAT 映射(mapping)和过滤(filtering)行为
+// 基于 https://github.com/pion/stun/blob/master/cmd/stun-nat-behaviour/main.go
+package nat
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "sync"
+    "time"
+
+    "github.com/pion/logging"
+    "github.com/pion/stun/v3"
+)
+
+var log = logging.NewDefaultLoggerFactory().NewLogger("nat")
+
+var ErrNoOtherAddress = errors.New("no OTHER-ADDRESS in message, NAT discovery not supported by this server")
+
+var ErrNoMappedAddress = errors.New("no XOR-MAPPED-ADDRESS in message")
+
+const defaultTimeout = 3 * time.Second
+
+const (
+    NetworkUDP4 = "udp4"
+    NetworkUDP6 = "udp6"
+)
+
+// Behavior NAT 映射或过滤行为
+type Behavior string
+
+const (
+    BehaviorUnknown         Behavior = "unknown"
+    EndpointIndependent     Behavior = "endpoint-independent"
+    AddressDependent        Behavior = "address-dependent"
+    AddressAndPortDependent Behavior = "address-and-port-dependent"
+)
+
+// NATBehavior NAT 行为检测结果
+type NATBehavior struct {
+    Server       string   `json:"server"`                 // STUN 服务器地址
+    Network      string   `json:"network"`                // 检测使用的网络, udp4 或 udp6
+    LocalAddr    string   `json:"localAddr,omitempty"`    // 映射测试使用的本地地址
+    ExternalAddr string   `json:"externalAddr,omitempty"` // STUN 服务器看到的外部地址(XOR-MAPPED-ADDRESS)
+    NAT          bool     `json:"nat"`                    // 外部地址和本地地址不同, 位于 NAT 之后
+    Mapping      Behavior `json:"mapping"`                // 映射行为, 决定不同目标地址是否复用同一个外部地址
+    Filtering    Behavior `json:"filtering"`              // 过滤行为, 决定哪些外部来源的数据包可以进入
+    Hairpin      bool     `json:"hairpin"`                // 是否支持 hairpin, 同一 NAT 后的 Peer 可以通过外部地址互通
+}
+
+// Options 检测配置
+type Options struct {
+    Timeout time.Duration // 单个请求等待响应的时间, 默认 3s, 过滤测试需要等待超时才能判断, 过短会误判
+    RTO     time.Duration // 初始重传超时, 未收到响应时每次翻倍重传直到 Timeout, 默认 500ms
+    Network string        // udp4 或 udp6, 默认 udp4, 同时检测两种网络使用 DiscoverDualStack
+}
+
+func (o *Options) setDefaults() error {
+    if o.Timeout <= 0 {
+        o.Timeout = defaultTimeout
+    }
+    return checkNetwork(&o.Network)
+}
+
+// checkNetwork 校验网络类型, 为空时使用 udp4
+func checkNetwork(network *string) error {
+    switch *network {
+    case "":
+        *network = NetworkUDP4
+    case NetworkUDP4, NetworkUDP6:
+    default:
+        return fmt.Errorf("unsupported network %q, want udp4 or udp6", *network)
+    }
+    return nil
+}
+
+// Discover 使用支持 RFC 5780(返回 OTHER-ADDRESS)的 STUN 服务器检测 NAT 行为
+// 服务器不支持 RFC 5780 时返回 ErrNoOtherAddress 和只包含外部地址的结果
+func Discover(ctx context.Context, server string, options Options) (*NATBehavior, error) {
+    result := &NATBehavior{
+        Server:    server,
+        Network:   options.Network,
+        Mapping:   BehaviorUnknown,
+        Filtering: BehaviorUnknown,
+    }
+    if err := options.setDefaults(); err != nil {
+        return result, err
+    }
+    result.Network = options.Network
+    if err := mappingTests(ctx, server, options, result); err != nil {
+        return result, err
+    }
+    if err := filteringTests(ctx, server, options, result); err != nil {
+        return result, err
+    }
+    return result, nil
+}
+
+// DualStackBehavior 分别通过 IPv4 和 IPv6 检测的 NAT 行为, 某个网络不可用时记录错误
+type DualStackBehavior struct {
+    IPv4      *NATBehavior `json:"ipv4,omitempty"`
+    IPv4Error string       `json:"ipv4Error,omitempty"`
+    IPv6      *NATBehavior `json:"ipv6,omitempty"`
+    IPv6Error string       `json:"ipv6Error,omitempty"`
+}
+
+// Preferred 返回检测成功的结果, 优先 IPv4, 都失败时返回 nil
+func (b *DualStackBehavior) Preferred() *NATBehavior {
+    if b.IPv4Error == "" && b.IPv4 != nil {
+        return b.IPv4
+    }
+    if b.IPv6Error == "" && b.IPv6 != nil {
+        return b.IPv6
+    }
+    return nil
+}
+
+// DiscoverDualStack 同时通过 IPv4 和 IPv6 检测 NAT 行为, 忽略 options.Network
+// server 为域名时分别解析 A 和 AAAA 记录, 为 IP 地址时只有对应的网络能检测成功
+func DiscoverDualStack(ctx context.Context, server string, options Options) *DualStackBehavior {
+    result := &DualStackBehavior{}
+    var wg sync.WaitGroup
+    discover := func(network string, behavior **NATBehavior, errMsg *string) {
+        defer wg.Done()
+        networkOptions := options
+        networkOptions.Network = network
+        var err error
+        if *behavior, err = Discover(ctx, server, networkOptions); err != nil {
+            *errMsg = err.Error()
+        }
+    }
+    wg.Add(2)
+    go discover(NetworkUDP4, &result.IPv4, &result.IPv4Error)
+    go discover(NetworkUDP6, &result.IPv6, &result.IPv6Error)
+    wg.Wait()
+    return result
+}
+
+// RFC5780: 4.3.  Determining NAT Mapping Behavior
+func mappingTests(ctx context.Context, addrStr string, options Options, result *NATBehavior) error {
+    mapTestConn, err := connect(addrStr, options.Network, options.RTO)
+    if err != nil {
+        log.Warnf("Error creating STUN connection: %s", err)
+        return err
+    }
+    defer mapTestConn.Close()
+    result.LocalAddr = mapTestConn.LocalAddr.String()
+
+    // Test I: Regular binding request
+    log.Info("Mapping Test I: Regular binding request")
+    request := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+
+    resp, err := mapTestConn.roundTrip(ctx, request, mapTestConn.RemoteAddr, options.Timeout)
+    if err != nil {
+        return err
+    }
+
+    // Parse response message for XOR-MAPPED-ADDRESS and make sure OTHER-ADDRESS valid
+    resps1 := parse(resp)
+    if resps1.xorAddr != nil {
+        result.ExternalAddr = resps1.xorAddr.String()
+    }
+    if resps1.xorAddr == nil || resps1.otherAddr == nil {
+        log.Info("Error: NAT discovery feature not supported by this server")
+        return ErrNoOtherAddress
+    }
+    addr, err := net.ResolveUDPAddr(options.Network, resps1.otherAddr.String())
+    if err != nil {
+        log.Infof("Failed resolving OTHER-ADDRESS: %v", resps1.otherAddr)
+        return err
+    }
+    mapTestConn.OtherAddr = addr
+    log.Infof("Received XOR-MAPPED-ADDRESS: %v", resps1.xorAddr)
+
+    // hairpin 需要在映射测试的 socket 上接收, 映射测试结束前检测
+    result.Hairpin = hairpinTest(ctx, mapTestConn, resps1.xorAddr, options)
+
+    // Assert mapping behavior
+    if isLocalAddr(resps1.xorAddr, mapTestConn.LocalAddr) {
+        log.Info("=> NAT mapping behavior: endpoint independent (no NAT)")
+        result.Mapping = EndpointIndependent
+        return nil
+    }
+    result.NAT = true
+
+    // Test II: Send binding request to the other address but primary port
+    log.Info("Mapping Test II: Send binding request to the other address but primary port")
+    oaddr := *mapTestConn.OtherAddr
+    oaddr.Port = mapTestConn.RemoteAddr.Port
+    resp, err = mapTestConn.roundTrip(ctx, request, &oaddr, options.Timeout)
+    if err != nil {
+        return err
+    }
+
+    // Assert mapping behavior
+    resps2 := parse(resp)
+    if resps2.xorAddr == nil {
+        return ErrNoMappedAddress
+    }
+    log.Infof("Received XOR-MAPPED-ADDRESS: %v", resps2.xorAddr)
+    if resps2.xorAddr.String() == resps1.xorAddr.String() {
+        log.Info("=> NAT mapping behavior: endpoint independent")
+        result.Mapping = EndpointIndependent
+        return nil
+    }
+
+    // Test III: Send binding request to the other address and port
+    log.Info("Mapping Test III: Send binding request to the other address and port")
+    resp, err = mapTestConn.roundTrip(ctx, request, mapTestConn.OtherAddr, options.Timeout)
+    if err != nil {
+        return err
+    }
+
+    // Assert mapping behavior
+    resps3 := parse(resp)
+    if resps3.xorAddr == nil {
+        return ErrNoMappedAddress
+    }
+    log.Infof("Received XOR-MAPPED-ADDRESS: %v", resps3.xorAddr)
+    if resps3.xorAddr.String() == resps2.xorAddr.String() {
+        log.Info("=> NAT mapping behavior: address dependent")
+        result.Mapping = AddressDependent
+    } else {
+        log.Info("=> NAT mapping behavior: address and port dependent")
+        result.Mapping = AddressAndPortDependent
+    }
+    return nil
+}
+
+// RFC5780: 4.4.  Determining NAT Filtering Behavior
+func filteringTests(ctx context.Context, addrStr string, options Options, result *NATBehavior) error {
+    mapTestConn, err := connect(addrStr, options.Network, options.RTO)
+    if err != nil {
+        log.Warnf("Error creating STUN connection: %s", err)
+        return err
+    }
+    defer mapTestConn.Close()
+
+    // Test I: Regular binding request
+    log.Info("Filtering Test I: Regular binding request")
+    request := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+
+    resp, err := mapTestConn.roundTrip(ctx, request, mapTestConn.RemoteAddr, options.Timeout)
+    if err != nil {
+        return err
+    }
+    resps := parse(resp)
+    if resps.xorAddr == nil || resps.otherAddr == nil {
+        log.Warn("Error: NAT discovery feature not supported by this server")
+        return ErrNoOtherAddress
+    }
+    addr, err := net.ResolveUDPAddr(options.Network, resps.otherAddr.String())
+    if err != nil {
+        log.Infof("Failed resolving OTHER-ADDRESS: %v", resps.otherAddr)
+        return err
+    }
+    mapTestConn.OtherAddr = addr
+
+    // Test II: Request to change both IP and port
+    log.Info("Filtering Test II: Request to change both IP and port")
+    request = stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+    request.Add(stun.AttrChangeRequest, []byte{0x00, 0x00, 0x00, 0x06})
+
+    resp, err = mapTestConn.roundTrip(ctx, request, mapTestConn.RemoteAddr, options.Timeout)
+    if err == nil {
+        parse(resp) // just to print out the resp
+        log.Info("=> NAT filtering behavior: endpoint independent")
+        result.Filtering = EndpointIndependent
+        return nil
+    } else if !errors.Is(err, errTimedOut) {
+        return err // something else went wrong, 包括服务器不支持 CHANGE-REQUEST 返回的错误响应
+    }
+
+    // Test III: Request to change port only
+    log.Info("Filtering Test III: Request to change port only")
+    request = stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+    request.Add(stun.AttrChangeRequest, []byte{0x00, 0x00, 0x00, 0x02})
+
+    resp, err = mapTestConn.roundTrip(ctx, request, mapTestConn.RemoteAddr, options.Timeout)
+    if err == nil {
+        parse(resp) // just to print out the resp
+        log.Info("=> NAT filtering behavior: address dependent")
+        result.Filtering = AddressDependent
+    } else if errors.Is(err, errTimedOut) {
+        log.Info("=> NAT filtering behavior: address and port dependent")
+        result.Filtering = AddressAndPortDependent
+    } else {
+        return err
+    }
+    return nil
+}
+
+// RFC5780: Determining Support for Hairpinning
+// 从另一个本地 socket 向外部地址发送 Binding 请求, 映射测试的 socket 收到则 NAT 支持 hairpin
+func hairpinTest(ctx context.Context, mapTestConn *stunServerConn, externalAddr *stun.XORMappedAddress, options Options) bool {
+    log.Info("Hairpin Test: Send binding request to the external address from another socket")
+    conn, err := net.ListenUDP(options.Network, nil)
+    if err != nil {
+        log.Warnf("Error creating hairpin connection: %s", err)
+        return false
+    }
+    defer conn.Close()
+
+    request := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+    if _, err := conn.WriteTo(request.Raw, &net.UDPAddr{IP: externalAddr.IP, Port: externalAddr.Port}); err != nil {
+        log.Warnf("Error sending hairpin request: %s", err)
+        return false
+    }
+
+    timer := time.NewTimer(options.Timeout)
+    defer timer.Stop()
+    for {
+        select {
+        case <-mapTestConn.done:
+            return false
+        case m := <-mapTestConn.requests:
+            if m.TransactionID == request.TransactionID {
+                log.Info("=> NAT hairpin: supported")
+                return true
+            }
+        case <-timer.C:
+            log.Info("=> NAT hairpin: not supported")
+            return false
+        case <-ctx.Done():
+            return false
+        }
+    }
+}
+
+// isLocalAddr 外部地址是否就是本地地址, 本地 socket 监听在任意地址时和本机网卡地址比较
+func isLocalAddr(externalAddr *stun.XORMappedAddress, localAddr net.Addr) bool {
+    local, ok := localAddr.(*net.UDPAddr)
+    if !ok || local.Port != externalAddr.Port {
+        return false
+    }
+    if !local.IP.IsUnspecified() {
+        return local.IP.Equal(externalAddr.IP)
+    }
+    addrs, err := net.InterfaceAddrs()
+    if err != nil {
+        return false
+    }
+    for _, addr := range addrs {
+        if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(externalAddr.IP) {
+            return true
+        }
+    }
+    return false
+}
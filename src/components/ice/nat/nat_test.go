@@ -0,0 +1,116 @@
+package nat
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/pion/stun/v3"
+)
+
+func TestDiscover(t *testing.T) {
+    t.Parallel()
+    cases := []struct {
+        name      string
+        nat       testNAT
+        mapping   Behavior
+        filtering Behavior
+        hairpin   bool
+    }{
+        {"no nat", testNAT{}, EndpointIndependent, EndpointIndependent, true},
+        {"full cone", testNAT{mapping: EndpointIndependent, filtering: EndpointIndependent, hairpin: true}, EndpointIndependent, EndpointIndependent, true},
+        {"restricted cone", testNAT{mapping: EndpointIndependent, filtering: AddressDependent}, EndpointIndependent, AddressDependent, false},
+        {"address dependent", testNAT{mapping: AddressDependent, filtering: AddressDependent}, AddressDependent, AddressDependent, false},
+        {"symmetric", testNAT{mapping: AddressAndPortDependent, filtering: AddressAndPortDependent}, AddressAndPortDependent, AddressAndPortDependent, false},
+    }
+    for _, c := range cases {
+        c := c
+        t.Run(c.name, func(t *testing.T) {
+            t.Parallel()
+            server := newTestSTUNServer(t, c.nat)
+            behavior, err := Discover(context.Background(), server.Addr(), Options{Timeout: 300 * time.Millisecond})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if behavior.Mapping != c.mapping || behavior.Filtering != c.filtering || behavior.Hairpin != c.hairpin {
+                t.Fatalf("unexpected behavior: %+v", behavior)
+            }
+            if behavior.NAT != (c.nat.mapping != "") || behavior.ExternalAddr == "" || behavior.LocalAddr == "" {
+                t.Fatalf("unexpected addresses: %+v", behavior)
+            }
+        })
+    }
+}
+
+func TestDiscoverErrors(t *testing.T) {
+    t.Parallel()
+    // STUN 服务器不支持 RFC 5780 时只返回外部地址
+    server := newTestSTUNServer(t, testNAT{noOtherAddress: true})
+    behavior, err := Discover(context.Background(), server.Addr(), Options{Timeout: 300 * time.Millisecond})
+    if !errors.Is(err, ErrNoOtherAddress) || behavior.ExternalAddr == "" || behavior.Mapping != BehaviorUnknown {
+        t.Fatalf("unexpected result: %+v, err: %v", behavior, err)
+    }
+
+    // 映射测试 II 收到错误响应时返回错误, 映射行为未知
+    server = newTestSTUNServer(t, testNAT{mapping: AddressAndPortDependent, filtering: AddressAndPortDependent, rejectOther: true})
+    behavior, err = Discover(context.Background(), server.Addr(), Options{Timeout: 300 * time.Millisecond})
+    var respErr *ErrorResponse
+    if !errors.As(err, &respErr) || respErr.Code != stun.CodeServerError || behavior.Mapping != BehaviorUnknown {
+        t.Fatalf("unexpected result: %+v, err: %v", behavior, err)
+    }
+
+    // 服务器不支持 CHANGE-REQUEST 时过滤行为未知, 不能当作 endpoint independent
+    server = newTestSTUNServer(t, testNAT{mapping: EndpointIndependent, filtering: AddressAndPortDependent, noChange: true})
+    behavior, err = Discover(context.Background(), server.Addr(), Options{Timeout: 300 * time.Millisecond})
+    if !errors.As(err, &respErr) || respErr.Code != stun.CodeUnknownAttribute ||
+        behavior.Mapping != EndpointIndependent || behavior.Filtering != BehaviorUnknown {
+        t.Fatalf("unexpected result: %+v, err: %v", behavior, err)
+    }
+
+    // ctx 结束后立即返回
+    server = newTestSTUNServer(t, testNAT{mapping: AddressAndPortDependent, filtering: AddressAndPortDependent})
+    ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+    defer cancel()
+    start := time.Now()
+    if _, err := Discover(ctx, server.Addr(), Options{Timeout: 10 * time.Second}); !errors.Is(err, context.DeadlineExceeded) {
+        t.Fatalf("expected deadline exceeded, got: %v", err)
+    }
+    if time.Since(start) > 5*time.Second {
+        t.Fatal("discover should return when ctx is done")
+    }
+}
+
+func TestDiscoverDualStack(t *testing.T) {
+    t.Parallel()
+    options := Options{Timeout: 300 * time.Millisecond}
+
+    server6 := newTestSTUNServer(t, testNAT{ipv6: true})
+    options.Network = NetworkUDP6
+    behavior, err := Discover(context.Background(), server6.Addr(), options)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if behavior.Network != NetworkUDP6 || behavior.NAT || behavior.Mapping != EndpointIndependent || behavior.ExternalAddr[0] != '[' {
+        t.Fatalf("unexpected ipv6 behavior: %+v", behavior)
+    }
+
+    // IPv4 地址的服务器只有 IPv4 检测成功
+    server4 := newTestSTUNServer(t, testNAT{mapping: EndpointIndependent, filtering: AddressDependent})
+    dual := DiscoverDualStack(context.Background(), server4.Addr(), options)
+    if dual.IPv4Error != "" || dual.IPv4.Network != NetworkUDP4 || dual.IPv4.Filtering != AddressDependent || dual.IPv6Error == "" {
+        t.Fatalf("unexpected dual stack behavior: %+v", dual)
+    }
+    if dual.Preferred() != dual.IPv4 {
+        t.Fatal("ipv4 should be preferred")
+    }
+
+    dual = DiscoverDualStack(context.Background(), server6.Addr(), options)
+    if dual.IPv6Error != "" || dual.IPv4Error == "" || dual.Preferred() != dual.IPv6 {
+        t.Fatalf("unexpected dual stack behavior: %+v", dual)
+    }
+
+    if _, err := Discover(context.Background(), server4.Addr(), Options{Network: "tcp4"}); err == nil {
+        t.Fatal("expected unsupported network error")
+    }
+}
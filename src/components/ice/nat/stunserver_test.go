@@ -0,0 +1,278 @@
+package nat
+
+import (
+    "net"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/pion/stun/v3"
+)
+
+// testNAT 测试 STUN 服务器模拟的客户端 NAT, mapping 为空表示没有 NAT
+type testNAT struct {
+    mapping        Behavior
+    filtering      Behavior
+    hairpin        bool
+    noOtherAddress bool          // 模拟不支持 RFC 5780 的 STUN 服务器
+    noChange       bool          // CHANGE-REQUEST 返回 420 错误响应
+    rejectOther    bool          // 另一个 IP 上收到的请求返回 500 错误响应
+    mappingTimeout time.Duration // 映射空闲超过该时间后过期, 重新分配外部地址, 0 不过期
+    portPreserving bool          // 映射过期后重新分配相同的外部端口
+    ipv6           bool          // 监听 ::1, IPv6 回环只有一个地址, 另一个 IP 和主 IP 相同
+}
+
+// testSTUNServer 回环地址上支持 RFC 5780 的 STUN 服务器, 监听 127.0.0.1 和 127.0.0.2 的两个端口
+// 所有客户端都在本机, 由服务器模拟 NAT 的映射和过滤: 响应中的外部地址按映射行为分配, 按过滤行为丢弃响应
+type testSTUNServer struct {
+    nat       testNAT
+    conns     [2][2]*net.UDPConn      // [IP][端口]
+    externals map[string]*net.UDPConn // 映射 key -> 模拟的外部地址
+    internals map[string]*net.UDPAddr // 映射 key -> 客户端地址
+    lastSeen  map[string]time.Time    // 映射最后一次使用时间
+    sent      map[string]bool         // 客户端发送过数据包的目标, 用于模拟过滤
+    closed    bool
+    wg        sync.WaitGroup
+    mu        sync.Mutex
+}
+
+func newTestSTUNServer(t *testing.T, nat testNAT) *testSTUNServer {
+    s := &testSTUNServer{
+        nat:       nat,
+        externals: make(map[string]*net.UDPConn),
+        internals: make(map[string]*net.UDPAddr),
+        lastSeen:  make(map[string]time.Time),
+        sent:      make(map[string]bool),
+    }
+    if nat.ipv6 {
+        for p := 0; p < 2; p++ {
+            conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+            if err != nil {
+                t.Skipf("ipv6 loopback unavailable: %v", err)
+            }
+            s.conns[0][p], s.conns[1][p] = conn, conn
+        }
+        for p := 0; p < 2; p++ {
+            s.wg.Add(1)
+            go s.serve(0, p)
+        }
+        t.Cleanup(s.close)
+        return s
+    }
+    // 127.0.0.2 上使用和 127.0.0.1 相同的端口
+    for attempt := 0; s.conns[1][1] == nil; attempt++ {
+        if attempt == 10 {
+            t.Fatal("listen test stun server failed")
+        }
+        s.closeConns()
+        s.conns = [2][2]*net.UDPConn{}
+        for p := 0; p < 2; p++ {
+            conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+            if err != nil {
+                t.Fatal(err)
+            }
+            s.conns[0][p] = conn
+            other, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: conn.LocalAddr().(*net.UDPAddr).Port})
+            if err != nil {
+                break
+            }
+            s.conns[1][p] = other
+        }
+    }
+    for i := 0; i < 2; i++ {
+        for p := 0; p < 2; p++ {
+            s.wg.Add(1)
+            go s.serve(i, p)
+        }
+    }
+    t.Cleanup(s.close)
+    return s
+}
+
+// Addr 主地址
+func (s *testSTUNServer) Addr() string {
+    return s.conns[0][0].LocalAddr().String()
+}
+
+func (s *testSTUNServer) serve(i, p int) {
+    defer s.wg.Done()
+    conn := s.conns[i][p]
+    buf := make([]byte, 1500)
+    for {
+        n, from, err := conn.ReadFromUDP(buf)
+        if err != nil {
+            return
+        }
+        req := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+        if err := req.Decode(); err != nil || req.Type != stun.BindingRequest {
+            continue
+        }
+        s.handle(req, from, i, p)
+    }
+}
+
+func (s *testSTUNServer) handle(req *stun.Message, from *net.UDPAddr, i, p int) {
+    dst := s.conns[i][p].LocalAddr().(*net.UDPAddr)
+    s.mu.Lock()
+    s.sent[from.String()+"|"+dst.IP.String()] = true
+    s.sent[from.String()+"|"+dst.String()] = true
+    external := s.externalLocked(from, dst)
+    s.mu.Unlock()
+
+    if s.nat.rejectOther && i == 1 {
+        s.reject(req, from, i, p, stun.CodeServerError)
+        return
+    }
+
+    // RESPONSE-PORT: 响应发给请求来源 IP 的指定端口, 即模拟的外部地址, 映射不存在或已过期时 NAT 丢弃响应
+    to := from
+    if value, err := req.Get(stun.AttrResponsePort); err == nil && len(value) == 4 {
+        if s.nat.noOtherAddress {
+            s.reject(req, from, i, p, stun.CodeUnknownAttribute)
+            return
+        }
+        client, ok := s.internal(from, int(value[0])<<8|int(value[1]))
+        if !ok {
+            return
+        }
+        to = client
+    }
+
+    // CHANGE-REQUEST: 0x04 更换 IP, 0x02 更换端口
+    if value, err := req.Get(stun.AttrChangeRequest); err == nil && len(value) == 4 {
+        if s.nat.noChange {
+            s.reject(req, from, i, p, stun.CodeUnknownAttribute)
+            return
+        }
+        if value[3]&0x04 != 0 {
+            i = 1 - i
+        }
+        if value[3]&0x02 != 0 {
+            p = 1 - p
+        }
+    }
+    src := s.conns[i][p]
+    if !s.allowed(to, src.LocalAddr().(*net.UDPAddr)) {
+        return
+    }
+
+    setters := []stun.Setter{
+        stun.NewTransactionIDSetter(req.TransactionID),
+        stun.BindingSuccess,
+        &stun.XORMappedAddress{IP: external.IP, Port: external.Port},
+    }
+    if !s.nat.noOtherAddress {
+        other := s.conns[1-i][1-p].LocalAddr().(*net.UDPAddr)
+        setters = append(setters, &stun.OtherAddress{IP: other.IP, Port: other.Port})
+    }
+    resp := stun.MustBuild(setters...)
+    _, _ = src.WriteToUDP(resp.Raw, to)
+}
+
+// reject 从收到请求的地址返回错误响应
+func (s *testSTUNServer) reject(req *stun.Message, from *net.UDPAddr, i, p int, code stun.ErrorCode) {
+    resp := stun.MustBuild(stun.NewTransactionIDSetter(req.TransactionID), stun.BindingError, code)
+    _, _ = s.conns[i][p].WriteToUDP(resp.Raw, from)
+}
+
+// internal 外部端口 port 对应的客户端地址, 只查找未过期的映射, 不刷新映射
+func (s *testSTUNServer) internal(from *net.UDPAddr, port int) (*net.UDPAddr, bool) {
+    if s.nat.mapping == "" {
+        return &net.UDPAddr{IP: from.IP, Port: port}, true
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for key, conn := range s.externals {
+        if conn.LocalAddr().(*net.UDPAddr).Port != port {
+            continue
+        }
+        if s.nat.mappingTimeout != 0 && time.Since(s.lastSeen[key]) >= s.nat.mappingTimeout {
+            return nil, false
+        }
+        return s.internals[key], true
+    }
+    return nil, false
+}
+
+// externalLocked 按映射行为为客户端分配外部地址, 外部地址收到的数据包在支持 hairpin 时转发给客户端
+func (s *testSTUNServer) externalLocked(from, dst *net.UDPAddr) *net.UDPAddr {
+    var key string
+    switch s.nat.mapping {
+    case "":
+        return from
+    case EndpointIndependent:
+        key = from.String()
+    case AddressDependent:
+        key = from.String() + "|" + dst.IP.String()
+    default:
+        key = from.String() + "|" + dst.String()
+    }
+    if s.closed {
+        return from
+    }
+    now := time.Now()
+    if conn, ok := s.externals[key]; ok {
+        if s.nat.mappingTimeout == 0 || now.Sub(s.lastSeen[key]) < s.nat.mappingTimeout || s.nat.portPreserving {
+            s.lastSeen[key] = now
+            return conn.LocalAddr().(*net.UDPAddr)
+        }
+        _ = conn.Close()
+    }
+    s.lastSeen[key] = now
+    s.internals[key] = from
+    conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        return from
+    }
+    s.externals[key] = conn
+    s.wg.Add(1)
+    go func() {
+        defer s.wg.Done()
+        buf := make([]byte, 1500)
+        for {
+            n, _, err := conn.ReadFromUDP(buf)
+            if err != nil {
+                return
+            }
+            if s.nat.hairpin {
+                _, _ = conn.WriteToUDP(buf[:n], from)
+            }
+        }
+    }()
+    return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// allowed 按过滤行为判断响应能否到达客户端
+func (s *testSTUNServer) allowed(client, src *net.UDPAddr) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    switch s.nat.filtering {
+    case "", EndpointIndependent:
+        return true
+    case AddressDependent:
+        return s.sent[client.String()+"|"+src.IP.String()]
+    default:
+        return s.sent[client.String()+"|"+src.String()]
+    }
+}
+
+func (s *testSTUNServer) closeConns() {
+    for i := 0; i < 2; i++ {
+        for p := 0; p < 2; p++ {
+            if s.conns[i][p] != nil {
+                _ = s.conns[i][p].Close()
+            }
+        }
+    }
+}
+
+func (s *testSTUNServer) close() {
+    s.closeConns()
+    s.mu.Lock()
+    s.closed = true
+    for _, conn := range s.externals {
+        _ = conn.Close()
+    }
+    s.mu.Unlock()
+    s.wg.Wait()
+}
@@ -1,317 +1,70 @@
 package main
 
 import (
+    "context"
+    "encoding/json"
     "errors"
-    "net"
+    "flag"
     "os"
+    "os/signal"
+    "strings"
+    "syscall"
     "time"
 
-    "github.com/pion/logging"
-    "github.com/pion/stun/v3"
+    "kwseeker.top/kwseeker/p2p/src/components/ice/nat"
 )
 
-// taken from https://github.com/pion/stun/blob/master/cmd/stun-nat-behaviour/main.go
-
-var log = logging.NewDefaultLeveledLoggerForScope("", logging.LogLevelDebug, os.Stdout)
-
-func main() {
-    addr := []string{
-        "stun.l.google.com:19302",
-        "192.168.8.100:3478",
-    }
-
-    for _, a := range addr {
-        if err := mappingTests(a); err != nil {
-            log.Errorf("Error: %s\n", err)
-        }
-        //if err := filteringTests(a); err != nil {
-        //    log.Errorf("Error: %s\n", err)
-        //}
-    }
-}
-
-type stunServerConn struct {
-    conn        net.PacketConn
-    LocalAddr   net.Addr
-    RemoteAddr  *net.UDPAddr
-    OtherAddr   *net.UDPAddr
-    messageChan chan *stun.Message
-}
-
-func (c *stunServerConn) Close() error {
-    return c.conn.Close()
-}
-
-const (
-    messageHeaderSize = 20
-)
-
-var (
-    errResponseMessage = errors.New("error reading from response message channel")
-    errTimedOut        = errors.New("timed out waiting for response")
-    errNoOtherAddress  = errors.New("no OTHER-ADDRESS in message")
-)
-
-// RFC5780: 4.3.  Determining NAT Mapping Behavior
-func mappingTests(addrStr string) error {
-    mapTestConn, err := connect(addrStr)
-    if err != nil {
-        log.Warnf("Error creating STUN connection: %s", err)
-        return err
-    }
-
-    // Test I: Regular binding request
-    log.Info("Mapping Test I: Regular binding request")
-    request := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
-
-    resp, err := mapTestConn.roundTrip(request, mapTestConn.RemoteAddr)
-    if err != nil {
-        return err
-    }
-
-    // Parse response message for XOR-MAPPED-ADDRESS and make sure OTHER-ADDRESS valid
-    resps1 := parse(resp)
-    if resps1.xorAddr == nil || resps1.otherAddr == nil {
-        log.Info("Error: NAT discovery feature not supported by this server")
-        return errNoOtherAddress
-    }
-    addr, err := net.ResolveUDPAddr("udp4", resps1.otherAddr.String())
-    if err != nil {
-        log.Infof("Failed resolving OTHER-ADDRESS: %v", resps1.otherAddr)
-        return err
-    }
-    mapTestConn.OtherAddr = addr
-    log.Infof("Received XOR-MAPPED-ADDRESS: %v", resps1.xorAddr)
-
-    // Assert mapping behavior
-    if resps1.xorAddr.String() == mapTestConn.LocalAddr.String() {
-        log.Warn("=> NAT mapping behavior: endpoint independent (no NAT)")
-        return nil
-    }
-
-    // Test II: Send binding request to the other address but primary port
-    log.Info("Mapping Test II: Send binding request to the other address but primary port")
-    oaddr := *mapTestConn.OtherAddr
-    oaddr.Port = mapTestConn.RemoteAddr.Port
-    resp, err = mapTestConn.roundTrip(request, &oaddr)
-    if err != nil {
-        return err
-    }
-
-    // Assert mapping behavior
-    resps2 := parse(resp)
-    log.Infof("Received XOR-MAPPED-ADDRESS: %v", resps2.xorAddr)
-    if resps2.xorAddr.String() == resps1.xorAddr.String() {
-        log.Warn("=> NAT mapping behavior: endpoint independent")
-        return nil
-    }
-
-    // Test III: Send binding request to the other address and port
-    log.Info("Mapping Test III: Send binding request to the other address and port")
-    resp, err = mapTestConn.roundTrip(request, mapTestConn.OtherAddr)
-    if err != nil {
-        return err
-    }
-
-    // Assert mapping behavior
-    resps3 := parse(resp)
-    log.Infof("Received XOR-MAPPED-ADDRESS: %v", resps3.xorAddr)
-    if resps3.xorAddr.String() == resps2.xorAddr.String() {
-        log.Warn("=> NAT mapping behavior: address dependent")
-    } else {
-        log.Warn("=> NAT mapping behavior: address and port dependent")
-    }
-
-    return mapTestConn.Close()
-}
-
-// RFC5780: 4.4.  Determining NAT Filtering Behavior
-func filteringTests(addrStr string) error {
-    mapTestConn, err := connect(addrStr)
-    if err != nil {
-        log.Warnf("Error creating STUN connection: %s", err)
-        return err
-    }
-
-    // Test I: Regular binding request
-    log.Info("Filtering Test I: Regular binding request")
-    request := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
-
-    resp, err := mapTestConn.roundTrip(request, mapTestConn.RemoteAddr)
-    if err != nil || errors.Is(err, errTimedOut) {
-        return err
-    }
-    resps := parse(resp)
-    if resps.xorAddr == nil || resps.otherAddr == nil {
-        log.Warn("Error: NAT discovery feature not supported by this server")
-        return errNoOtherAddress
-    }
-    addr, err := net.ResolveUDPAddr("udp4", resps.otherAddr.String())
-    if err != nil {
-        log.Infof("Failed resolving OTHER-ADDRESS: %v", resps.otherAddr)
-        return err
-    }
-    mapTestConn.OtherAddr = addr
-
-    // Test II: Request to change both IP and port
-    log.Info("Filtering Test II: Request to change both IP and port")
-    request = stun.MustBuild(stun.TransactionID, stun.BindingRequest)
-    request.Add(stun.AttrChangeRequest, []byte{0x00, 0x00, 0x00, 0x06})
-
-    resp, err = mapTestConn.roundTrip(request, mapTestConn.RemoteAddr)
-    if err == nil {
-        parse(resp) // just to print out the resp
-        log.Warn("=> NAT filtering behavior: endpoint independent")
-        return nil
-    } else if !errors.Is(err, errTimedOut) {
-        return err // something else went wrong
-    }
-
-    // Test III: Request to change port only
-    log.Info("Filtering Test III: Request to change port only")
-    request = stun.MustBuild(stun.TransactionID, stun.BindingRequest)
-    request.Add(stun.AttrChangeRequest, []byte{0x00, 0x00, 0x00, 0x02})
-
-    resp, err = mapTestConn.roundTrip(request, mapTestConn.RemoteAddr)
-    if err == nil {
-        parse(resp) // just to print out the resp
-        log.Warn("=> NAT filtering behavior: address dependent")
-    } else if errors.Is(err, errTimedOut) {
-        log.Warn("=> NAT filtering behavior: address and port dependent")
-    }
-
-    return mapTestConn.Close()
+var servers = flag.String("servers", "stun.l.google.com:19302,192.168.8.100:3478", "comma separated STUN servers supporting RFC 5780")
+var timeout = flag.Duration("timeout", 3*time.Second, "timeout of each STUN request")
+var lifetime = flag.Bool("lifetime", false, "also probe how long the NAT keeps an idle UDP mapping, takes several minutes")
+var lifetimeMax = flag.Duration("lifetime-max", 5*time.Minute, "longest idle interval of the mapping lifetime probe")
+var networks = flag.String("network", "udp4,udp6", "comma separated address families to probe, udp4 and/or udp6")
+
+// report 单个 STUN 服务器的检测结果
+type report struct {
+    *nat.NATBehavior
+    Lifetime *nat.BindingLifetime `json:"lifetime,omitempty"`
+    Error    string               `json:"error,omitempty"`
 }
 
-// Parse a STUN message
-func parse(msg *stun.Message) (ret struct {
-    xorAddr    *stun.XORMappedAddress
-    otherAddr  *stun.OtherAddress
-    respOrigin *stun.ResponseOrigin
-    mappedAddr *stun.MappedAddress
-    software   *stun.Software
-},
-) {
-    ret.mappedAddr = &stun.MappedAddress{}
-    ret.xorAddr = &stun.XORMappedAddress{}
-    ret.respOrigin = &stun.ResponseOrigin{}
-    ret.otherAddr = &stun.OtherAddress{}
-    ret.software = &stun.Software{}
-    if ret.xorAddr.GetFrom(msg) != nil {
-        ret.xorAddr = nil
-    }
-    if ret.otherAddr.GetFrom(msg) != nil {
-        ret.otherAddr = nil
-    }
-    if ret.respOrigin.GetFrom(msg) != nil {
-        ret.respOrigin = nil
-    }
-    if ret.mappedAddr.GetFrom(msg) != nil {
-        ret.mappedAddr = nil
-    }
-    if ret.software.GetFrom(msg) != nil {
-        ret.software = nil
-    }
-    log.Debugf("%v", msg)
-    log.Debugf("\tMAPPED-ADDRESS:     %v", ret.mappedAddr)
-    log.Debugf("\tXOR-MAPPED-ADDRESS: %v", ret.xorAddr)
-    log.Debugf("\tRESPONSE-ORIGIN:    %v", ret.respOrigin)
-    log.Debugf("\tOTHER-ADDRESS:      %v", ret.otherAddr)
-    log.Debugf("\tSOFTWARE: %v", ret.software)
-    for _, attr := range msg.Attributes {
-        switch attr.Type {
-        case
-            stun.AttrXORMappedAddress,
-            stun.AttrOtherAddress,
-            stun.AttrResponseOrigin,
-            stun.AttrMappedAddress,
-            stun.AttrSoftware:
-            break //nolint:staticcheck
-        default:
-            log.Debugf("\t%v (l=%v)", attr, attr.Length)
-        }
-    }
-    return ret
-}
-
-// Given an address string, returns a StunServerConn
-func connect(addrStr string) (*stunServerConn, error) {
-    log.Infof("Connecting to STUN server: %s", addrStr)
-    addr, err := net.ResolveUDPAddr("udp4", addrStr)
-    if err != nil {
-        log.Warnf("Error resolving address: %s", err)
-        return nil, err
-    }
-
-    c, err := net.ListenUDP("udp4", nil)
-    if err != nil {
-        return nil, err
-    }
-    log.Infof("Local address: %s", c.LocalAddr())
-    log.Infof("Remote address: %s", addr.String())
-
-    mChan := listen(c)
-
-    return &stunServerConn{
-        conn:        c,
-        LocalAddr:   c.LocalAddr(),
-        RemoteAddr:  addr,
-        messageChan: mChan,
-    }, nil
-}
-
-// Send request and wait for response or timeout
-func (c *stunServerConn) roundTrip(msg *stun.Message, addr net.Addr) (*stun.Message, error) {
-    _ = msg.NewTransactionID()
-    log.Infof("Sending to %v: (%v bytes)", addr, msg.Length+messageHeaderSize)
-    log.Debugf("%v", msg)
-    for _, attr := range msg.Attributes {
-        log.Debugf("\t%v (l=%v)", attr, attr.Length)
-    }
-    _, err := c.conn.WriteTo(msg.Raw, addr)
-    if err != nil {
-        log.Warnf("Error sending request to %v", addr)
-        return nil, err
-    }
-
-    // Wait for response or timeout
-    select {
-    case m, ok := <-c.messageChan:
-        if !ok {
-            return nil, errResponseMessage
+// 检测 NAT 映射和过滤行为, -lifetime 时同时探测映射存活时间, 每个 STUN 服务器的每个地址族输出一行 JSON
+// IPv4 和 IPv6 分别检测, 某个 STUN 服务器所有地址族都失败时退出码为 1
+func main() {
+    flag.Parse()
+    ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+    defer stop()
+
+    failed := false
+    encoder := json.NewEncoder(os.Stdout)
+    for _, server := range strings.Split(*servers, ",") {
+        if server = strings.TrimSpace(server); server == "" {
+            continue
         }
-        return m, nil
-    case <-time.After(time.Duration(3) * time.Second):
-        log.Infof("Timed out waiting for response from server %v", addr)
-        return nil, errTimedOut
-    }
-}
-
-func listen(conn *net.UDPConn) (messages chan *stun.Message) {
-    messages = make(chan *stun.Message)
-    go func() {
-        for {
-            buf := make([]byte, 1024)
-
-            n, addr, err := conn.ReadFromUDP(buf)
-            if err != nil {
-                close(messages)
-                return
+        succeeded := false
+        for _, network := range strings.Split(*networks, ",") {
+            if network = strings.TrimSpace(network); network == "" {
+                continue
+            }
+            behavior, err := nat.Discover(ctx, server, nat.Options{Timeout: *timeout, Network: network})
+            r := report{NATBehavior: behavior}
+            if err == nil && *lifetime {
+                r.Lifetime, err = nat.ProbeLifetime(ctx, server, nat.LifetimeOptions{Timeout: *timeout, Network: network, MaxInterval: *lifetimeMax})
             }
-            log.Infof("Response from %v: (%v bytes)", addr, n)
-            buf = buf[:n]
-
-            m := new(stun.Message)
-            m.Raw = buf
-            err = m.Decode()
             if err != nil {
-                log.Infof("Error decoding message: %v", err)
-                close(messages)
-                return
+                r.Error = err.Error()
+            } else {
+                succeeded = true
             }
-
-            messages <- m
+            _ = encoder.Encode(r)
+            if errors.Is(err, context.Canceled) {
+                os.Exit(1)
+            }
+        }
+        if !succeeded {
+            failed = true
         }
-    }()
-    return
+    }
+    if failed {
+        os.Exit(1)
+    }
 }
@@ -1,6 +1,10 @@
 package message
 
-import "github.com/pion/webrtc/v4"
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/pion/webrtc/v4"
+)
 
 const (
     TypeRegisterRequest = iota + 1
@@ -11,15 +15,132 @@ const (
     TypeSdpResponse
     TypeCandidateRequest
     TypeCandidateResponse
+    TypeErrorResponse // 无法识别请求类型时的错误响应
+    TypePresenceRequest
+    TypePresenceResponse
+    TypeSubscribeRequest
+    TypeSubscribeResponse
+    TypePresenceEvent // 订阅的 Peer 上线、下线时服务器主动推送
+    TypeUnregisterRequest
+    TypeUnregisterResponse
+    TypePeerLeftEvent // 与本端协商过的 Peer 离开信令服务器时服务器主动推送
+    TypeConnectivityRequest
+    TypeConnectivityResponse
+    TypeICEServersRequest // 刷新信令服务器下发的 ICE 服务器(TURN 临时认证信息)
+    TypeICEServersResponse
 )
 
+// ErrorCode 响应错误码
+type ErrorCode string
+
+const (
+    ErrCodeTargetOffline ErrorCode = "target_offline" // 目标 Peer 未注册
+    ErrCodeAuthFailed    ErrorCode = "auth_failed"    // 认证失败
+    ErrCodeMalformed     ErrorCode = "malformed"      // 消息格式错误
+    ErrCodeRateLimited   ErrorCode = "rate_limited"   // 认证失败次数过多，暂时拒绝处理
+    ErrCodeInternal      ErrorCode = "internal"       // 服务端内部错误
+    ErrCodeNotRegistered ErrorCode = "not_registered" // 当前连接未注册或注册已失效
+)
+
+// Error 响应错误信息
+type Error struct {
+    Code    ErrorCode `json:"code"`    // 错误码，供程序判断
+    Message string    `json:"message"` // 错误描述，供用户查看
+}
+
+func NewError(code ErrorCode, message string) *Error {
+    return &Error{
+        Code:    code,
+        Message: message,
+    }
+}
+
+func (e *Error) Error() string {
+    return string(e.Code) + ": " + e.Message
+}
+
+// Result 所有响应共有的处理结果
+type Result struct {
+    Success bool   `json:"success"`
+    Error   *Error `json:"error,omitempty"` // 失败原因, Success 为 false 时有效
+}
+
+func NewResult(success bool) Result {
+    return Result{Success: success}
+}
+
+func NewFailedResult(err *Error) Result {
+    return Result{Success: false, Error: err}
+}
+
+// Err 返回失败原因, 成功时返回 nil
+func (r Result) Err() error {
+    if r.Success {
+        return nil
+    }
+    if r.Error == nil {
+        return NewError(ErrCodeInternal, "unknown error")
+    }
+    return r.Error
+}
+
+// ErrorResponse 请求类型无法识别(消息格式错误、未知类型)时返回
+type ErrorResponse struct {
+    MMeta
+    Result
+}
+
+// NewErrorResponse id 为无法识别的请求的ID, 未知时为空
+func NewErrorResponse(id string, err *Error) ErrorResponse {
+    return ErrorResponse{
+        MMeta: MMeta{
+            Type: TypeErrorResponse,
+            Id:   id,
+        },
+        Result: NewFailedResult(err),
+    }
+}
+
 type MMeta struct {
-    Type int `json:"type"` // 消息类型
+    Type int    `json:"type"`         // 消息类型
+    Id   string `json:"id,omitempty"` // 请求ID, 由请求方生成, 服务器在响应中原样返回用于关联请求和响应
+}
+
+// Meta 返回消息元信息，所有嵌入 MMeta 的消息指针都实现了 Message 接口
+func (m *MMeta) Meta() *MMeta {
+    return m
+}
+
+// Message 信令消息
+type Message interface {
+    Meta() *MMeta
+}
+
+// IsResponse 是否是响应消息
+func (m *MMeta) IsResponse() bool {
+    switch m.Type {
+    case TypeRegisterResponse, TypeHeartbeatResponse, TypeSdpResponse, TypeCandidateResponse, TypeErrorResponse,
+        TypePresenceResponse, TypeSubscribeResponse, TypeUnregisterResponse, TypeConnectivityResponse,
+        TypeICEServersResponse:
+        return true
+    }
+    return false
 }
 
 type RegisterBody struct {
-    Cid      string `json:"cid"`      // Peer ID，比如远程控制场景每个可控终端都有一个唯一ID
-    AuthCode string `json:"authCode"` // 认证码，比如远程控制场景密码认证
+    Cid      string            `json:"cid"`                // Peer ID，比如远程控制场景每个可控终端都有一个唯一ID
+    AuthCode string            `json:"authCode"`           // 认证码，比如远程控制场景密码认证
+    Metadata map[string]string `json:"metadata,omitempty"` // 公开的 Peer 信息，比如设备名称，其他 Peer 可以通过在线状态查询获取
+    Token    string            `json:"token,omitempty"`    // 设备身份凭证，由信令服务器配置的认证后端校验
+    NAT      *NATInfo          `json:"nat,omitempty"`      // 客户端检测到的 NAT 行为，信令服务器据此预测 Peer 间的连通性
+}
+
+// NATInfo Peer 检测到的 NAT 行为，Mapping 和 Filtering 取值见 ice/nat 包的 Behavior
+type NATInfo struct {
+    NAT          bool   `json:"nat"`                    // 是否位于 NAT 之后
+    Mapping      string `json:"mapping"`                // 映射行为
+    Filtering    string `json:"filtering"`              // 过滤行为
+    ExternalAddr string `json:"externalAddr,omitempty"` // STUN 服务器看到的外部地址
 }
 
 type RegisterRequest struct {
@@ -42,36 +163,146 @@ func NewRegisterRequest(cid, authCode string) RegisterRequest {
 type RegisterResponse struct {
     MMeta
     RegisterBody
-    Success bool `json:"success"`
+    Result
+    ICEServers    []webrtc.ICEServer `json:"iceServers,omitempty"`    // 信令服务器下发的 ICE 服务器, 包含有效期有限的 TURN 认证信息
+    ICEServersTTL int64              `json:"iceServersTTL,omitempty"` // ICEServers 中 TURN 认证信息的有效期(秒), 客户端需在过期前通过 ICEServersRequest 刷新
 }
 
+// NewRegisterResponse 响应中不返回认证码和 Token, 避免凭证出现在响应和日志中
 func NewRegisterResponse(registerRequest RegisterRequest, success bool) RegisterResponse {
+    registerBody := registerRequest.RegisterBody
+    registerBody.AuthCode = ""
+    registerBody.Token = ""
     return RegisterResponse{
         MMeta: MMeta{
             Type: TypeRegisterResponse,
+            Id:   registerRequest.Id,
         },
-        RegisterBody: registerRequest.RegisterBody,
-        Success:      success,
+        RegisterBody: registerBody,
+        Result:       NewResult(success),
     }
 }
 
-//type HeartBeatMessage struct {
-//    MMeta
-//}
-//
-//func NewHeartBeatMessage() *HeartBeatMessage {
-//    return &HeartBeatMessage{
-//        MMeta: MMeta{
-//            Type: TypeHeartbeatRequest,
-//        },
-//    }
-//}
+func NewRegisterFailedResponse(registerRequest RegisterRequest, err *Error) RegisterResponse {
+    registerResponse := NewRegisterResponse(registerRequest, false)
+    registerResponse.Result = NewFailedResult(err)
+    return registerResponse
+}
+
+type UnregisterBody struct {
+    Cid string `json:"cid"` // 注销的 Peer ID
+}
+
+// UnregisterRequest 客户端关闭前主动注销, 信令服务器立即删除注册信息
+type UnregisterRequest struct {
+    MMeta
+    UnregisterBody
+}
+
+func NewUnregisterRequest(cid string) UnregisterRequest {
+    return UnregisterRequest{
+        MMeta: MMeta{
+            Type: TypeUnregisterRequest,
+        },
+        UnregisterBody: UnregisterBody{
+            Cid: cid,
+        },
+    }
+}
+
+type UnregisterResponse struct {
+    MMeta
+    UnregisterBody
+    Result
+}
+
+func NewUnregisterResponse(unregisterRequest UnregisterRequest, success bool) UnregisterResponse {
+    return UnregisterResponse{
+        MMeta: MMeta{
+            Type: TypeUnregisterResponse,
+            Id:   unregisterRequest.Id,
+        },
+        UnregisterBody: unregisterRequest.UnregisterBody,
+        Result:         NewResult(success),
+    }
+}
+
+func NewUnregisterFailedResponse(unregisterRequest UnregisterRequest, err *Error) UnregisterResponse {
+    unregisterResponse := NewUnregisterResponse(unregisterRequest, false)
+    unregisterResponse.Result = NewFailedResult(err)
+    return unregisterResponse
+}
+
+// PeerLeftEvent 与本端协商过的 Peer 离开信令服务器(注销、断开、超时), 尚未完成的协商无法继续
+type PeerLeftEvent struct {
+    MMeta
+    Cid string `json:"cid"` // 离开的 Peer ID
+}
+
+func NewPeerLeftEvent(cid string) PeerLeftEvent {
+    return PeerLeftEvent{
+        MMeta: MMeta{
+            Type: TypePeerLeftEvent,
+        },
+        Cid: cid,
+    }
+}
+
+// HeartbeatBody 心跳, 除了维持连接外还可以上报客户端当前状态
+type HeartbeatBody struct {
+    Cid       string `json:"cid"`                 // 来源 Peer ID
+    PeerState string `json:"peerState,omitempty"` // 当前 PeerConnection 连接状态, 可选
+    Timestamp int64  `json:"timestamp"`           // 发送时间(毫秒), 响应中原样返回可用于计算 RTT
+}
+
+type HeartbeatRequest struct {
+    MMeta
+    HeartbeatBody
+}
+
+func NewHeartbeatRequest(cid, peerState string, timestamp int64) HeartbeatRequest {
+    return HeartbeatRequest{
+        MMeta: MMeta{
+            Type: TypeHeartbeatRequest,
+        },
+        HeartbeatBody: HeartbeatBody{
+            Cid:       cid,
+            PeerState: peerState,
+            Timestamp: timestamp,
+        },
+    }
+}
+
+type HeartbeatResponse struct {
+    MMeta
+    HeartbeatBody
+    Result
+}
+
+func NewHeartbeatResponse(heartbeatRequest HeartbeatRequest, success bool) HeartbeatResponse {
+    return HeartbeatResponse{
+        MMeta: MMeta{
+            Type: TypeHeartbeatResponse,
+            Id:   heartbeatRequest.Id,
+        },
+        HeartbeatBody: heartbeatRequest.HeartbeatBody,
+        Result:        NewResult(success),
+    }
+}
+
+func NewHeartbeatFailedResponse(heartbeatRequest HeartbeatRequest, err *Error) HeartbeatResponse {
+    heartbeatResponse := NewHeartbeatResponse(heartbeatRequest, false)
+    heartbeatResponse.Result = NewFailedResult(err)
+    return heartbeatResponse
+}
 
 type SdpBody struct {
-    Sd       webrtc.SessionDescription `json:"sd"`       // SDP
-    From     string                    `json:"from"`     // 来源 Peer ID
-    To       string                    `json:"to"`       // 目标 Peer ID
-    AuthCode string                    `json:"authCode"` // 目标 Peer 的 AuthCode
+    Sd        webrtc.SessionDescription `json:"sd"`                  // SDP
+    From      string                    `json:"from"`                // 来源 Peer ID
+    To        string                    `json:"to"`                  // 目标 Peer ID
+    AuthCode  string                    `json:"authCode"`            // 目标 Peer 的 AuthCode
+    SessionId string                    `json:"sessionId,omitempty"` // 会话ID, 由 Offer 端生成, 同一对 Peer 之间可以同时存在多个会话
+    NoTrickle bool                      `json:"noTrickle,omitempty"` // 发送端不使用 trickle ICE, SDP 已包含全部候选地址; offer 带此标记时 answer 也应包含全部候选地址
 }
 
 type SdpRequest struct {
@@ -96,22 +327,34 @@ func NewSdpRequest(sd webrtc.SessionDescription, from, to, authCode string) SdpR
 type SdpResponse struct {
     MMeta
     SdpBody
-    Success bool `json:"success"`
+    Result
 }
 
 func NewSdpResponse(sdpRequest SdpRequest, success bool) SdpResponse {
     return SdpResponse{
         MMeta: MMeta{
             Type: TypeSdpResponse,
+            Id:   sdpRequest.Id,
         },
         SdpBody: sdpRequest.SdpBody,
+        Result:  NewResult(success),
     }
 }
 
+func NewSdpFailedResponse(sdpRequest SdpRequest, err *Error) SdpResponse {
+    sdpResponse := NewSdpResponse(sdpRequest, false)
+    sdpResponse.Result = NewFailedResult(err)
+    return sdpResponse
+}
+
+// CandidateBody 一批 ICE 候选地址, 包含 sdpMid、sdpMLineIndex、usernameFragment
+// EndOfCandidates 为 true 表示对端本轮候选地址收集完成, 此时 Candidates 可以为空
 type CandidateBody struct {
-    Candidate string `json:"candidate"`
-    From      string `json:"from"` // 来源 Peer ID
-    To        string `json:"to"`   // 目标 Peer ID
+    Candidates      []webrtc.ICECandidateInit `json:"candidates"`
+    EndOfCandidates bool                      `json:"endOfCandidates,omitempty"`
+    From            string                    `json:"from"`                // 来源 Peer ID
+    To              string                    `json:"to"`                  // 目标 Peer ID
+    SessionId       string                    `json:"sessionId,omitempty"` // 会话ID, 同 SdpBody.SessionId
 }
 
 type CandidateRequest struct {
@@ -119,15 +362,16 @@ type CandidateRequest struct {
     CandidateBody
 }
 
-func NewCandidateRequest(candidate, from, to string) CandidateRequest {
+func NewCandidateRequest(candidates []webrtc.ICECandidateInit, endOfCandidates bool, from, to string) CandidateRequest {
     return CandidateRequest{
         MMeta: MMeta{
             Type: TypeCandidateRequest,
         },
         CandidateBody: CandidateBody{
-            Candidate: candidate,
-            From:      from,
-            To:        to,
+            Candidates:      candidates,
+            EndOfCandidates: endOfCandidates,
+            From:            from,
+            To:              to,
         },
     }
 }
@@ -135,15 +379,289 @@ func NewCandidateRequest(candidate, from, to string) CandidateRequest {
 type CandidateResponse struct {
     MMeta
     CandidateBody
-    Success bool `json:"success"`
+    Result
 }
 
 func NewCandidateResponse(candidateRequest CandidateRequest, success bool) CandidateResponse {
     return CandidateResponse{
         MMeta: MMeta{
             Type: TypeCandidateResponse,
+            Id:   candidateRequest.Id,
         },
         CandidateBody: candidateRequest.CandidateBody,
-        Success:       success,
+        Result:        NewResult(success),
+    }
+}
+
+func NewCandidateFailedResponse(candidateRequest CandidateRequest, err *Error) CandidateResponse {
+    candidateResponse := NewCandidateResponse(candidateRequest, false)
+    candidateResponse.Result = NewFailedResult(err)
+    return candidateResponse
+}
+
+// Presence Peer 在线状态
+type Presence struct {
+    Cid          string            `json:"cid"`
+    Online       bool              `json:"online"`
+    RegisteredAt int64             `json:"registeredAt,omitempty"` // 注册时间(毫秒)
+    Metadata     map[string]string `json:"metadata,omitempty"`     // 注册时上报的公开信息
+}
+
+type PresenceBody struct {
+    Cid string `json:"cid"` // 查询的 Peer ID
+}
+
+type PresenceRequest struct {
+    MMeta
+    PresenceBody
+}
+
+func NewPresenceRequest(cid string) PresenceRequest {
+    return PresenceRequest{
+        MMeta: MMeta{
+            Type: TypePresenceRequest,
+        },
+        PresenceBody: PresenceBody{
+            Cid: cid,
+        },
+    }
+}
+
+type PresenceResponse struct {
+    MMeta
+    Presence
+    Result
+}
+
+func NewPresenceResponse(presenceRequest PresenceRequest, presence Presence) PresenceResponse {
+    return PresenceResponse{
+        MMeta: MMeta{
+            Type: TypePresenceResponse,
+            Id:   presenceRequest.Id,
+        },
+        Presence: presence,
+        Result:   NewResult(true),
+    }
+}
+
+func NewPresenceFailedResponse(presenceRequest PresenceRequest, err *Error) PresenceResponse {
+    return PresenceResponse{
+        MMeta: MMeta{
+            Type: TypePresenceResponse,
+            Id:   presenceRequest.Id,
+        },
+        Presence: Presence{Cid: presenceRequest.Cid},
+        Result:   NewFailedResult(err),
+    }
+}
+
+type SubscribeBody struct {
+    Cid         string `json:"cid"`                   // 订阅的 Peer ID
+    Unsubscribe bool   `json:"unsubscribe,omitempty"` // true 表示取消订阅
+}
+
+type SubscribeRequest struct {
+    MMeta
+    SubscribeBody
+}
+
+func NewSubscribeRequest(cid string, unsubscribe bool) SubscribeRequest {
+    return SubscribeRequest{
+        MMeta: MMeta{
+            Type: TypeSubscribeRequest,
+        },
+        SubscribeBody: SubscribeBody{
+            Cid:         cid,
+            Unsubscribe: unsubscribe,
+        },
+    }
+}
+
+type SubscribeResponse struct {
+    MMeta
+    SubscribeBody
+    Presence Presence `json:"presence"` // 订阅时的在线状态
+    Result
+}
+
+func NewSubscribeResponse(subscribeRequest SubscribeRequest, presence Presence) SubscribeResponse {
+    return SubscribeResponse{
+        MMeta: MMeta{
+            Type: TypeSubscribeResponse,
+            Id:   subscribeRequest.Id,
+        },
+        SubscribeBody: subscribeRequest.SubscribeBody,
+        Presence:      presence,
+        Result:        NewResult(true),
+    }
+}
+
+func NewSubscribeFailedResponse(subscribeRequest SubscribeRequest, err *Error) SubscribeResponse {
+    return SubscribeResponse{
+        MMeta: MMeta{
+            Type: TypeSubscribeResponse,
+            Id:   subscribeRequest.Id,
+        },
+        SubscribeBody: subscribeRequest.SubscribeBody,
+        Presence:      Presence{Cid: subscribeRequest.Cid},
+        Result:        NewFailedResult(err),
+    }
+}
+
+// PresenceEvent 订阅的 Peer 上线、下线通知
+type PresenceEvent struct {
+    MMeta
+    Presence
+}
+
+func NewPresenceEvent(presence Presence) PresenceEvent {
+    return PresenceEvent{
+        MMeta: MMeta{
+            Type: TypePresenceEvent,
+        },
+        Presence: presence,
+    }
+}
+
+// Connectivity 信令服务器根据双方 NAT 行为预测的连通性
+type Connectivity string
+
+const (
+    ConnectivityUnknown Connectivity = "unknown"  // 至少一方没有上报 NAT 行为
+    ConnectivityDirect  Connectivity = "direct"   // 打洞可能成功
+    ConnectivityRelay   Connectivity = "relay"    // 打洞基本不可能成功，需要 TURN 中继
+    ConnectivitySameLAN Connectivity = "same-lan" // 双方外部 IP 相同，可能在同一局域网
+)
+
+type ConnectivityBody struct {
+    From string `json:"from"` // 发起连接的 Peer ID
+    To   string `json:"to"`   // 目标 Peer ID
+}
+
+// ConnectivityRequest 发起连接前查询与目标 Peer 的连通性预测
+type ConnectivityRequest struct {
+    MMeta
+    ConnectivityBody
+}
+
+func NewConnectivityRequest(from, to string) ConnectivityRequest {
+    return ConnectivityRequest{
+        MMeta: MMeta{
+            Type: TypeConnectivityRequest,
+        },
+        ConnectivityBody: ConnectivityBody{
+            From: from,
+            To:   to,
+        },
+    }
+}
+
+type ConnectivityResponse struct {
+    MMeta
+    ConnectivityBody
+    Connectivity Connectivity `json:"connectivity"`
+    Result
+}
+
+func NewConnectivityResponse(connectivityRequest ConnectivityRequest, connectivity Connectivity) ConnectivityResponse {
+    return ConnectivityResponse{
+        MMeta: MMeta{
+            Type: TypeConnectivityResponse,
+            Id:   connectivityRequest.Id,
+        },
+        ConnectivityBody: connectivityRequest.ConnectivityBody,
+        Connectivity:     connectivity,
+        Result:           NewResult(true),
+    }
+}
+
+func NewConnectivityFailedResponse(connectivityRequest ConnectivityRequest, err *Error) ConnectivityResponse {
+    connectivityResponse := NewConnectivityResponse(connectivityRequest, ConnectivityUnknown)
+    connectivityResponse.Result = NewFailedResult(err)
+    return connectivityResponse
+}
+
+type ICEServersBody struct {
+    Cid string `json:"cid"` // 已注册的本端 Peer ID
+}
+
+// ICEServersRequest TURN 临时认证信息过期前重新获取, 不需要重新注册
+type ICEServersRequest struct {
+    MMeta
+    ICEServersBody
+}
+
+func NewICEServersRequest(cid string) ICEServersRequest {
+    return ICEServersRequest{
+        MMeta: MMeta{
+            Type: TypeICEServersRequest,
+        },
+        ICEServersBody: ICEServersBody{
+            Cid: cid,
+        },
+    }
+}
+
+type ICEServersResponse struct {
+    MMeta
+    ICEServersBody
+    Result
+    ICEServers    []webrtc.ICEServer `json:"iceServers,omitempty"`    // 同 RegisterResponse.ICEServers
+    ICEServersTTL int64              `json:"iceServersTTL,omitempty"` // 同 RegisterResponse.ICEServersTTL
+}
+
+func NewICEServersResponse(iceServersRequest ICEServersRequest, iceServers []webrtc.ICEServer, ttl int64) ICEServersResponse {
+    return ICEServersResponse{
+        MMeta: MMeta{
+            Type: TypeICEServersResponse,
+            Id:   iceServersRequest.Id,
+        },
+        ICEServersBody: iceServersRequest.ICEServersBody,
+        Result:         NewResult(true),
+        ICEServers:     iceServers,
+        ICEServersTTL:  ttl,
+    }
+}
+
+func NewICEServersFailedResponse(iceServersRequest ICEServersRequest, err *Error) ICEServersResponse {
+    iceServersResponse := NewICEServersResponse(iceServersRequest, nil, 0)
+    iceServersResponse.Result = NewFailedResult(err)
+    return iceServersResponse
+}
+
+// sensitiveFields 日志中隐藏的字段: 认证码、设备 Token 和 TURN 临时密码
+var sensitiveFields = map[string]bool{"authCode": true, "token": true, "credential": true}
+
+// Redact 隐藏 JSON 消息中的认证信息后用于记录日志, 无法解析时只记录长度
+func Redact(raw []byte) string {
+    var v interface{}
+    if err := json.Unmarshal(raw, &v); err != nil {
+        return fmt.Sprintf("<%d bytes>", len(raw))
+    }
+    scrub(v)
+    redacted, err := json.Marshal(v)
+    if err != nil {
+        return fmt.Sprintf("<%d bytes>", len(raw))
+    }
+    return string(redacted)
+}
+
+// scrub 递归替换非空的敏感字段
+func scrub(v interface{}) {
+    switch value := v.(type) {
+    case map[string]interface{}:
+        for key, field := range value {
+            if sensitiveFields[key] {
+                if str, ok := field.(string); !ok || str != "" {
+                    value[key] = "***"
+                }
+                continue
+            }
+            scrub(field)
+        }
+    case []interface{}:
+        for _, field := range value {
+            scrub(field)
+        }
     }
 }
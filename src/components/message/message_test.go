@@ -0,0 +1,59 @@
+package message
+
+import (
+    "encoding/json"
+    "errors"
+    "github.com/pion/webrtc/v4"
+    "testing"
+)
+
+func TestFailedResponseJSON(t *testing.T) {
+    request := NewCandidateRequest([]webrtc.ICECandidateInit{{Candidate: "candidate:1 1 udp 1 127.0.0.1 9 typ host"}}, false, "c1", "c2")
+    data, err := json.Marshal(NewCandidateFailedResponse(request, NewError(ErrCodeTargetOffline, "target peer c2 is offline")))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // 客户端不关心具体响应类型时，直接解析共有的 Result
+    result := Result{}
+    if err := json.Unmarshal(data, &result); err != nil {
+        t.Fatal(err)
+    }
+    if result.Success {
+        t.Fatal("expected failed result")
+    }
+    var e *Error
+    if !errors.As(result.Err(), &e) || e.Code != ErrCodeTargetOffline {
+        t.Fatalf("unexpected error: %v", result.Err())
+    }
+
+    if err := NewResult(true).Err(); err != nil {
+        t.Fatalf("unexpected error for success result: %v", err)
+    }
+    if err := NewResult(false).Err(); err == nil {
+        t.Fatal("expected error for failed result without reason")
+    }
+}
+
+func TestCandidateBodyJSON(t *testing.T) {
+    mid, index, ufrag := "0", uint16(0), "abcd"
+    request := NewCandidateRequest([]webrtc.ICECandidateInit{
+        {Candidate: "candidate:1 1 udp 1 127.0.0.1 9 typ host", SDPMid: &mid, SDPMLineIndex: &index, UsernameFragment: &ufrag},
+    }, true, "c1", "c2")
+    data, err := json.Marshal(request)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    decoded := CandidateRequest{}
+    if err := json.Unmarshal(data, &decoded); err != nil {
+        t.Fatal(err)
+    }
+    if !decoded.EndOfCandidates || len(decoded.Candidates) != 1 {
+        t.Fatalf("unexpected candidate body: %+v", decoded.CandidateBody)
+    }
+    candidate := decoded.Candidates[0]
+    if *candidate.SDPMid != mid || *candidate.SDPMLineIndex != index || *candidate.UsernameFragment != ufrag {
+        t.Fatalf("unexpected candidate: %+v", candidate)
+    }
+}
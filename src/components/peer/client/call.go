@@ -0,0 +1,86 @@
+package client
+
+import (
+    "encoding/json"
+    "errors"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "strconv"
+    "sync/atomic"
+    "time"
+)
+
+const defaultRequestTimeout = 10 * time.Second
+
+var (
+    ErrRequestTimeout = errors.New("signal request timeout")
+    ErrNotConnected   = errors.New("not connected to signal server")
+)
+
+// writeJSON 向信令服务器发送消息, WebSocket 连接不支持并发写
+func (c *Client) writeJSON(v interface{}) error {
+    c.writeMux.Lock()
+    defer c.writeMux.Unlock()
+    if c.signalConn == nil {
+        return ErrNotConnected
+    }
+    return c.signalConn.WriteJSON(v)
+}
+
+func (c *Client) nextRequestId() string {
+    return strconv.FormatUint(atomic.AddUint64(&c.requestSeq, 1), 10)
+}
+
+// Call 发送信令请求并阻塞等待信令服务器返回对应的响应
+// resp 为响应结构体指针，不关心响应内容时可以传 nil；
+// 信令服务器返回处理失败时返回 *message.Error，超时返回 ErrRequestTimeout
+func (c *Client) Call(req message.Message, resp interface{}, timeout time.Duration) error {
+    id := c.nextRequestId()
+    req.Meta().Id = id
+    respChan := make(chan []byte, 1)
+    c.pendingMux.Lock()
+    c.pendingRequests[id] = respChan
+    c.pendingMux.Unlock()
+    defer func() {
+        c.pendingMux.Lock()
+        delete(c.pendingRequests, id)
+        c.pendingMux.Unlock()
+    }()
+
+    if err := c.writeJSON(req); err != nil {
+        return err
+    }
+
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+    select {
+    case msg := <-respChan:
+        result := message.Result{}
+        if err := json.Unmarshal(msg, &result); err != nil {
+            return err
+        }
+        if resp != nil {
+            if err := json.Unmarshal(msg, resp); err != nil {
+                return err
+            }
+        }
+        return result.Err()
+    case <-timer.C:
+        return ErrRequestTimeout
+    }
+}
+
+// deliverResponse 将响应交给等待中的 Call，没有对应的等待者时返回 false
+func (c *Client) deliverResponse(id string, msg []byte) bool {
+    if id == "" {
+        return false
+    }
+    c.pendingMux.Lock()
+    respChan, ok := c.pendingRequests[id]
+    delete(c.pendingRequests, id)
+    c.pendingMux.Unlock()
+    if !ok {
+        return false
+    }
+    respChan <- msg
+    return true
+}
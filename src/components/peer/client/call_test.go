@@ -0,0 +1,97 @@
+package client
+
+import (
+    "encoding/json"
+    "errors"
+    "github.com/gorilla/websocket"
+    "github.com/pion/webrtc/v4"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+// 模拟信令服务器: 先返回一个无关ID的响应, 再返回对应请求的响应; To 为 offline 时返回失败, 为 silent 时不响应
+func newCallTestServer(t *testing.T) *httptest.Server {
+    upgrader := websocket.Upgrader{}
+    return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err != nil {
+            t.Errorf("upgrade: %v", err)
+            return
+        }
+        defer conn.Close()
+        for {
+            sdpRequest := message.SdpRequest{}
+            if err := conn.ReadJSON(&sdpRequest); err != nil {
+                return
+            }
+            if sdpRequest.To == "silent" {
+                continue
+            }
+            stale := message.NewSdpResponse(sdpRequest, true)
+            stale.Id = "stale"
+            response := message.NewSdpResponse(sdpRequest, true)
+            if sdpRequest.To == "offline" {
+                response = message.NewSdpFailedResponse(sdpRequest, message.NewError(message.ErrCodeTargetOffline, "offline"))
+            }
+            _ = conn.WriteJSON(stale)
+            _ = conn.WriteJSON(response)
+        }
+    }))
+}
+
+func newCallTestClient(t *testing.T, serverUrl string) *Client {
+    c := NewClient(&Option{Cid: "c1"})
+    conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(serverUrl, "http"), nil)
+    if err != nil {
+        t.Fatalf("dial: %v", err)
+    }
+    c.signalConn = conn
+    go func() {
+        for {
+            _, msg, err := conn.ReadMessage()
+            if err != nil {
+                return
+            }
+            m := message.MMeta{}
+            if err := json.Unmarshal(msg, &m); err == nil {
+                c.deliverResponse(m.Id, msg)
+            }
+        }
+    }()
+    return c
+}
+
+func TestCall(t *testing.T) {
+    server := newCallTestServer(t)
+    defer server.Close()
+    c := newCallTestClient(t, server.URL)
+    defer c.signalConn.Close()
+
+    offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0"}
+    request := message.NewSdpRequest(offer, "c1", "c2", "123456")
+    response := message.SdpResponse{}
+    if err := c.Call(&request, &response, time.Second); err != nil {
+        t.Fatalf("call: %v", err)
+    }
+    if response.Id != request.Id || response.To != "c2" {
+        t.Fatalf("unexpected response: %+v", response)
+    }
+
+    request = message.NewSdpRequest(offer, "c1", "offline", "123456")
+    var e *message.Error
+    if err := c.Call(&request, nil, time.Second); !errors.As(err, &e) || e.Code != message.ErrCodeTargetOffline {
+        t.Fatalf("expected target offline error, got: %v", err)
+    }
+
+    request = message.NewSdpRequest(offer, "c1", "silent", "123456")
+    if err := c.Call(&request, nil, 50*time.Millisecond); !errors.Is(err, ErrRequestTimeout) {
+        t.Fatalf("expected timeout, got: %v", err)
+    }
+    if len(c.pendingRequests) != 0 {
+        t.Fatalf("pending requests not cleaned: %d", len(c.pendingRequests))
+    }
+}
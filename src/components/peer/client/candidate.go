@@ -0,0 +1,200 @@
+package client
+
+import (
+    "github.com/pion/webrtc/v4"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "log"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    candidateBatchWindow      = 50 * time.Millisecond // 候选地址合并发送的时间窗口
+    maxEarlyCandidateSessions = 64                    // 最多为多少个尚未建立的会话暂存对端候选地址
+    maxEarlyCandidateMessages = 32                    // 每个尚未建立的会话最多暂存的候选地址消息数
+)
+
+// candidateQueue 会话的双向候选地址队列
+// 本端候选地址在批量发送窗口内或收到对端 SDP 前暂存, 对端候选地址在 SetRemoteDescription 前暂存,
+// 两个方向以及 SetRemoteDescription 都在 mu 保护下进行, 保证每个候选地址恰好处理一次
+type candidateQueue struct {
+    outbound      []webrtc.ICECandidateInit // 待发送的本端候选地址
+    gatheringDone bool                      // 本轮候选地址收集完成, 随下一批候选地址发送 end-of-candidates
+    batchTimer    *time.Timer               // 批量发送窗口定时器
+    complete      bool                      // 本端 SDP 已包含全部候选地址(vanilla ICE), 不再单独发送候选地址
+    inbound       []webrtc.ICECandidateInit // 等待 SetRemoteDescription 的对端候选地址
+    remoteDone    bool                      // 对端 end-of-candidates 在 SetRemoteDescription 前到达
+    mu            sync.Mutex
+}
+
+// setRemoteDescription 设置对端描述信息并添加之前暂存的对端候选地址
+func (s *Session) setRemoteDescription(sd webrtc.SessionDescription) error {
+    s.candidates.mu.Lock()
+    defer s.candidates.mu.Unlock()
+    if err := s.peerConn.SetRemoteDescription(sd); err != nil {
+        return err
+    }
+    inbound, remoteDone := s.candidates.inbound, s.candidates.remoteDone
+    s.candidates.inbound, s.candidates.remoteDone = nil, false
+    if len(inbound) > 0 || remoteDone {
+        log.Printf("add %d queued remote candidates, session=%s\n", len(inbound), s.id)
+    }
+    s.addRemoteCandidatesLocked(inbound, remoteDone)
+    return nil
+}
+
+// handleCandidate 收到对端的候选地址信息后，记录到 peerConnection, 还没有对端描述信息时先暂存
+func (s *Session) handleCandidate(candidateMessage message.CandidateRequest) {
+    s.candidates.mu.Lock()
+    defer s.candidates.mu.Unlock()
+    if s.peerConn.RemoteDescription() == nil {
+        s.candidates.inbound = append(s.candidates.inbound, candidateMessage.Candidates...)
+        s.candidates.remoteDone = s.candidates.remoteDone || candidateMessage.EndOfCandidates
+        return
+    }
+    s.addRemoteCandidatesLocked(candidateMessage.Candidates, candidateMessage.EndOfCandidates)
+}
+
+// addRemoteCandidatesLocked 需持有 s.candidates.mu
+func (s *Session) addRemoteCandidatesLocked(candidates []webrtc.ICECandidateInit, endOfCandidates bool) {
+    remoteUfrag := iceUfrag(s.peerConn.RemoteDescription().SDP)
+    for _, candidate := range candidates {
+        // ICE 重启后对端的 ufrag 已变化, 丢弃重启前收集的候选地址
+        if candidate.UsernameFragment != nil && remoteUfrag != "" && *candidate.UsernameFragment != remoteUfrag {
+            log.Printf("discard stale candidate, session=%s, ufrag=%s\n", s.id, *candidate.UsernameFragment)
+            continue
+        }
+        if err := s.peerConn.AddICECandidate(candidate); err != nil {
+            log.Printf("AddICECandidate failed: %v", err)
+        }
+    }
+    if endOfCandidates {
+        // 对端候选地址收集完成, 空候选地址表示 end-of-candidates
+        log.Printf("remote end-of-candidates, session=%s\n", s.id)
+        if err := s.peerConn.AddICECandidate(webrtc.ICECandidateInit{}); err != nil {
+            log.Printf("AddICECandidate end-of-candidates failed: %v", err)
+        }
+    }
+}
+
+// onICECandidate 处理ICE返回候选地址事件, candidate 为 nil 表示本轮收集完成
+// 候选地址在 candidateBatchWindow 内合并发送, 收集完成时立即发送剩余候选地址和 end-of-candidates
+func (s *Session) onICECandidate(candidate *webrtc.ICECandidate) {
+    s.candidates.mu.Lock()
+    defer s.candidates.mu.Unlock()
+
+    if candidate == nil {
+        log.Printf("onICECandidate, session=%s, gathering complete\n", s.id)
+        s.candidates.gatheringDone = true
+        s.flushCandidatesLocked()
+        return
+    }
+
+    init := candidate.ToJSON()
+    log.Printf("onICECandidate, session=%s, candidate=%s\n", s.id, init.Candidate)
+    if desc := s.peerConn.LocalDescription(); desc != nil {
+        ufrag := iceUfrag(desc.SDP)
+        init.UsernameFragment = &ufrag
+    }
+    if s.candidates.complete {
+        return
+    }
+    s.candidates.outbound = append(s.candidates.outbound, init)
+    if s.candidates.batchTimer == nil {
+        s.candidates.batchTimer = time.AfterFunc(candidateBatchWindow, s.flushCandidates)
+    }
+}
+
+func (s *Session) flushCandidates() {
+    s.candidates.mu.Lock()
+    defer s.candidates.mu.Unlock()
+    s.flushCandidatesLocked()
+}
+
+// flushCandidatesLocked 通过信令服务器转发暂存的本端候选地址, 收到对端 SDP 前继续暂存, 需持有 s.candidates.mu
+func (s *Session) flushCandidatesLocked() {
+    if s.candidates.batchTimer != nil {
+        s.candidates.batchTimer.Stop()
+        s.candidates.batchTimer = nil
+    }
+    if s.candidates.complete {
+        s.candidates.outbound = nil
+        s.candidates.gatheringDone = false
+        return
+    }
+    if s.peerConn.RemoteDescription() == nil {
+        return
+    }
+    if len(s.candidates.outbound) == 0 && !s.candidates.gatheringDone {
+        return
+    }
+    // 发送ICE候选地址到信令服务器, 与信令服务器断开时暂存, 重连后发送
+    candidateMessage := message.NewCandidateRequest(s.candidates.outbound, s.candidates.gatheringDone, s.client.cid, s.remoteCid)
+    candidateMessage.SessionId = s.id
+    if err := s.client.sendOrQueue(candidateMessage); err != nil {
+        log.Printf("signal candidates failed, session=%s, err: %v\n", s.id, err)
+        return
+    }
+    s.candidates.outbound = nil
+    s.candidates.gatheringDone = false
+}
+
+// stopCandidates 会话关闭时停止批量发送定时器
+func (s *Session) stopCandidates() {
+    s.candidates.mu.Lock()
+    defer s.candidates.mu.Unlock()
+    if s.candidates.batchTimer != nil {
+        s.candidates.batchTimer.Stop()
+        s.candidates.batchTimer = nil
+    }
+}
+
+// iceUfrag 从 SDP 中解析 ICE usernameFragment
+func iceUfrag(sdp string) string {
+    for _, line := range strings.Split(sdp, "\n") {
+        if ufrag, ok := strings.CutPrefix(strings.TrimSpace(line), "a=ice-ufrag:"); ok {
+            return ufrag
+        }
+    }
+    return ""
+}
+
+// handleCandidate 将候选地址交给对应的会话处理, 会话还未建立(offer 尚未到达)时暂存, 创建会话时取出
+func (c *Client) handleCandidate(candidateMessage message.CandidateRequest) {
+    key := sessionKey{candidateMessage.From, candidateMessage.SessionId}
+    c.sessionsMux.Lock()
+    s := c.sessions[key]
+    if s == nil {
+        early := c.earlyCandidates[key]
+        if (early == nil && len(c.earlyCandidates) >= maxEarlyCandidateSessions) || len(early) >= maxEarlyCandidateMessages {
+            log.Printf("drop candidate from %s, session=%s\n", candidateMessage.From, candidateMessage.SessionId)
+        } else {
+            c.earlyCandidates[key] = append(early, candidateMessage)
+        }
+    }
+    c.sessionsMux.Unlock()
+    if s != nil {
+        s.handleCandidate(candidateMessage)
+    }
+}
+
+// takeEarlyCandidates 取出会话建立前到达的候选地址
+func (c *Client) takeEarlyCandidates(key sessionKey) []message.CandidateRequest {
+    c.sessionsMux.Lock()
+    defer c.sessionsMux.Unlock()
+    early := c.earlyCandidates[key]
+    delete(c.earlyCandidates, key)
+    return early
+}
+
+// dropEarlyCandidates 对端离开信令服务器后不会再发起会话, 清理为其暂存的候选地址
+func (c *Client) dropEarlyCandidates(cid string) {
+    c.sessionsMux.Lock()
+    defer c.sessionsMux.Unlock()
+    for key := range c.earlyCandidates {
+        if key.cid == cid {
+            delete(c.earlyCandidates, key)
+        }
+    }
+}
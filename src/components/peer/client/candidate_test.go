@@ -0,0 +1,254 @@
+package client
+
+import (
+    "github.com/pion/logging"
+    "github.com/pion/transport/v3/vnet"
+    "github.com/pion/webrtc/v4"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "strings"
+    "testing"
+    "time"
+)
+
+// newVNetClient 创建使用虚拟网络的 Client, 不连接信令服务器, 信令消息暂存在 unsent 中由测试转发
+func newVNetClient(t *testing.T, wan *vnet.Router, cid, ip string, vanillaICE bool) *Client {
+    vnetNet, err := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{ip}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := wan.AddNet(vnetNet); err != nil {
+        t.Fatal(err)
+    }
+    settingEngine := webrtc.SettingEngine{}
+    settingEngine.SetNet(vnetNet)
+    settingEngine.SetICETimeouts(time.Second, time.Second, 200*time.Millisecond)
+
+    c := NewClient(&Option{Cid: cid, ICERestartAttempts: -1, VanillaICE: vanillaICE})
+    c.api = webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine))
+    t.Cleanup(c.Close)
+    return c
+}
+
+func takeUnsent(c *Client) []interface{} {
+    c.queueMux.Lock()
+    defer c.queueMux.Unlock()
+    unsent := c.unsent
+    c.unsent = nil
+    return unsent
+}
+
+// deliver 模拟信令服务器转发, candidateFirst 为 true 时候选地址先于 SDP 到达
+func deliver(to *Client, msgs []interface{}, candidateFirst bool) {
+    for _, deliverCandidates := range []bool{candidateFirst, !candidateFirst} {
+        for _, msg := range msgs {
+            switch m := msg.(type) {
+            case message.CandidateRequest:
+                if deliverCandidates {
+                    to.handleCandidate(m)
+                }
+            case message.SdpRequest:
+                if !deliverCandidates {
+                    to.handleSdp(m)
+                }
+            }
+        }
+    }
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+    deadline := time.Now().Add(10 * time.Second)
+    for !cond() {
+        if time.Now().After(deadline) {
+            t.Fatalf("wait %s timeout", what)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func TestCandidateQueue(t *testing.T) {
+    wan, err := vnet.NewRouter(&vnet.RouterConfig{CIDR: "1.2.3.0/24", LoggerFactory: logging.NewDefaultLoggerFactory()})
+    if err != nil {
+        t.Fatal(err)
+    }
+    offerClient := newVNetClient(t, wan, "offer-peer", "1.2.3.4", false)
+    answerClient := newVNetClient(t, wan, "answer-peer", "1.2.3.5", false)
+    if err := wan.Start(); err != nil {
+        t.Fatal(err)
+    }
+    defer func() {
+        _ = wan.Stop()
+    }()
+
+    offerSession, err := offerClient.newSession("answer-peer", "", newSessionId(), true, offerClient.webrtcConfiguration())
+    if err != nil {
+        t.Fatal(err)
+    }
+    offerClient.addSession(offerSession)
+    offerSdp, err := offerSession.createOffer(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // 1 Offer 端收到 answer 前候选地址暂存在本端, 不会发送
+    waitFor(t, "offer gathering", func() bool {
+        offerSession.candidates.mu.Lock()
+        defer offerSession.candidates.mu.Unlock()
+        return offerSession.candidates.gatheringDone
+    })
+    if unsent := takeUnsent(offerClient); len(unsent) != 0 {
+        t.Fatalf("candidates should not be sent before answer: %v", unsent)
+    }
+
+    // 2 对端候选地址先于 offer 到达, Answer 端还没有会话, 暂存到 Client
+    offerSession.candidates.mu.Lock()
+    early := message.NewCandidateRequest(offerSession.candidates.outbound, true, "offer-peer", "answer-peer")
+    offerSession.candidates.mu.Unlock()
+    early.SessionId = offerSession.ID()
+    answerClient.handleCandidate(early)
+    if len(answerClient.earlyCandidates) != 1 {
+        t.Fatal("early candidates should be queued")
+    }
+    answerClient.handleSdp(offerSdp)
+    if len(answerClient.earlyCandidates) != 0 {
+        t.Fatal("early candidates should be taken by the new session")
+    }
+    answerSession := answerClient.getSession("offer-peer", offerSession.ID())
+    if answerSession == nil {
+        t.Fatal("answer session not created")
+    }
+
+    // 3 answer 的候选地址先于 answer SDP 到达 Offer 端, 设置对端描述信息前暂存
+    var fromAnswer []interface{}
+    waitFor(t, "answer candidates", func() bool {
+        fromAnswer = append(fromAnswer, takeUnsent(answerClient)...)
+        for _, msg := range fromAnswer {
+            if m, ok := msg.(message.CandidateRequest); ok && m.EndOfCandidates {
+                return true
+            }
+        }
+        return false
+    })
+    deliver(offerClient, fromAnswer, true)
+    offerSession.candidates.mu.Lock()
+    inbound, outbound := len(offerSession.candidates.inbound), len(offerSession.candidates.outbound)
+    offerSession.candidates.mu.Unlock()
+    if inbound != 0 || outbound != 0 {
+        t.Fatalf("queues should be drained after answer, inbound=%d, outbound=%d", inbound, outbound)
+    }
+
+    // 4 本端暂存的候选地址在收到 answer 后恰好发送一次
+    sent := 0
+    for _, msg := range takeUnsent(offerClient) {
+        if m, ok := msg.(message.CandidateRequest); ok {
+            sent += len(m.Candidates)
+        }
+    }
+    if sent != len(early.Candidates) {
+        t.Fatalf("unexpected sent candidates: %d, gathered: %d", sent, len(early.Candidates))
+    }
+
+    waitFor(t, "peer connection", func() bool {
+        return offerSession.peerConn.ConnectionState() == webrtc.PeerConnectionStateConnected &&
+            answerSession.peerConn.ConnectionState() == webrtc.PeerConnectionStateConnected
+    })
+}
+
+func TestCandidateQueueBeforeRemoteDescription(t *testing.T) {
+    c := NewClient(&Option{Cid: "local-peer"})
+    defer c.Close()
+    s, err := c.newSession("remote-peer", "", newSessionId(), false, c.webrtcConfiguration())
+    if err != nil {
+        t.Fatal(err)
+    }
+    c.addSession(s)
+
+    candidate := "candidate:1 1 udp 2130706431 1.2.3.4 5000 typ host"
+    request := message.NewCandidateRequest([]webrtc.ICECandidateInit{{Candidate: candidate}}, true, "remote-peer", "local-peer")
+    request.SessionId = s.ID()
+    c.handleCandidate(request)
+
+    s.candidates.mu.Lock()
+    defer s.candidates.mu.Unlock()
+    if len(s.candidates.inbound) != 1 || !s.candidates.remoteDone {
+        t.Fatalf("candidate should be queued, inbound=%d, remoteDone=%v", len(s.candidates.inbound), s.candidates.remoteDone)
+    }
+}
+
+func TestVanillaICE(t *testing.T) {
+    cases := []struct {
+        name          string
+        offerVanilla  bool
+        answerVanilla bool
+    }{
+        {"vanilla offer, trickle answer", true, false},
+        {"trickle offer, vanilla answer", false, true},
+        {"vanilla offer, vanilla answer", true, true},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            wan, err := vnet.NewRouter(&vnet.RouterConfig{CIDR: "1.2.3.0/24", LoggerFactory: logging.NewDefaultLoggerFactory()})
+            if err != nil {
+                t.Fatal(err)
+            }
+            offerClient := newVNetClient(t, wan, "offer-peer", "1.2.3.4", tc.offerVanilla)
+            answerClient := newVNetClient(t, wan, "answer-peer", "1.2.3.5", tc.answerVanilla)
+            if err := wan.Start(); err != nil {
+                t.Fatal(err)
+            }
+            defer func() {
+                _ = wan.Stop()
+            }()
+
+            offerSession, err := offerClient.newSession("answer-peer", "", newSessionId(), true, offerClient.webrtcConfiguration())
+            if err != nil {
+                t.Fatal(err)
+            }
+            offerClient.addSession(offerSession)
+            offerSdp, err := offerSession.createOffer(nil)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if offerSdp.NoTrickle != tc.offerVanilla {
+                t.Fatalf("unexpected offer noTrickle: %v", offerSdp.NoTrickle)
+            }
+            answerClient.handleSdp(offerSdp)
+            answerSession := answerClient.getSession("offer-peer", offerSession.ID())
+            if answerSession == nil {
+                t.Fatal("answer session not created")
+            }
+
+            // 不使用 trickle 的一端不发送 CandidateRequest, 对端 offer 不使用 trickle 时 answer 也不使用
+            answerComplete := tc.offerVanilla || tc.answerVanilla
+            var answerSdp *message.SdpRequest
+            offerCandidates, answerCandidates := 0, 0
+            waitFor(t, "peer connection", func() bool {
+                for _, msg := range takeUnsent(answerClient) {
+                    switch m := msg.(type) {
+                    case message.SdpRequest:
+                        answerSdp = &m
+                    case message.CandidateRequest:
+                        answerCandidates++
+                    }
+                    deliver(offerClient, []interface{}{msg}, false)
+                }
+                for _, msg := range takeUnsent(offerClient) {
+                    if _, ok := msg.(message.CandidateRequest); ok {
+                        offerCandidates++
+                    }
+                    deliver(answerClient, []interface{}{msg}, false)
+                }
+                return offerSession.peerConn.ConnectionState() == webrtc.PeerConnectionStateConnected &&
+                    answerSession.peerConn.ConnectionState() == webrtc.PeerConnectionStateConnected
+            })
+            if answerSdp == nil || answerSdp.NoTrickle != answerComplete {
+                t.Fatalf("unexpected answer: %+v", answerSdp)
+            }
+            if answerComplete && (answerCandidates != 0 || !strings.Contains(answerSdp.Sd.SDP, "a=candidate")) {
+                t.Fatalf("answer should embed all candidates, candidate messages=%d", answerCandidates)
+            }
+            if tc.offerVanilla && (offerCandidates != 0 || !strings.Contains(offerSdp.Sd.SDP, "a=candidate")) {
+                t.Fatalf("offer should embed all candidates, candidate messages=%d", offerCandidates)
+            }
+        })
+    }
+}
@@ -1,16 +1,16 @@
 package client
 
 import (
+    "context"
+    "crypto/tls"
     "encoding/json"
     "github.com/gorilla/websocket"
     "github.com/pion/webrtc/v4"
+    "kwseeker.top/kwseeker/p2p/src/components/ice/nat"
     "kwseeker.top/kwseeker/p2p/src/components/message"
     "log"
-    "net/url"
-    "os"
-    "os/signal"
+    "strings"
     "sync"
-    "syscall"
     "time"
 )
 
@@ -19,372 +19,381 @@ const (
     PeerTypeAnswer
 )
 
+const defaultPingInterval = 20 * time.Second
+
 type Option struct {
-    SignalServerAddr string // 信令服务器地址
-    SignalServerPath string
-    PingIntervalSec  int
-    ICEServerAddr    string // ICE服务器地址
-    PeerType         int    // Peer类型
-    Cid              string // 客户端ID
-    AuthCode         string // 认证码
+    SignalServerAddr     string // 信令服务器地址
+    SignalServerPath     string
+    SignalServerTLS      *tls.Config // 不为 nil 时使用 wss 连接信令服务器, 可配置自定义 CA 和客户端证书, 见 NewTLSConfig
+    PingIntervalSec      int
+    RequestTimeoutSec    int                       // 信令请求等待响应超时时间, 默认 10s
+    ReconnectMaxSec      int                       // 与信令服务器断开后重连的最大等待时间, 默认 30s
+    ICERestartAttempts   int                       // P2P 连接断开或失败后 ICE 重启的最多次数, 默认 5, 小于 0 不重启
+    ICERestartTimeoutSec int                       // 每次 ICE 重启等待连接恢复的时间, 默认 10s
+    ICEServerAddr        string                    // ICE服务器地址, ICEServers 为空时使用
+    ICEServers           []webrtc.ICEServer        // ICE服务器列表, 可配置 TURN 服务器的认证信息, 见 ParseICEServers
+    ICETransportPolicy   webrtc.ICETransportPolicy // ICE 传输策略, 默认使用所有候选地址, relay 只通过 TURN 中继连接
+    VanillaICE           bool                      // 不使用 trickle ICE, 等待候选地址收集完成后发送包含全部候选地址的 SDP, 不发送 CandidateRequest
+    PeerType             int                       // Peer类型
+    Cid                  string                    // 客户端ID
+    AuthCode             string                    // 认证码
+    Token                string                    // 设备身份凭证, 信令服务器启用认证后端时需要
+    Metadata             map[string]string         // 注册时公开的 Peer 信息, 其他 Peer 可以通过在线状态查询获取
+    NATBehavior          *nat.NATBehavior          // 本端 NAT 行为检测结果(见 nat.Discover), 注册时上报, 发起连接前据此预测是否需要 TURN 中继
+    NetworkTypes         []webrtc.NetworkType      // 收集候选地址使用的网络类型, 比如只用 IPv6 时为 udp6/tcp6, 为空使用 pion 默认(udp4/udp6), 见 ParseNetworkTypes
+    ReceiveDir           string                    // 接收对端发送的文件的目录, 为空时拒绝接收文件, 见 Session.SendFile
 }
 
 type SignalServerConfig struct {
     SignalServerAddr string
     SignalServerPath string
+    TLSConfig        *tls.Config
     pingInterval     time.Duration
 }
 
 type ICEServerConfig struct {
-    ICEServerAddr string
+    ICEServerAddr   string
+    ICEServers      []webrtc.ICEServer
+    TransportPolicy webrtc.ICETransportPolicy
 }
 
 // Client Peer 节点在P2P连接建立前只会和信令服务器和ICE服务器进行通信
 type Client struct {
-    signalServerConfig SignalServerConfig
-    iceServerConfig    ICEServerConfig
-    peerType           int
-    cid                string                 // 客户端ID
-    authCode           string                 // 认证码
-    toCid              *string                // 对端设备ID
-    toAuthCode         *string                // 对端设备认证码
-    peerConn           *webrtc.PeerConnection // 与ICE服务器的连接 PeerConnection
-    pendingCandidates  []*webrtc.ICECandidate // 可能ICE服务器在Offer端发起对等连接前返回了一些候选地址,需要暂存起来用于后续通过SDP发给对端
-    signalConn         *websocket.Conn        // 与信令服务器的WebSocket连接
-    dataChannel        *webrtc.DataChannel    // 与对端Peer的数据通道
-    wChan              chan bool              // DataChannel 是否写就绪
-    candidatesMux      sync.Mutex
+    signalServerConfig   SignalServerConfig
+    iceServerConfig      ICEServerConfig
+    issuedICEServers     []webrtc.ICEServer // 信令服务器注册响应下发的 ICE 服务器(TURN 临时认证信息), 每次注册和刷新时更新
+    issuedExpiry         time.Time          // issuedICEServers 中 TURN 认证信息的过期时间
+    iceRefreshTimer      *time.Timer        // 在 TURN 认证信息有效期过半时刷新
+    iceMux               sync.Mutex
+    api                  *webrtc.API // 创建 PeerConnection 使用的 API, 为 nil 时使用默认配置
+    vanillaICE           bool        // 不使用 trickle ICE
+    receiveDir           string      // 接收文件的目录
+    peerType             int
+    cid                  string                                    // 客户端ID
+    authCode             string                                    // 认证码
+    metadata             map[string]string                         // 注册时公开的 Peer 信息
+    token                string                                    // 设备身份凭证
+    nat                  *message.NATInfo                          // 注册时上报的 NAT 行为
+    sessions             map[sessionKey]*Session                   // 与对端 Peer 的会话
+    onSessionHandler     func(*Session)                            // 新会话回调
+    earlyCandidates      map[sessionKey][]message.CandidateRequest // 会话建立前到达的对端候选地址
+    sessionsMux          sync.Mutex
+    receiving            map[string]bool // 接收中的 .part 文件, 同一个文件同时只能由一个会话接收
+    receiveMux           sync.Mutex
+    signalConn           *websocket.Conn        // 与信令服务器的WebSocket连接
+    writeMux             sync.Mutex             // signalConn 写锁
+    requestSeq           uint64                 // 信令请求ID序列
+    requestTimeout       time.Duration          // 信令请求等待响应超时时间
+    pendingRequests      map[string]chan []byte // 等待响应的信令请求, 请求ID -> 响应
+    pendingMux           sync.Mutex
+    onPresenceHandler    func(message.Presence) // 订阅的 Peer 在线状态变化回调
+    onPeerLeftHandler    func(cid string)       // 协商过的 Peer 离开信令服务器回调
+    watching             map[string]bool        // 订阅了在线状态的 Peer, 重连后重新订阅
+    presenceMux          sync.Mutex
+    signalState          SignalState       // 与信令服务器的连接状态
+    onSignalStateHandler func(SignalState) // 连接状态变化回调
+    signalEvents         eventQueue        // 按顺序执行连接状态变化回调
+    stateMux             sync.Mutex
+    reconnectMaxInterval time.Duration // 重连最大等待时间
+    unsent               []interface{} // 断线期间未发送的消息, 重连后按顺序发送
+    queueMux             sync.Mutex
+    closeChan            chan struct{} // Client 关闭后停止心跳和重连
+    closeOnce            sync.Once
+    iceRestartPolicy     ICERestartPolicy // ICE 重启重试策略
 }
 
 func NewClient(option *Option) *Client {
+    requestTimeout := time.Duration(option.RequestTimeoutSec) * time.Second
+    if requestTimeout <= 0 {
+        requestTimeout = defaultRequestTimeout
+    }
+    pingInterval := time.Duration(option.PingIntervalSec) * time.Second
+    if pingInterval <= 0 {
+        pingInterval = defaultPingInterval
+    }
+    reconnectMaxInterval := time.Duration(option.ReconnectMaxSec) * time.Second
+    if reconnectMaxInterval <= 0 {
+        reconnectMaxInterval = defaultReconnectInterval
+    }
     return &Client{
         signalServerConfig: SignalServerConfig{
             SignalServerAddr: option.SignalServerAddr,
             SignalServerPath: option.SignalServerPath,
-            pingInterval:     time.Duration(option.PingIntervalSec) * time.Second,
+            TLSConfig:        option.SignalServerTLS,
+            pingInterval:     pingInterval,
         },
         iceServerConfig: ICEServerConfig{
-            ICEServerAddr: option.ICEServerAddr,
+            ICEServerAddr:   option.ICEServerAddr,
+            ICEServers:      option.ICEServers,
+            TransportPolicy: option.ICETransportPolicy,
         },
-        peerType: option.PeerType,
-        cid:      option.Cid,
-        authCode: option.AuthCode,
-        wChan:    make(chan bool),
+        peerType:   option.PeerType,
+        cid:        option.Cid,
+        authCode:   option.AuthCode,
+        metadata:   option.Metadata,
+        token:      option.Token,
+        nat:        newNATInfo(option.NATBehavior),
+        vanillaICE: option.VanillaICE,
+        receiveDir: option.ReceiveDir,
+        receiving:  make(map[string]bool),
+        sessions:   make(map[sessionKey]*Session),
+
+        earlyCandidates: make(map[sessionKey][]message.CandidateRequest),
+
+        requestTimeout:  requestTimeout,
+        pendingRequests: make(map[string]chan []byte),
+        watching:        make(map[string]bool),
+
+        reconnectMaxInterval: reconnectMaxInterval,
+        closeChan:            make(chan struct{}),
+
+        iceRestartPolicy: newICERestartPolicy(option),
+
+        api: newAPI(option),
+    }
+}
+
+// newAPI 按配置的网络类型创建 webrtc API, 没有需要定制的配置时返回 nil 使用默认 API
+func newAPI(option *Option) *webrtc.API {
+    if len(option.NetworkTypes) == 0 {
+        return nil
     }
+    settingEngine := webrtc.SettingEngine{}
+    settingEngine.SetNetworkTypes(option.NetworkTypes)
+    return webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine))
 }
 
-func (c *Client) RunAsAnswer() {
-    c.run(nil, nil)
+// RunAsAnswer 作为 Answer 端运行, 等待其他 Peer 发起连接, 可以同时与多个 Peer 建立会话
+// 阻塞直到 ctx 结束或 Client 关闭, ctx 结束和调用 Close 返回 nil
+func (c *Client) RunAsAnswer(ctx context.Context) error {
+    return c.run(ctx, nil, nil)
 }
 
-func (c *Client) RunAsOffer(toCid *string, toAuthCode *string) {
-    c.run(toCid, toAuthCode)
+// RunAsOffer 作为 Offer 端运行, 向 toCid 发起连接, 会话结束时返回会话关闭原因, 其他同 RunAsAnswer
+func (c *Client) RunAsOffer(ctx context.Context, toCid *string, toAuthCode *string) error {
+    return c.run(ctx, toCid, toAuthCode)
 }
 
 // run Peer节点启动
-func (c *Client) run(toCid *string, toAuthCode *string) {
-    c.toCid = toCid
-    c.toAuthCode = toAuthCode
+func (c *Client) run(ctx context.Context, toCid *string, toAuthCode *string) error {
+    defer c.Close()
 
     // 1 连接信令服务器并上报本端信息
-    c.connectSignalServer()
-
-    // 2 连接ICE服务器
-    config := webrtc.Configuration{
-        ICEServers: []webrtc.ICEServer{
-            {
-                URLs: []string{c.iceServerConfig.ICEServerAddr},
-            },
-        },
-    }
-    peerConnection, err := webrtc.NewPeerConnection(config)
-    if err != nil {
-        log.Fatalln(err)
-    }
-    c.peerConn = peerConnection
-    defer func() {
-        if err := peerConnection.Close(); err != nil {
-            log.Printf("cannot close peerConnection: %v\n", err)
-        }
-    }()
-
-    // 设置处理ICE返回候选地址事件
-    c.peerConn.OnICECandidate(c.onICECandidate)
-    // 设置处理ICE连接状态变化事件
-    c.peerConn.OnConnectionStateChange(c.onConnectionStateChange)
-
-    if c.peerType == PeerTypeAnswer {
-        // 设置成功建立 DataChannel 的监听
-        c.peerConn.OnDataChannel(c.onDataChannel)
-    } else if c.peerType == PeerTypeOffer {
-        // 发起创建连接到对端（Peer）的数据通道
-        c.dataChannel, err = c.peerConn.CreateDataChannel("data", nil)
-        if err != nil {
-            log.Printf("create DataChannel failed: %v\n", err)
-            return
-        }
-        c.dataChannel.OnOpen(c.onOpen)
-        c.dataChannel.OnMessage(c.onMessage)
+    if err := c.connectSignalServer(); err != nil {
+        return err
     }
 
-    // 3 Offer Peer 发起对等连接
+    // 2 Offer Peer 发起对等连接, Answer Peer 收到 offer 时创建会话
+    var session *Session
+    var sessionDone <-chan struct{}
     if c.peerType == PeerTypeOffer {
-        // 创建 offer sdp
-        offerSd, err := c.peerConn.CreateOffer(nil)
-        if err != nil {
-            log.Printf("CreateOffer failed: %v", err)
-            return
-        }
-        // 设置本端描述信息
-        if err := c.peerConn.SetLocalDescription(offerSd); err != nil {
-            log.Printf("SetLocalDescription failed: %v", err)
-            return
-        }
-        offerSdp := message.NewSdpRequest(offerSd, c.cid, *c.toCid, *c.toAuthCode)
-        if err := c.signalConn.WriteJSON(offerSdp); err != nil {
-            log.Printf("register local peer info to signal server, err: %v\n", err)
-            return
+        var err error
+        if session, err = c.Dial(*toCid, *toAuthCode); err != nil {
+            return err
         }
+        sessionDone = session.Done()
     }
 
-    c.listenForShutdown()
+    select {
+    case <-ctx.Done():
+        return nil
+    case <-c.closeChan:
+        return nil
+    case <-sessionDone:
+        return session.Err()
+    }
 }
 
-func (c *Client) connectSignalServer() {
-    u := url.URL{Scheme: "ws", Host: c.signalServerConfig.SignalServerAddr, Path: c.signalServerConfig.SignalServerPath}
-    log.Printf("connecting to signal server %s", u.String())
-    var err error
-    if c.signalConn, _, err = websocket.DefaultDialer.Dial(u.String(), nil); err != nil {
-        log.Fatalf("connecting to signal server, err: %v\n", err)
+func (c *Client) newPeerConnection(config webrtc.Configuration) (*webrtc.PeerConnection, error) {
+    if c.api != nil {
+        return c.api.NewPeerConnection(config)
     }
+    return webrtc.NewPeerConnection(config)
+}
 
-    // 上报本端信息到信令服务器
-    if err := c.signalConn.WriteJSON(message.NewRegisterRequest(c.cid, c.authCode)); err != nil {
-        c.signalConn.Close()
-        log.Fatalf("register local peer info to signal server, err: %v\n", err)
+// webrtcConfiguration 创建 PeerConnection 的配置
+func (c *Client) webrtcConfiguration() webrtc.Configuration {
+    config := webrtc.Configuration{
+        ICEServers:         c.iceServerConfig.ICEServers,
+        ICETransportPolicy: c.iceServerConfig.TransportPolicy,
     }
-    log.Printf("register peer info to signal server, cid=%s, authCode=%s", c.cid, c.authCode)
-
-    // 监听信令服务器返回的消息，SDP、Candidate
-    go func() {
-        for {
-            _, msg, err := c.signalConn.ReadMessage()
-            if err != nil {
-                log.Printf("read message from signal server failed: %v", err)
-                break
-            }
-
-            log.Printf("received message from signal server: %s", msg)
-            // message 转成 MMeta
-            m := message.MMeta{}
-            if err := json.Unmarshal(msg, &m); err != nil {
-                log.Println(err)
-                break
-            }
-
-            switch m.Type {
-            case message.TypeRegisterResponse:
-                //暂时忽略
-                break
-            case message.TypeSdpRequest:
-                // 收到对端经过信令服务器中转的 SDP 消息
-                sdpMessage := message.SdpRequest{}
-                if err := json.Unmarshal(msg, &sdpMessage); err != nil {
-                    log.Printf("unmarshal sdpMessage failed: %v", err)
-                    break
-                }
-                // 本地 peerConnection 记录远端的描述信息
-                if err := c.peerConn.SetRemoteDescription(sdpMessage.Sd); err != nil {
-                    log.Printf("SetRemoteDescription failed: %v", err)
-                    break
-                }
-                if c.peerType == PeerTypeAnswer {
-                    c.toCid = &sdpMessage.From
-                    // 1 作为 Answer 端还需要创建 answer sdp 并经过信令服务器转发给 offer端
-                    answer, err := c.peerConn.CreateAnswer(nil)
-                    if err != nil {
-                        log.Printf("CreateAnswer failed: %v", err)
-                        break
-                    }
-                    err = c.peerConn.SetLocalDescription(answer)
-                    if err != nil {
-                        panic(err)
-                    }
-                    answerSdp := message.NewSdpRequest(answer, c.cid, sdpMessage.From, "")
-                    if err := c.signalConn.WriteJSON(answerSdp); err != nil {
-                        log.Printf("register local peer info to signal server, err: %v\n", err)
-                        break
-                    }
-                }
-                // 2 通过信令服务器向对端发送ICE Candidate 信息
-                for _, candidate := range c.pendingCandidates {
-                    if err := c.signalCandidate(candidate); err != nil {
-                        log.Printf("signalCandidate failed: %v", err)
-                        break
-                    }
-                }
-                break
-            case message.TypeSdpResponse:
-                // 暂时忽略
-                break
-            case message.TypeCandidateRequest:
-                // 收到对端的候选地址信息后，记录到 peerConnection
-                candidateMessage := message.CandidateRequest{}
-                if err := json.Unmarshal(msg, &candidateMessage); err != nil {
-                    log.Printf("unmarshal sdpMessage failed: %v", err)
-                    break
-                }
-                if err := c.peerConn.AddICECandidate(webrtc.ICECandidateInit{Candidate: candidateMessage.Candidate}); err != nil {
-                    log.Printf("AddICECandidate failed: %v", err)
-                    break
-                }
-                break
-            case message.TypeCandidateResponse:
-                // 暂时忽略
-                break
-            default:
-                log.Println("Unknown message type!")
-            }
+    if len(config.ICEServers) == 0 && c.iceServerConfig.ICEServerAddr != "" {
+        config.ICEServers = []webrtc.ICEServer{
+            {
+                URLs: []string{c.iceServerConfig.ICEServerAddr},
+            },
         }
-    }()
+    }
+    c.iceMux.Lock()
+    defer c.iceMux.Unlock()
+    if len(c.issuedICEServers) > 0 {
+        config.ICEServers = append(append([]webrtc.ICEServer(nil), config.ICEServers...), c.issuedICEServers...)
+    }
+    return config
+}
+
+// connectSignalServer 连接信令服务器并注册, 连接断开后自动重连
+func (c *Client) connectSignalServer() error {
+    if err := c.connect(); err != nil {
+        return err
+    }
 
-    // 维持 signalConn 连接
+    // 维持 signalConn 连接, 信令服务器据此判断客户端是否存活
     go func() {
         ticker := time.NewTicker(c.signalServerConfig.pingInterval)
         defer ticker.Stop()
         for {
             select {
+            case <-c.closeChan:
+                return
             case <-ticker.C:
-                if err := c.signalConn.WriteMessage(websocket.PingMessage, nil); err != nil {
-                    log.Printf("signalConn write ping message error: %v", err)
-                    return
+                if c.SignalState() != SignalStateConnected {
+                    continue
+                }
+                // 写失败说明连接已断开, 由读循环发现并重连
+                if err := c.sendHeartbeat(); err != nil {
+                    log.Printf("signalConn write heartbeat message error: %v", err)
                 }
             }
         }
     }()
+    return nil
 }
 
-// OnICECandidate 处理ICE返回候选地址事件
-func (c *Client) onICECandidate(candidate *webrtc.ICECandidate) {
-    if candidate == nil {
+// handleSignalMessage 处理信令服务器发来的消息，SDP、Candidate
+func (c *Client) handleSignalMessage(msg []byte) {
+    log.Printf("received message from signal server: %s", message.Redact(msg))
+    // message 转成 MMeta
+    m := message.MMeta{}
+    if err := json.Unmarshal(msg, &m); err != nil {
+        log.Println(err)
         return
     }
-
-    c.candidatesMux.Lock()
-    defer c.candidatesMux.Unlock()
-
-    log.Printf("onICECandidate, candidate=%s\n", candidate.ToJSON().Candidate)
-    // 将从ICE服务器获取当前Peer远程会话描述信息，包括配置信息、媒体流、编解码器、网络传输参数等，通过信令服务器转发给对端
-    desc := c.peerConn.RemoteDescription() // 估计是 SetRemoteDescription() 方法设置的, 即收到对端 SDP 消息后才能直接发送
-    if desc == nil {                       // 说明还没有与对端建立通信
-        c.pendingCandidates = append(c.pendingCandidates, candidate)
-    } else if err := c.signalCandidate(candidate); err != nil {
-        log.Printf("onICECandidate, signalCandidate err: %s\n", err)
+    // 有 Call 在等待的响应直接交给 Call 处理
+    if m.IsResponse() && c.deliverResponse(m.Id, msg) {
+        return
     }
-}
-
-func (c *Client) listenForShutdown() {
-    sigChan := make(chan os.Signal, 1)
-    signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-    select {
-    case sig := <-sigChan:
-        log.Printf("Received signal: %v. Shutting down...\n", sig)
-        //c.Close()
-        //os.Exit(0)
+    switch m.Type {
+    case message.TypeRegisterResponse, message.TypeHeartbeatResponse, message.TypeSdpResponse,
+        message.TypeCandidateResponse, message.TypeErrorResponse, message.TypePresenceResponse,
+        message.TypeSubscribeResponse, message.TypeUnregisterResponse, message.TypeICEServersResponse:
+        // 信令服务器处理失败时记录失败原因
+        result := message.Result{}
+        if err := json.Unmarshal(msg, &result); err != nil {
+            log.Printf("unmarshal response failed: %v", err)
+            break
+        }
+        if err := result.Err(); err != nil {
+            log.Printf("signal request failed, type=%d, err: %v", m.Type, err)
+        }
+        // 注册信息已被信令服务器移除(比如空闲超时), 重新注册
+        if result.Error != nil && result.Error.Code == message.ErrCodeNotRegistered {
+            if err := c.writeJSON(c.newRegisterRequest()); err != nil {
+                log.Printf("re-register to signal server failed: %v", err)
+            }
+        }
+        break
+    case message.TypeSdpRequest:
+        // 收到对端经过信令服务器中转的 SDP 消息
+        sdpMessage := message.SdpRequest{}
+        if err := json.Unmarshal(msg, &sdpMessage); err != nil {
+            log.Printf("unmarshal sdpMessage failed: %v", err)
+            break
+        }
+        c.handleSdp(sdpMessage)
+        break
+    case message.TypePresenceEvent:
+        presenceEvent := message.PresenceEvent{}
+        if err := json.Unmarshal(msg, &presenceEvent); err != nil {
+            log.Printf("unmarshal presenceEvent failed: %v", err)
+            break
+        }
+        c.onPresence(presenceEvent.Presence)
+        break
+    case message.TypePeerLeftEvent:
+        peerLeftEvent := message.PeerLeftEvent{}
+        if err := json.Unmarshal(msg, &peerLeftEvent); err != nil {
+            log.Printf("unmarshal peerLeftEvent failed: %v", err)
+            break
+        }
+        log.Printf("peer %s left signal server", peerLeftEvent.Cid)
+        c.dropEarlyCandidates(peerLeftEvent.Cid)
+        c.onPeerLeft(peerLeftEvent.Cid)
+        break
+    case message.TypeCandidateRequest:
+        // 收到对端的候选地址信息后，记录到对应会话的 peerConnection
+        candidateMessage := message.CandidateRequest{}
+        if err := json.Unmarshal(msg, &candidateMessage); err != nil {
+            log.Printf("unmarshal sdpMessage failed: %v", err)
+            break
+        }
+        c.handleCandidate(candidateMessage)
+        break
+    default:
+        log.Println("Unknown message type!")
     }
 }
 
-// signalCandidate 发送ICE候选地址到对端，通过信令服务器转发, TODO 批量发送
-func (c *Client) signalCandidate(candidate *webrtc.ICECandidate) error {
-    // 与信令服务器的WebSocket连接是否存在，不存在则创建
-    //if c.signalConn == nil {
-    //}
-
-    // 发送ICE候选地址到信令服务器
-    candidateMessage := message.NewCandidateRequest(candidate.ToJSON().Candidate, c.cid, *c.toCid)
-    if err := c.signalConn.WriteJSON(candidateMessage); err != nil {
-        log.Printf("signalCandidate, candiatemessage: %v, err: %v\n", candidateMessage, err)
-        return err
-    }
-    return nil
+func (c *Client) newRegisterRequest() message.RegisterRequest {
+    registerRequest := message.NewRegisterRequest(c.cid, c.authCode)
+    registerRequest.Metadata = c.metadata
+    registerRequest.Token = c.token
+    registerRequest.NAT = c.nat
+    return registerRequest
 }
 
-func (c *Client) onConnectionStateChange(state webrtc.PeerConnectionState) {
-    log.Printf("Peer Connection State has changed: %s\n", state.String())
-
-    if state == webrtc.PeerConnectionStateFailed {
-        // Wait until PeerConnection has had no network activity for 30 seconds or another failure.
-        // It may be reconnected using an ICE Restart.
-        // Use webrtc.PeerConnectionStateDisconnected if you are interested in detecting faster timeout.
-        // Note that the PeerConnection may come back from PeerConnectionStateDisconnected.
-        log.Println("Peer Connection has gone to failed exiting")
-        c.Close()
-        os.Exit(0)
+// newNATInfo 转换为注册时上报的 NAT 行为
+func newNATInfo(behavior *nat.NATBehavior) *message.NATInfo {
+    if behavior == nil {
+        return nil
     }
-
-    if state == webrtc.PeerConnectionStateClosed {
-        // PeerConnection was explicitly closed. This usually happens from a DTLS CloseNotify
-        log.Println("Peer Connection has gone to closed exiting")
-        c.Close()
-        os.Exit(0)
+    return &message.NATInfo{
+        NAT:          behavior.NAT,
+        Mapping:      string(behavior.Mapping),
+        Filtering:    string(behavior.Filtering),
+        ExternalAddr: behavior.ExternalAddr,
     }
 }
 
-func (c *Client) onDataChannel(dataChannel *webrtc.DataChannel) {
-    log.Printf("New DataChannel establisted, label=%s, id=%d\n", dataChannel.Label(), dataChannel.ID())
-    c.dataChannel = dataChannel
-
-    dataChannel.OnOpen(c.onOpen)
-    dataChannel.OnMessage(c.onMessage)
+// sendHeartbeat 发送心跳并上报当前各会话的 PeerConnection 状态
+func (c *Client) sendHeartbeat() error {
+    var states []string
+    for _, s := range c.Sessions() {
+        states = append(states, s.remoteCid+":"+s.peerConn.ConnectionState().String())
+    }
+    return c.writeJSON(message.NewHeartbeatRequest(c.cid, strings.Join(states, ","), time.Now().UnixMilli()))
 }
 
-func (c *Client) onOpen() {
-    log.Printf("DataChannel '%s'-'%d' open\n", c.dataChannel.Label(), c.dataChannel.ID())
-    // 写就绪
-    c.wChan <- true
-    //ticker := time.NewTicker(5 * time.Second)
-    //defer ticker.Stop()
-    //for range ticker.C {
-    //    msg, sendTextErr := randutil.GenerateCryptoRandomString(15, "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
-    //    if sendTextErr != nil {
-    //        log.Printf("generate crypto random string, err: %v\n", sendTextErr)
-    //    }
-    //
-    //    log.Printf("Sending '%s'\n", msg)
-    //    if sendTextErr = c.dataChannel.SendText(msg); sendTextErr != nil {
-    //        panic(sendTextErr)
-    //    }
-    //}
+// Close 关闭所有会话并从信令服务器注销, 可重复调用
+func (c *Client) Close() {
+    c.closeOnce.Do(c.close)
 }
 
-func (c *Client) WaitWritable() {
-    writable := <-c.wChan
-    if writable {
-        log.Println("DataChannel now is writable -> ")
+func (c *Client) close() {
+    // 停止心跳、重连和 ICE 重启
+    close(c.closeChan)
+    c.iceMux.Lock()
+    if c.iceRefreshTimer != nil {
+        c.iceRefreshTimer.Stop()
     }
-}
-
-func (c *Client) WriteText(text string) {
-    if err := c.dataChannel.SendText(text); err != nil {
-        log.Printf("send text:%s, error: %v\n", text, err)
+    c.iceMux.Unlock()
+    for _, s := range c.Sessions() {
+        s.Close()
     }
-}
-
-func (c *Client) onMessage(msg webrtc.DataChannelMessage) {
-    log.Printf("MMeta from DataChannel '%s': '%s'\n", c.dataChannel.Label(), string(msg.Data))
-}
-
-func (c *Client) Close() {
-    if c.peerConn != nil {
-        if err := c.peerConn.Close(); err != nil {
-            log.Printf("close peerConnection error: %v\n", err)
-            return
+    if c.SignalState() == SignalStateConnected {
+        // 清理信令服务器中的客户端连接信息
+        unregisterRequest := message.NewUnregisterRequest(c.cid)
+        if err := c.Call(&unregisterRequest, nil, c.requestTimeout); err != nil {
+            log.Printf("unregister from signal server error: %v\n", err)
         }
     }
-    // TODO 清理信令服务器中的客户端连接信息
-    if c.signalConn != nil {
-        if err := c.signalConn.Close(); err != nil {
+    c.setSignalState(SignalStateClosed)
+    c.writeMux.Lock()
+    signalConn := c.signalConn
+    c.writeMux.Unlock()
+    if signalConn != nil {
+        if err := signalConn.Close(); err != nil {
             log.Printf("close signalConn error: %v\n", err)
             return
         }
@@ -0,0 +1,50 @@
+package client
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+)
+
+func TestRunLifecycle(t *testing.T) {
+    addr, shutdown := serveAt(t, "127.0.0.1:0")
+    defer shutdown()
+
+    // 信令服务器不可达时返回错误而不是退出进程
+    unreachable := NewClient(&Option{SignalServerAddr: "127.0.0.1:1", SignalServerPath: "/signal", Cid: "lost-peer"})
+    if err := unreachable.RunAsAnswer(context.Background()); err == nil {
+        t.Fatal("run should fail when signal server is unreachable")
+    }
+
+    // 对端不在线
+    toCid, toAuthCode := "offline-peer", "123456"
+    offer := NewClient(&Option{SignalServerAddr: addr, SignalServerPath: "/signal", PeerType: PeerTypeOffer, Cid: "offer-peer"})
+    if err := offer.RunAsOffer(context.Background(), &toCid, &toAuthCode); !errors.Is(err, ErrPeerOffline) {
+        t.Fatalf("expected peer offline, got: %v", err)
+    }
+
+    // ctx 结束后关闭 Client 并返回
+    answer := NewClient(&Option{SignalServerAddr: addr, SignalServerPath: "/signal", PeerType: PeerTypeAnswer, Cid: "answer-peer"})
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan error, 1)
+    go func() {
+        done <- answer.RunAsAnswer(ctx)
+    }()
+    time.Sleep(100 * time.Millisecond)
+    cancel()
+    select {
+    case err := <-done:
+        if err != nil {
+            t.Fatalf("unexpected error: %v", err)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("run should return after ctx is done")
+    }
+    if state := answer.SignalState(); state != SignalStateClosed {
+        t.Fatalf("unexpected signal state: %s", state)
+    }
+    if sessions := answer.Sessions(); len(sessions) != 0 {
+        t.Fatalf("sessions should be closed, got %d", len(sessions))
+    }
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+    "github.com/pion/webrtc/v4"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "log"
+    "strings"
+)
+
+// PredictConnectivity 查询信令服务器根据双方上报的 NAT 行为对本端到 toCid 连通性的预测
+func (c *Client) PredictConnectivity(toCid string) (message.Connectivity, error) {
+    connectivityRequest := message.NewConnectivityRequest(c.cid, toCid)
+    connectivityResponse := message.ConnectivityResponse{}
+    if err := c.Call(&connectivityRequest, &connectivityResponse, c.requestTimeout); err != nil {
+        return message.ConnectivityUnknown, err
+    }
+    return connectivityResponse.Connectivity, nil
+}
+
+// dialConfiguration 发起会话使用的配置, 预测打洞不可能成功且配置了 TURN 服务器时只使用中继候选地址,
+// 避免等待注定失败的直连尝试超时
+func (c *Client) dialConfiguration(toCid string) webrtc.Configuration {
+    config := c.webrtcConfiguration()
+    if c.nat == nil || config.ICETransportPolicy == webrtc.ICETransportPolicyRelay {
+        return config
+    }
+    connectivity, err := c.PredictConnectivity(toCid)
+    if err != nil {
+        log.Printf("predict connectivity to %s failed: %v\n", toCid, err)
+        return config
+    }
+    log.Printf("predicted connectivity to %s: %s\n", toCid, connectivity)
+    if connectivity == message.ConnectivityRelay {
+        if !hasTURNServer(config.ICEServers) {
+            log.Printf("relay needed to reach %s but no TURN server configured\n", toCid)
+            return config
+        }
+        config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+    }
+    return config
+}
+
+func hasTURNServer(iceServers []webrtc.ICEServer) bool {
+    for _, iceServer := range iceServers {
+        for _, url := range iceServer.URLs {
+            if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+                return true
+            }
+        }
+    }
+    return false
+}
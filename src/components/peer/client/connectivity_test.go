@@ -0,0 +1,43 @@
+package client
+
+import (
+    "github.com/pion/webrtc/v4"
+    "kwseeker.top/kwseeker/p2p/src/components/ice/nat"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "testing"
+)
+
+func TestDialConfiguration(t *testing.T) {
+    addr, shutdown := serveAt(t, "127.0.0.1:0")
+    defer shutdown()
+
+    symmetric := func(externalAddr string) *nat.NATBehavior {
+        return &nat.NATBehavior{NAT: true, Mapping: nat.AddressAndPortDependent, Filtering: nat.AddressAndPortDependent, ExternalAddr: externalAddr}
+    }
+    newConnectedClient := func(cid string, behavior *nat.NATBehavior, iceServers []webrtc.ICEServer) *Client {
+        c := NewClient(&Option{SignalServerAddr: addr, SignalServerPath: "/signal", Cid: cid, NATBehavior: behavior, ICEServers: iceServers})
+        if err := c.connectSignalServer(); err != nil {
+            t.Fatal(err)
+        }
+        t.Cleanup(c.Close)
+        return c
+    }
+    turn := []webrtc.ICEServer{{URLs: []string{"turn:turn.example.com:3478"}, Username: "u", Credential: "p"}}
+    offer := newConnectedClient("predict-offer", symmetric("203.0.113.1:4000"), turn)
+    newConnectedClient("predict-answer", symmetric("198.51.100.1:5000"), nil)
+
+    connectivity, err := offer.PredictConnectivity("predict-answer")
+    if err != nil || connectivity != message.ConnectivityRelay {
+        t.Fatalf("unexpected connectivity: %s, err: %v", connectivity, err)
+    }
+    // 双方都是对称型 NAT, 配置了 TURN 时直接只使用中继
+    if config := offer.dialConfiguration("predict-answer"); config.ICETransportPolicy != webrtc.ICETransportPolicyRelay {
+        t.Fatalf("expected relay policy, got %s", config.ICETransportPolicy)
+    }
+
+    // 没有 TURN 服务器时仍尝试直连
+    noTURN := newConnectedClient("predict-no-turn", symmetric("192.0.2.1:6000"), nil)
+    if config := noTURN.dialConfiguration("predict-answer"); config.ICETransportPolicy != webrtc.ICETransportPolicyAll {
+        t.Fatalf("expected all policy, got %s", config.ICETransportPolicy)
+    }
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+    "errors"
+    "github.com/pion/webrtc/v4"
+    "sync"
+)
+
+var (
+    ErrSessionClosed    = errors.New("session closed")
+    ErrNotWritable      = errors.New("data channel is not writable")
+    ErrPeerOffline      = errors.New("peer is offline")
+    ErrICERestartFailed = errors.New("ICE restart attempts exhausted")
+)
+
+// eventHandlers P2P 连接和 DataChannel 状态回调, 状态回调在会话的事件 goroutine 中按发生顺序执行
+type eventHandlers struct {
+    onPeerConnectionState func(webrtc.PeerConnectionState)
+    onDataChannelState    func(webrtc.DataChannelState)
+    onDataChannelMessage  func(webrtc.DataChannelMessage)
+    onFileProgress        func(FileProgress)
+    mu                    sync.Mutex
+}
+
+// OnPeerConnectionStateChange 设置 P2P 连接(ICE + DTLS)状态变化回调
+func (s *Session) OnPeerConnectionStateChange(f func(state webrtc.PeerConnectionState)) {
+    s.handlers.mu.Lock()
+    defer s.handlers.mu.Unlock()
+    s.handlers.onPeerConnectionState = f
+}
+
+// OnDataChannelStateChange 设置 DataChannel 状态变化回调, 目前通知 open 和 closed
+func (s *Session) OnDataChannelStateChange(f func(state webrtc.DataChannelState)) {
+    s.handlers.mu.Lock()
+    defer s.handlers.mu.Unlock()
+    s.handlers.onDataChannelState = f
+}
+
+// OnDataChannelMessage 设置收到对端 DataChannel 消息的回调
+func (s *Session) OnDataChannelMessage(f func(msg webrtc.DataChannelMessage)) {
+    s.handlers.mu.Lock()
+    defer s.handlers.mu.Unlock()
+    s.handlers.onDataChannelMessage = f
+}
+
+func (s *Session) emitPeerConnectionState(state webrtc.PeerConnectionState) {
+    s.handlers.mu.Lock()
+    defer s.handlers.mu.Unlock()
+    if handler := s.handlers.onPeerConnectionState; handler != nil {
+        s.events.push(func() {
+            handler(state)
+        })
+    }
+}
+
+func (s *Session) emitDataChannelState(state webrtc.DataChannelState) {
+    s.handlers.mu.Lock()
+    defer s.handlers.mu.Unlock()
+    if handler := s.handlers.onDataChannelState; handler != nil {
+        s.events.push(func() {
+            handler(state)
+        })
+    }
+}
+
+// emitDataChannelMessage 消息回调同步执行, 保证消息顺序
+func (s *Session) emitDataChannelMessage(msg webrtc.DataChannelMessage) {
+    s.handlers.mu.Lock()
+    handler := s.handlers.onDataChannelMessage
+    s.handlers.mu.Unlock()
+    if handler != nil {
+        handler(msg)
+    }
+}
+
+// eventQueue 按加入顺序在同一个 goroutine 中执行回调, 回调阻塞不影响调用方, 队列为空时 goroutine 退出
+type eventQueue struct {
+    events  []func()
+    running bool
+    mu      sync.Mutex
+}
+
+func (q *eventQueue) push(event func()) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.events = append(q.events, event)
+    if !q.running {
+        q.running = true
+        go q.run()
+    }
+}
+
+func (q *eventQueue) run() {
+    for {
+        q.mu.Lock()
+        if len(q.events) == 0 {
+            q.running = false
+            q.mu.Unlock()
+            return
+        }
+        event := q.events[0]
+        q.events[0] = nil
+        q.events = q.events[1:]
+        q.mu.Unlock()
+        event()
+    }
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+    "github.com/pion/webrtc/v4"
+    "sync"
+    "testing"
+    "time"
+)
+
+// 状态回调按状态变化的顺序执行, 回调阻塞不影响状态更新
+func TestEventOrder(t *testing.T) {
+    c := NewClient(&Option{Cid: "local-peer"})
+    defer c.Close()
+    s, err := c.newSession("remote-peer", "", newSessionId(), false, c.webrtcConfiguration())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+
+    var states []webrtc.PeerConnectionState
+    var signalStates []SignalState
+    var mu sync.Mutex
+    s.OnPeerConnectionStateChange(func(state webrtc.PeerConnectionState) {
+        time.Sleep(time.Millisecond)
+        mu.Lock()
+        defer mu.Unlock()
+        states = append(states, state)
+    })
+    c.OnSignalStateChange(func(state SignalState) {
+        time.Sleep(time.Millisecond)
+        mu.Lock()
+        defer mu.Unlock()
+        signalStates = append(signalStates, state)
+    })
+
+    expected := []webrtc.PeerConnectionState{
+        webrtc.PeerConnectionStateConnecting,
+        webrtc.PeerConnectionStateConnected,
+        webrtc.PeerConnectionStateDisconnected,
+        webrtc.PeerConnectionStateConnected,
+        webrtc.PeerConnectionStateFailed,
+    }
+    for _, state := range expected {
+        s.emitPeerConnectionState(state)
+    }
+    expectedSignal := []SignalState{SignalStateConnecting, SignalStateConnected, SignalStateReconnecting, SignalStateConnected}
+    for _, state := range expectedSignal {
+        c.setSignalState(state)
+    }
+
+    waitFor(t, "state callbacks", func() bool {
+        mu.Lock()
+        defer mu.Unlock()
+        return len(states) == len(expected) && len(signalStates) == len(expectedSignal)
+    })
+    mu.Lock()
+    defer mu.Unlock()
+    for i := range expected {
+        if states[i] != expected[i] {
+            t.Fatalf("peer connection states out of order: %v", states)
+        }
+    }
+    for i := range expectedSignal {
+        if signalStates[i] != expectedSignal[i] {
+            t.Fatalf("signal states out of order: %v", signalStates)
+        }
+    }
+}
@@ -0,0 +1,647 @@
+package client
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/pion/webrtc/v4"
+    "hash"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// 文件传输复用会话的 DataChannel, 文本消息仍然是普通消息, 文件传输使用二进制消息, 第一个字节为帧类型:
+//
+//	offer  发送端 -> 接收端 JSON FileMeta, 文件名、大小和 SHA-256
+//	accept 接收端 -> 发送端 JSON fileAccept, 接收端已有的数据长度, 发送端从该偏移继续发送(断点续传)
+//	chunk  发送端 -> 接收端 8 字节传输ID + 8 字节偏移(大端) + 数据
+//	result 双向 JSON fileResult, 接收端拒绝、校验结果, 或任意一端取消传输
+//
+// 接收端未完成的数据保存在接收目录的 .part 文件中, 按文件名和 SHA-256 区分, 连接断开后重新发送同一个文件时从已接收的位置继续
+const (
+    fileFrameOffer  byte = 1
+    fileFrameAccept byte = 2
+    fileFrameChunk  byte = 3
+    fileFrameResult byte = 4
+)
+
+const (
+    fileIdSize             = 8                                        // 传输ID字节数, 和会话ID一样随机生成
+    fileMaxMessageSize     = 16 * 1024                                // 浏览器之间可靠传输的最大消息长度
+    fileChunkHeaderSize    = 1 + fileIdSize + 8                       // 帧类型 + 传输ID + 偏移
+    fileChunkSize          = fileMaxMessageSize - fileChunkHeaderSize // 每个数据帧的数据长度, 加上帧头不超过最大消息长度
+    fileMaxBufferedAmount  = 1024 * 1024                              // DataChannel 发送缓冲超过该值时暂停发送
+    fileBufferLowThreshold = 256 * 1024                               // 发送缓冲低于该值时继续发送
+    filePartSuffix         = ".part"
+)
+
+var (
+    ErrFileRejected       = errors.New("file rejected by peer")
+    ErrFileTransferFailed = errors.New("file transfer failed")
+)
+
+// FileMeta 文件元信息, 发送前通知接收端
+type FileMeta struct {
+    ID     string `json:"id"`     // 传输ID, 每次发送生成
+    Name   string `json:"name"`   // 文件名, 不含目录
+    Size   int64  `json:"size"`   // 文件大小
+    SHA256 string `json:"sha256"` // 文件内容的 SHA-256, 十六进制
+}
+
+// FileProgress 文件传输进度
+type FileProgress struct {
+    FileMeta
+    Sending     bool   // true 为本端发送, false 为本端接收
+    Path        string // 本端文件路径, 接收完成前为 .part 文件
+    Offset      int64  // 断点续传的起始偏移
+    Transferred int64  // 已传输的数据长度, 包括断点续传前已有的数据
+    Done        bool   // 传输结束, Err 为 nil 表示成功
+    Err         error
+}
+
+type fileAccept struct {
+    ID     string `json:"id"`
+    Offset int64  `json:"offset"`
+}
+
+type fileResult struct {
+    ID    string `json:"id"`
+    Error string `json:"error,omitempty"` // 为空表示接收端校验成功
+}
+
+// fileSender 本端发送中的文件, 等待接收端的 accept 和 result
+type fileSender struct {
+    accept chan fileAccept
+    result chan fileResult
+}
+
+// fileReceiver 本端接收中的文件, 数据帧在 DataChannel 读循环中处理, 会话关闭时在其他 goroutine 中结束接收, 由 mu 保护
+type fileReceiver struct {
+    meta     FileMeta
+    file     *os.File
+    partPath string
+    hash     hash.Hash
+    offset   int64
+    received int64
+    done     bool // 接收已结束, 只通知一次结束进度
+    corrupt  bool // 已接收的数据有误, 结束接收时删除 .part 文件
+    mu       sync.Mutex
+}
+
+// fileTransfers 会话的文件传输状态
+type fileTransfers struct {
+    senders     map[string]*fileSender
+    receivers   map[string]*fileReceiver
+    sendMu      sync.Mutex    // 同一个会话同时只发送一个文件, 共用 DataChannel 的发送缓冲
+    bufferedLow chan struct{} // DataChannel 发送缓冲低于阈值通知
+    mu          sync.Mutex
+}
+
+func newFileTransfers() fileTransfers {
+    return fileTransfers{
+        senders:     make(map[string]*fileSender),
+        receivers:   make(map[string]*fileReceiver),
+        bufferedLow: make(chan struct{}, 1),
+    }
+}
+
+// OnFileProgress 设置文件传输进度回调, 发送和接收都会通知, 回调同步执行, 不能阻塞
+func (s *Session) OnFileProgress(f func(progress FileProgress)) {
+    s.handlers.mu.Lock()
+    defer s.handlers.mu.Unlock()
+    s.handlers.onFileProgress = f
+}
+
+func (s *Session) emitFileProgress(progress FileProgress) {
+    s.handlers.mu.Lock()
+    handler := s.handlers.onFileProgress
+    s.handlers.mu.Unlock()
+    if handler != nil {
+        handler(progress)
+    }
+}
+
+// SendFile 通过 DataChannel 发送文件, 等待接收端校验完成后返回
+// 发送失败(比如连接断开)后重新发送同一个文件, 接收端从已接收的位置继续; 对端未配置接收目录时返回 ErrFileRejected
+func (s *Session) SendFile(ctx context.Context, path string) error {
+    s.files.sendMu.Lock()
+    defer s.files.sendMu.Unlock()
+
+    file, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    meta, err := newFileMeta(file)
+    if err != nil {
+        return err
+    }
+    progress := FileProgress{FileMeta: meta, Sending: true, Path: path}
+    err = s.sendFile(ctx, file, &progress)
+    progress.Done, progress.Err = true, err
+    s.emitFileProgress(progress)
+    return err
+}
+
+func (s *Session) sendFile(ctx context.Context, file *os.File, progress *FileProgress) error {
+    meta := progress.FileMeta
+    if err := s.WaitWritable(ctx); err != nil {
+        return err
+    }
+    dataChannel, err := s.writableDataChannel()
+    if err != nil {
+        return err
+    }
+    sender := &fileSender{accept: make(chan fileAccept, 1), result: make(chan fileResult, 1)}
+    s.files.mu.Lock()
+    s.files.senders[meta.ID] = sender
+    s.files.mu.Unlock()
+    defer func() {
+        s.files.mu.Lock()
+        delete(s.files.senders, meta.ID)
+        s.files.mu.Unlock()
+    }()
+
+    if err := s.sendFileFrame(fileFrameOffer, meta); err != nil {
+        return err
+    }
+    var accept fileAccept
+    select {
+    case accept = <-sender.accept:
+    case result := <-sender.result:
+        return fmt.Errorf("%w: %s", ErrFileRejected, result.Error)
+    case <-ctx.Done():
+        s.cancelFileTransfer(meta.ID, ctx.Err())
+        return ctx.Err()
+    case <-s.closeChan:
+        return ErrSessionClosed
+    }
+    if accept.Offset < 0 || accept.Offset > meta.Size {
+        err := fmt.Errorf("invalid resume offset %d", accept.Offset)
+        s.cancelFileTransfer(meta.ID, err)
+        return err
+    }
+    if _, err := file.Seek(accept.Offset, io.SeekStart); err != nil {
+        s.cancelFileTransfer(meta.ID, err)
+        return err
+    }
+    progress.Offset, progress.Transferred = accept.Offset, accept.Offset
+    log.Printf("send file %s to %s, size=%d, offset=%d, session=%s\n", meta.Name, s.remoteCid, meta.Size, accept.Offset, s.id)
+
+    id, err := hex.DecodeString(meta.ID)
+    if err != nil {
+        return err
+    }
+    buf := make([]byte, fileChunkHeaderSize+fileChunkSize)
+    buf[0] = fileFrameChunk
+    copy(buf[1:], id)
+    for progress.Transferred < meta.Size {
+        chunk := buf[fileChunkHeaderSize:]
+        if remaining := meta.Size - progress.Transferred; remaining < fileChunkSize {
+            chunk = chunk[:remaining]
+        }
+        n, err := io.ReadFull(file, chunk)
+        if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+            s.cancelFileTransfer(meta.ID, err)
+            return err
+        }
+        if err := s.waitBufferedAmountLow(ctx, dataChannel, sender); err != nil {
+            s.cancelFileTransfer(meta.ID, err)
+            return err
+        }
+        binary.BigEndian.PutUint64(buf[1+fileIdSize:], uint64(progress.Transferred))
+        if err := dataChannel.Send(buf[:fileChunkHeaderSize+n]); err != nil {
+            return err
+        }
+        progress.Transferred += int64(n)
+        s.emitFileProgress(*progress)
+    }
+
+    // 等待接收端校验结果
+    select {
+    case result := <-sender.result:
+        if result.Error != "" {
+            return fmt.Errorf("%w: %s", ErrFileTransferFailed, result.Error)
+        }
+        log.Printf("file %s sent to %s, session=%s\n", meta.Name, s.remoteCid, s.id)
+        return nil
+    case <-ctx.Done():
+        s.cancelFileTransfer(meta.ID, ctx.Err())
+        return ctx.Err()
+    case <-s.closeChan:
+        return ErrSessionClosed
+    }
+}
+
+// waitBufferedAmountLow 发送缓冲超过上限时等待缓冲降到阈值以下, 避免大文件占满 SCTP 发送缓冲
+// 等待期间接收端取消传输或会话关闭时返回错误
+func (s *Session) waitBufferedAmountLow(ctx context.Context, dataChannel *webrtc.DataChannel, sender *fileSender) error {
+    for {
+        // 先清除旧通知再检查缓冲, 检查之后缓冲降到阈值以下一定会收到新通知
+        select {
+        case <-s.files.bufferedLow:
+        default:
+        }
+        select {
+        case result := <-sender.result:
+            return fmt.Errorf("%w: %s", ErrFileTransferFailed, result.Error)
+        default:
+        }
+        if dataChannel.BufferedAmount() <= fileMaxBufferedAmount {
+            return nil
+        }
+        select {
+        case <-s.files.bufferedLow:
+        case result := <-sender.result:
+            return fmt.Errorf("%w: %s", ErrFileTransferFailed, result.Error)
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-s.closeChan:
+            return ErrSessionClosed
+        }
+    }
+}
+
+func (s *Session) onBufferedAmountLow() {
+    select {
+    case s.files.bufferedLow <- struct{}{}:
+    default:
+    }
+}
+
+// cancelFileTransfer 通知对端取消传输, 接收端保留已接收的数据用于断点续传
+func (s *Session) cancelFileTransfer(id string, reason error) {
+    if err := s.sendFileFrame(fileFrameResult, fileResult{ID: id, Error: reason.Error()}); err != nil {
+        log.Printf("send file cancel to %s failed, err: %v\n", s.remoteCid, err)
+    }
+}
+
+// newFileMeta 计算文件的元信息, 读取整个文件计算 SHA-256
+func newFileMeta(file *os.File) (FileMeta, error) {
+    info, err := file.Stat()
+    if err != nil {
+        return FileMeta{}, err
+    }
+    if !info.Mode().IsRegular() {
+        return FileMeta{}, fmt.Errorf("%s is not a regular file", file.Name())
+    }
+    h := sha256.New()
+    size, err := io.Copy(h, file)
+    if err != nil {
+        return FileMeta{}, err
+    }
+    if _, err := file.Seek(0, io.SeekStart); err != nil {
+        return FileMeta{}, err
+    }
+    return FileMeta{
+        ID:     newSessionId(),
+        Name:   filepath.Base(file.Name()),
+        Size:   size,
+        SHA256: hex.EncodeToString(h.Sum(nil)),
+    }, nil
+}
+
+func (s *Session) sendFileFrame(frameType byte, v interface{}) error {
+    data, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    dataChannel, err := s.writableDataChannel()
+    if err != nil {
+        return err
+    }
+    return dataChannel.Send(append([]byte{frameType}, data...))
+}
+
+// handleFileFrame 处理对端发送的文件传输帧, 在 DataChannel 的读循环中执行, 写文件较慢时会对发送端形成背压
+func (s *Session) handleFileFrame(data []byte) {
+    if len(data) == 0 {
+        return
+    }
+    var err error
+    switch data[0] {
+    case fileFrameOffer:
+        meta := FileMeta{}
+        if err = json.Unmarshal(data[1:], &meta); err == nil {
+            s.handleFileOffer(meta)
+        }
+    case fileFrameAccept:
+        accept := fileAccept{}
+        if err = json.Unmarshal(data[1:], &accept); err == nil {
+            if sender := s.getFileSender(accept.ID); sender != nil {
+                select {
+                case sender.accept <- accept:
+                default:
+                }
+            }
+        }
+    case fileFrameChunk:
+        if len(data) < fileChunkHeaderSize {
+            err = errors.New("short file chunk")
+            break
+        }
+        id := hex.EncodeToString(data[1 : 1+fileIdSize])
+        s.handleFileChunk(id, int64(binary.BigEndian.Uint64(data[1+fileIdSize:])), data[fileChunkHeaderSize:])
+    case fileFrameResult:
+        result := fileResult{}
+        if err = json.Unmarshal(data[1:], &result); err == nil {
+            s.handleFileResult(result)
+        }
+    default:
+        err = fmt.Errorf("unknown frame type %d", data[0])
+    }
+    if err != nil {
+        log.Printf("invalid file frame from %s, session=%s, err: %v\n", s.remoteCid, s.id, err)
+    }
+}
+
+func (s *Session) getFileSender(id string) *fileSender {
+    s.files.mu.Lock()
+    defer s.files.mu.Unlock()
+    return s.files.senders[id]
+}
+
+func (s *Session) getFileReceiver(id string) *fileReceiver {
+    s.files.mu.Lock()
+    defer s.files.mu.Unlock()
+    return s.files.receivers[id]
+}
+
+// handleFileOffer 打开(或继续写入)接收目录中的 .part 文件, 回复已接收的数据长度
+func (s *Session) handleFileOffer(meta FileMeta) {
+    reject := func(err error) {
+        log.Printf("reject file %q from %s, err: %v\n", meta.Name, s.remoteCid, err)
+        if err := s.sendFileFrame(fileFrameResult, fileResult{ID: meta.ID, Error: err.Error()}); err != nil {
+            log.Printf("send file reject to %s failed, err: %v\n", s.remoteCid, err)
+        }
+    }
+    dir := s.client.receiveDir
+    if dir == "" {
+        reject(errors.New("file transfer is not accepted"))
+        return
+    }
+    if err := validFileMeta(meta); err != nil {
+        reject(err)
+        return
+    }
+    // 同一个文件(.part 文件相同)同时只能有一个接收者, 否则两个传输会交替写入同一个文件
+    partPath := filePartPath(dir, meta)
+    if !s.client.reservePartPath(partPath) {
+        reject(errors.New("file is already being received"))
+        return
+    }
+    receiver, err := openFileReceiver(partPath, meta)
+    if err != nil {
+        s.client.releasePartPath(partPath)
+        reject(err)
+        return
+    }
+    receiver.mu.Lock()
+    defer receiver.mu.Unlock()
+    s.files.mu.Lock()
+    s.files.receivers[meta.ID] = receiver
+    s.files.mu.Unlock()
+    log.Printf("receive file %s from %s, size=%d, offset=%d, session=%s\n", meta.Name, s.remoteCid, meta.Size, receiver.offset, s.id)
+
+    if err := s.sendFileFrame(fileFrameAccept, fileAccept{ID: meta.ID, Offset: receiver.offset}); err != nil {
+        s.closeFileReceiver(receiver, err)
+        return
+    }
+    s.emitFileProgress(receiver.progress())
+    // 之前已经接收完整, 不会再收到数据
+    if receiver.received == meta.Size {
+        s.finishFileReceiver(receiver)
+    }
+}
+
+func (s *Session) handleFileChunk(id string, offset int64, data []byte) {
+    receiver := s.getFileReceiver(id)
+    if receiver == nil {
+        return
+    }
+    receiver.mu.Lock()
+    defer receiver.mu.Unlock()
+    if receiver.done {
+        return
+    }
+    if offset != receiver.received || receiver.received+int64(len(data)) > receiver.meta.Size {
+        s.failFileReceiver(receiver, fmt.Errorf("unexpected chunk at offset %d, received %d", offset, receiver.received))
+        return
+    }
+    if _, err := receiver.file.Write(data); err != nil {
+        s.failFileReceiver(receiver, err)
+        return
+    }
+    receiver.hash.Write(data)
+    receiver.received += int64(len(data))
+    s.emitFileProgress(receiver.progress())
+    if receiver.received == receiver.meta.Size {
+        s.finishFileReceiver(receiver)
+    }
+}
+
+func (s *Session) handleFileResult(result fileResult) {
+    if sender := s.getFileSender(result.ID); sender != nil {
+        select {
+        case sender.result <- result:
+        default:
+        }
+        return
+    }
+    // 发送端取消传输, 保留已接收的数据
+    if receiver := s.getFileReceiver(result.ID); receiver != nil {
+        log.Printf("file %s canceled by %s, err: %s\n", receiver.meta.Name, s.remoteCid, result.Error)
+        receiver.mu.Lock()
+        defer receiver.mu.Unlock()
+        s.closeFileReceiver(receiver, fmt.Errorf("%w: %s", ErrFileTransferFailed, result.Error))
+    }
+}
+
+// finishFileReceiver 校验 SHA-256, 成功后将 .part 文件重命名为接收目录中不重名的文件, 并通知发送端校验结果
+// 以下结束接收的方法都需持有 receiver.mu
+func (s *Session) finishFileReceiver(receiver *fileReceiver) {
+    if sum := hex.EncodeToString(receiver.hash.Sum(nil)); sum != receiver.meta.SHA256 {
+        // 已接收的数据有误, 删除后重新发送时从头开始
+        receiver.corrupt = true
+        s.failFileReceiver(receiver, fmt.Errorf("sha256 mismatch, got %s", sum))
+        return
+    }
+    path, err := receiver.complete()
+    if err != nil {
+        s.failFileReceiver(receiver, err)
+        return
+    }
+    s.endFileReceiver(receiver)
+    if err := s.sendFileFrame(fileFrameResult, fileResult{ID: receiver.meta.ID}); err != nil {
+        log.Printf("send file result to %s failed, err: %v\n", s.remoteCid, err)
+    }
+    log.Printf("file %s received from %s, saved to %s\n", receiver.meta.Name, s.remoteCid, path)
+    progress := receiver.progress()
+    progress.Path, progress.Done = path, true
+    s.emitFileProgress(progress)
+}
+
+// failFileReceiver 接收出错, 通知发送端并结束接收
+func (s *Session) failFileReceiver(receiver *fileReceiver, err error) {
+    if receiver.done {
+        return
+    }
+    log.Printf("receive file %s from %s failed, err: %v\n", receiver.meta.Name, s.remoteCid, err)
+    if err := s.sendFileFrame(fileFrameResult, fileResult{ID: receiver.meta.ID, Error: err.Error()}); err != nil {
+        log.Printf("send file result to %s failed, err: %v\n", s.remoteCid, err)
+    }
+    s.closeFileReceiver(receiver, err)
+}
+
+// closeFileReceiver 结束接收, 数据无误时保留 .part 文件
+// 先关闭(删除)文件再释放 .part 文件, 否则新的传输可能在删除前开始续传有误的数据
+func (s *Session) closeFileReceiver(receiver *fileReceiver, err error) {
+    if receiver.done {
+        return
+    }
+    _ = receiver.file.Close()
+    if receiver.corrupt {
+        if err := os.Remove(receiver.partPath); err != nil {
+            log.Printf("remove corrupt part file %s failed, err: %v\n", receiver.partPath, err)
+        }
+    }
+    s.endFileReceiver(receiver)
+    progress := receiver.progress()
+    progress.Done, progress.Err = true, err
+    s.emitFileProgress(progress)
+}
+
+// endFileReceiver 标记接收结束, 不再处理之后的数据帧, .part 文件可以被新的传输继续接收
+func (s *Session) endFileReceiver(receiver *fileReceiver) {
+    receiver.done = true
+    s.files.mu.Lock()
+    delete(s.files.receivers, receiver.meta.ID)
+    s.files.mu.Unlock()
+    s.client.releasePartPath(receiver.partPath)
+}
+
+// closeFileTransfers 会话关闭时结束所有接收中的文件, 已接收的数据留给断点续传
+func (s *Session) closeFileTransfers() {
+    s.files.mu.Lock()
+    receivers := make([]*fileReceiver, 0, len(s.files.receivers))
+    for _, receiver := range s.files.receivers {
+        receivers = append(receivers, receiver)
+    }
+    s.files.mu.Unlock()
+    for _, receiver := range receivers {
+        receiver.mu.Lock()
+        s.closeFileReceiver(receiver, ErrSessionClosed)
+        receiver.mu.Unlock()
+    }
+}
+
+// reservePartPath 登记接收中的 .part 文件, 已有其他传输在接收时返回 false
+func (c *Client) reservePartPath(partPath string) bool {
+    c.receiveMux.Lock()
+    defer c.receiveMux.Unlock()
+    if c.receiving[partPath] {
+        return false
+    }
+    c.receiving[partPath] = true
+    return true
+}
+
+func (c *Client) releasePartPath(partPath string) {
+    c.receiveMux.Lock()
+    defer c.receiveMux.Unlock()
+    delete(c.receiving, partPath)
+}
+
+// validFileMeta 校验对端发送的文件元信息, 文件名不能包含目录
+func validFileMeta(meta FileMeta) error {
+    if len(meta.ID) != hex.EncodedLen(fileIdSize) {
+        return fmt.Errorf("invalid transfer id %q", meta.ID)
+    }
+    if _, err := hex.DecodeString(meta.ID); err != nil {
+        return fmt.Errorf("invalid transfer id %q", meta.ID)
+    }
+    if meta.Name == "" || meta.Name == "." || meta.Name == ".." || strings.ContainsAny(meta.Name, `/\`) {
+        return fmt.Errorf("invalid file name %q", meta.Name)
+    }
+    if meta.Size < 0 {
+        return fmt.Errorf("invalid file size %d", meta.Size)
+    }
+    if sum, err := hex.DecodeString(meta.SHA256); err != nil || len(sum) != sha256.Size {
+        return fmt.Errorf("invalid sha256 %q", meta.SHA256)
+    }
+    return nil
+}
+
+// filePartPath 接收目录中未完成数据的 .part 文件, 按文件名和 SHA-256 区分
+func filePartPath(dir string, meta FileMeta) string {
+    return filepath.Join(dir, "."+meta.Name+"."+meta.SHA256[:16]+filePartSuffix)
+}
+
+// openFileReceiver 打开 .part 文件, 已有的数据计入 SHA-256, 从文件末尾继续写入
+func openFileReceiver(partPath string, meta FileMeta) (*fileReceiver, error) {
+    file, err := os.OpenFile(partPath, os.O_CREATE|os.O_RDWR, 0o644)
+    if err != nil {
+        return nil, err
+    }
+    h := sha256.New()
+    offset, err := io.Copy(h, file)
+    if err == nil && offset > meta.Size {
+        // 不是同一个文件的数据, 从头接收
+        h.Reset()
+        offset = 0
+        if err = file.Truncate(0); err == nil {
+            _, err = file.Seek(0, io.SeekStart)
+        }
+    }
+    if err != nil {
+        _ = file.Close()
+        return nil, err
+    }
+    return &fileReceiver{
+        meta:     meta,
+        file:     file,
+        partPath: partPath,
+        hash:     h,
+        offset:   offset,
+        received: offset,
+    }, nil
+}
+
+// complete 关闭 .part 文件并重命名, 接收目录中已有同名文件时在文件名后加序号
+func (r *fileReceiver) complete() (string, error) {
+    if err := r.file.Close(); err != nil {
+        return "", err
+    }
+    dir := filepath.Dir(r.partPath)
+    ext := filepath.Ext(r.meta.Name)
+    base := strings.TrimSuffix(r.meta.Name, ext)
+    path := filepath.Join(dir, r.meta.Name)
+    for i := 1; ; i++ {
+        if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+            break
+        }
+        path = filepath.Join(dir, base+" ("+strconv.Itoa(i)+")"+ext)
+    }
+    if err := os.Rename(r.partPath, path); err != nil {
+        return "", err
+    }
+    return path, nil
+}
+
+func (r *fileReceiver) progress() FileProgress {
+    return FileProgress{
+        FileMeta:    r.meta,
+        Path:        r.partPath,
+        Offset:      r.offset,
+        Transferred: r.received,
+    }
+}
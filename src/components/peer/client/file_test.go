@@ -0,0 +1,250 @@
+package client
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "errors"
+    "github.com/pion/logging"
+    "github.com/pion/transport/v3/vnet"
+    "os"
+    "path/filepath"
+    "sync"
+    "testing"
+    "time"
+)
+
+// newConnectedSessions 通过虚拟网络建立一对 DataChannel 可写的会话, 接收端文件保存到 receiveDir
+func newConnectedSessions(t *testing.T, receiveDir string) (*Session, *Session) {
+    wan, err := vnet.NewRouter(&vnet.RouterConfig{CIDR: "1.2.3.0/24", LoggerFactory: logging.NewDefaultLoggerFactory()})
+    if err != nil {
+        t.Fatal(err)
+    }
+    offerClient := newVNetClient(t, wan, "offer-peer", "1.2.3.4", false)
+    answerClient := newVNetClient(t, wan, "answer-peer", "1.2.3.5", false)
+    answerClient.receiveDir = receiveDir
+    if err := wan.Start(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        _ = wan.Stop()
+    })
+
+    offerSession, err := offerClient.newSession("answer-peer", "", newSessionId(), true, offerClient.webrtcConfiguration())
+    if err != nil {
+        t.Fatal(err)
+    }
+    offerClient.addSession(offerSession)
+    offerSdp, err := offerSession.createOffer(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    answerClient.handleSdp(offerSdp)
+    answerSession := answerClient.getSession("offer-peer", offerSession.ID())
+    if answerSession == nil {
+        t.Fatal("answer session not created")
+    }
+    waitFor(t, "data channel", func() bool {
+        deliver(offerClient, takeUnsent(answerClient), false)
+        deliver(answerClient, takeUnsent(offerClient), false)
+        select {
+        case <-offerSession.writable:
+        default:
+            return false
+        }
+        select {
+        case <-answerSession.writable:
+            return true
+        default:
+            return false
+        }
+    })
+    return offerSession, answerSession
+}
+
+// progressRecorder 记录文件传输进度回调
+type progressRecorder struct {
+    progress []FileProgress
+    mu       sync.Mutex
+}
+
+func (r *progressRecorder) record(progress FileProgress) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.progress = append(r.progress, progress)
+}
+
+func (r *progressRecorder) last() FileProgress {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if len(r.progress) == 0 {
+        return FileProgress{}
+    }
+    return r.progress[len(r.progress)-1]
+}
+
+func writeRandomFile(t *testing.T, dir, name string, size int) []byte {
+    data := make([]byte, size)
+    _, _ = rand.Read(data)
+    if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+        t.Fatal(err)
+    }
+    return data
+}
+
+func TestSendFile(t *testing.T) {
+    sendDir, receiveDir := t.TempDir(), t.TempDir()
+    offerSession, answerSession := newConnectedSessions(t, receiveDir)
+    sent, received := &progressRecorder{}, &progressRecorder{}
+    offerSession.OnFileProgress(sent.record)
+    answerSession.OnFileProgress(received.record)
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    // 1 文件大于发送缓冲上限, 发送过程中需要等待缓冲降低
+    data := writeRandomFile(t, sendDir, "report.bin", 3*fileMaxBufferedAmount+123)
+    if err := offerSession.SendFile(ctx, filepath.Join(sendDir, "report.bin")); err != nil {
+        t.Fatal(err)
+    }
+    if got, err := os.ReadFile(filepath.Join(receiveDir, "report.bin")); err != nil || !bytes.Equal(got, data) {
+        t.Fatalf("received file mismatch, err: %v", err)
+    }
+    if p := sent.last(); !p.Done || p.Err != nil || !p.Sending || p.Transferred != int64(len(data)) {
+        t.Fatalf("unexpected send progress: %+v", p)
+    }
+    waitFor(t, "receive progress", func() bool {
+        return received.last().Done
+    })
+    if p := received.last(); p.Err != nil || p.Sending || p.Path != filepath.Join(receiveDir, "report.bin") {
+        t.Fatalf("unexpected receive progress: %+v", p)
+    }
+
+    // 2 接收目录已有部分数据时从已接收的位置继续, 同名文件不覆盖
+    file, err := os.Open(filepath.Join(sendDir, "report.bin"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    meta, err := newFileMeta(file)
+    _ = file.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+    resumed := fileMaxBufferedAmount + 7
+    partPath := filePartPath(receiveDir, meta)
+    if err := os.WriteFile(partPath, data[:resumed], 0o644); err != nil {
+        t.Fatal(err)
+    }
+    if err := offerSession.SendFile(ctx, filepath.Join(sendDir, "report.bin")); err != nil {
+        t.Fatal(err)
+    }
+    if p := sent.last(); p.Offset != int64(resumed) || p.Transferred != int64(len(data)) {
+        t.Fatalf("transfer should resume from %d: %+v", resumed, p)
+    }
+    if got, err := os.ReadFile(filepath.Join(receiveDir, "report (1).bin")); err != nil || !bytes.Equal(got, data) {
+        t.Fatalf("resumed file mismatch, err: %v", err)
+    }
+
+    // 3 已接收的数据有误时校验失败并删除, 重新发送从头开始
+    if err := os.WriteFile(partPath, make([]byte, resumed), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    if err := offerSession.SendFile(ctx, filepath.Join(sendDir, "report.bin")); !errors.Is(err, ErrFileTransferFailed) {
+        t.Fatalf("expected sha256 mismatch, got: %v", err)
+    }
+    if _, err := os.Stat(partPath); !errors.Is(err, os.ErrNotExist) {
+        t.Fatalf("corrupted part file should be removed, err: %v", err)
+    }
+    if err := offerSession.SendFile(ctx, filepath.Join(sendDir, "report.bin")); err != nil {
+        t.Fatal(err)
+    }
+    if p := sent.last(); p.Offset != 0 {
+        t.Fatalf("transfer should restart from 0: %+v", p)
+    }
+
+    // 4 空文件
+    writeRandomFile(t, sendDir, "empty", 0)
+    if err := offerSession.SendFile(ctx, filepath.Join(sendDir, "empty")); err != nil {
+        t.Fatal(err)
+    }
+    if info, err := os.Stat(filepath.Join(receiveDir, "empty")); err != nil || info.Size() != 0 {
+        t.Fatalf("empty file not received, err: %v", err)
+    }
+
+    // 5 同一个文件正在被其他传输接收时拒绝
+    answerSession.client.reservePartPath(partPath)
+    if err := offerSession.SendFile(ctx, filepath.Join(sendDir, "report.bin")); !errors.Is(err, ErrFileRejected) {
+        t.Fatalf("expected rejection, got: %v", err)
+    }
+    answerSession.client.releasePartPath(partPath)
+
+    // 6 未配置接收目录的一端拒绝接收
+    if err := answerSession.SendFile(ctx, filepath.Join(sendDir, "empty")); !errors.Is(err, ErrFileRejected) {
+        t.Fatalf("expected rejection, got: %v", err)
+    }
+}
+
+// 接收过程中会话关闭, 接收端只通知一次结束, .part 文件可以被之后的传输继续接收
+func TestCloseWhileReceiving(t *testing.T) {
+    sendDir, receiveDir := t.TempDir(), t.TempDir()
+    offerSession, answerSession := newConnectedSessions(t, receiveDir)
+    received := &progressRecorder{}
+    answerSession.OnFileProgress(received.record)
+    writeRandomFile(t, sendDir, "large.bin", 8*fileMaxBufferedAmount)
+
+    sendErr := make(chan error, 1)
+    go func() {
+        sendErr <- offerSession.SendFile(context.Background(), filepath.Join(sendDir, "large.bin"))
+    }()
+    waitFor(t, "receiving", func() bool {
+        return received.last().Transferred > 0
+    })
+    answerSession.Close()
+    select {
+    case err := <-sendErr:
+        if err == nil {
+            t.Fatal("send should fail after the receiver closed")
+        }
+    case <-time.After(30 * time.Second):
+        t.Fatal("send did not stop after the receiver closed")
+    }
+
+    received.mu.Lock()
+    defer received.mu.Unlock()
+    done := 0
+    for _, p := range received.progress {
+        if p.Done {
+            done++
+        }
+    }
+    if done != 1 || !errors.Is(received.progress[len(received.progress)-1].Err, ErrSessionClosed) {
+        t.Fatalf("expected one done progress with session closed, got %d", done)
+    }
+    answerSession.client.receiveMux.Lock()
+    defer answerSession.client.receiveMux.Unlock()
+    if len(answerSession.client.receiving) != 0 {
+        t.Fatalf("part file should be released: %v", answerSession.client.receiving)
+    }
+}
+
+func TestValidFileMeta(t *testing.T) {
+    valid := FileMeta{ID: newSessionId(), Name: "a.txt", Size: 1, SHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}
+    if err := validFileMeta(valid); err != nil {
+        t.Fatal(err)
+    }
+    for _, name := range []string{"", ".", "..", "../a.txt", "dir/a.txt", `dir\a.txt`} {
+        meta := valid
+        meta.Name = name
+        if err := validFileMeta(meta); err == nil {
+            t.Fatalf("file name %q should be rejected", name)
+        }
+    }
+    invalid := []FileMeta{valid, valid, valid}
+    invalid[0].ID = "x"
+    invalid[1].Size = -1
+    invalid[2].SHA256 = "abc"
+    for _, meta := range invalid {
+        if err := validFileMeta(meta); err == nil {
+            t.Fatalf("meta should be rejected: %+v", meta)
+        }
+    }
+}
@@ -0,0 +1,147 @@
+package client
+
+import (
+    "fmt"
+    "github.com/pion/stun/v3"
+    "github.com/pion/webrtc/v4"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "log"
+    "strings"
+    "time"
+)
+
+const minICERefreshInterval = 5 * time.Second // 刷新 TURN 认证信息失败后的最短重试间隔
+
+// ParseICEServers 解析逗号分隔的 ICE 服务器列表, 每项格式为 [username:credential@]url, 比如
+// "stun:stun.l.google.com:19302,turn:user:pass@turn.example.com:3478?transport=udp"
+// 没有单独指定认证信息的 TURN 服务器使用 username 和 credential
+func ParseICEServers(value, username, credential string) ([]webrtc.ICEServer, error) {
+    var iceServers []webrtc.ICEServer
+    for _, entry := range strings.Split(value, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        iceServer := webrtc.ICEServer{}
+        rawURL := entry
+        // 认证信息放在 scheme 之后、主机之前: turn:user:pass@host:port
+        if i := strings.LastIndex(entry, "@"); i >= 0 {
+            scheme, userinfo, ok := strings.Cut(entry[:i], ":")
+            if !ok {
+                return nil, fmt.Errorf("invalid ICE server %q", entry)
+            }
+            sep := strings.LastIndex(userinfo, ":")
+            if sep < 0 {
+                return nil, fmt.Errorf("invalid ICE server credentials in %q, want username:credential", entry)
+            }
+            iceServer.Username, iceServer.Credential = userinfo[:sep], userinfo[sep+1:]
+            rawURL = scheme + ":" + entry[i+1:]
+        }
+        uri, err := stun.ParseURI(rawURL)
+        if err != nil {
+            return nil, fmt.Errorf("invalid ICE server %q: %w", rawURL, err)
+        }
+        if uri.Scheme == stun.SchemeTypeTURN || uri.Scheme == stun.SchemeTypeTURNS {
+            if iceServer.Username == "" {
+                iceServer.Username, iceServer.Credential = username, credential
+            }
+            iceServer.CredentialType = webrtc.ICECredentialTypePassword
+        }
+        iceServer.URLs = []string{rawURL}
+        iceServers = append(iceServers, iceServer)
+    }
+    return iceServers, nil
+}
+
+// ParseICETransportPolicy 解析 ICE 传输策略, 空或 all 使用所有候选地址, relay 只使用 TURN 中继
+func ParseICETransportPolicy(value string) (webrtc.ICETransportPolicy, error) {
+    switch value {
+    case "", "all":
+        return webrtc.ICETransportPolicyAll, nil
+    case "relay":
+        return webrtc.ICETransportPolicyRelay, nil
+    default:
+        return webrtc.ICETransportPolicyAll, fmt.Errorf("invalid ICE transport policy %q, want all or relay", value)
+    }
+}
+
+// ParseNetworkTypes 解析逗号分隔的 ICE 候选地址网络类型(udp4, udp6, tcp4, tcp6), 空表示不限制
+// 比如只有 IPv6 可用的移动网络可以配置 "udp6,tcp6"
+func ParseNetworkTypes(value string) ([]webrtc.NetworkType, error) {
+    var networkTypes []webrtc.NetworkType
+    for _, entry := range strings.Split(value, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        networkType, err := webrtc.NewNetworkType(entry)
+        if err != nil {
+            return nil, fmt.Errorf("invalid ICE network type %q, want udp4, udp6, tcp4 or tcp6", entry)
+        }
+        networkTypes = append(networkTypes, networkType)
+    }
+    return networkTypes, nil
+}
+
+// setIssuedICEServers 更新信令服务器下发的 ICE 服务器, 并在 TURN 认证信息有效期过半时刷新
+func (c *Client) setIssuedICEServers(iceServers []webrtc.ICEServer, ttlSec int64) {
+    c.iceMux.Lock()
+    defer c.iceMux.Unlock()
+    c.issuedICEServers = iceServers
+    if c.iceRefreshTimer != nil {
+        c.iceRefreshTimer.Stop()
+        c.iceRefreshTimer = nil
+    }
+    if len(iceServers) == 0 || ttlSec <= 0 {
+        return
+    }
+    ttl := time.Duration(ttlSec) * time.Second
+    c.issuedExpiry = time.Now().Add(ttl)
+    c.iceRefreshTimer = time.AfterFunc(ttl/2, c.refreshICEServers)
+}
+
+// refreshICEServers 向信令服务器请求新的 TURN 认证信息, 失败时在剩余有效期过半时重试
+// 与信令服务器断开期间不刷新, 重连注册时会重新下发
+func (c *Client) refreshICEServers() {
+    select {
+    case <-c.closeChan:
+        return
+    default:
+    }
+    if c.SignalState() != SignalStateConnected {
+        return
+    }
+    iceServersRequest := message.NewICEServersRequest(c.cid)
+    iceServersResponse := message.ICEServersResponse{}
+    if err := c.Call(&iceServersRequest, &iceServersResponse, c.requestTimeout); err != nil {
+        log.Printf("refresh ice servers failed: %v", err)
+        c.iceMux.Lock()
+        defer c.iceMux.Unlock()
+        retry := time.Until(c.issuedExpiry) / 2
+        if retry < minICERefreshInterval {
+            retry = minICERefreshInterval
+        }
+        if c.iceRefreshTimer != nil {
+            c.iceRefreshTimer.Stop()
+        }
+        c.iceRefreshTimer = time.AfterFunc(retry, c.refreshICEServers)
+        return
+    }
+    log.Printf("signal server refreshed %d ice servers\n", len(iceServersResponse.ICEServers))
+    c.setIssuedICEServers(iceServersResponse.ICEServers, iceServersResponse.ICEServersTTL)
+    for _, s := range c.Sessions() {
+        s.updateICEServers()
+    }
+}
+
+// updateICEServers 把客户端当前的 ICE 服务器(包括刷新后的 TURN 认证信息)同步到会话的 PeerConnection, 保留会话的传输策略
+// pion 的 ICE gatherer 在创建 PeerConnection 时确定 ICE 服务器, 同步后的配置不会替换已经创建的 gatherer
+func (s *Session) updateICEServers() {
+    s.configMux.Lock()
+    defer s.configMux.Unlock()
+    config := s.peerConn.GetConfiguration()
+    config.ICEServers = s.client.webrtcConfiguration().ICEServers
+    if err := s.peerConn.SetConfiguration(config); err != nil {
+        log.Printf("update ice servers of session %s failed: %v\n", s.id, err)
+    }
+}
@@ -0,0 +1,145 @@
+package client
+
+import (
+    "github.com/pion/webrtc/v4"
+    "kwseeker.top/kwseeker/p2p/src/components/signal/server"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestParseICEServers(t *testing.T) {
+    iceServers, err := ParseICEServers("stun:stun.l.google.com:19302, turn:alice:s3cr:et@turn.example.com:3478?transport=udp,turns:turn.example.com", "bob", "pass")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(iceServers) != 3 {
+        t.Fatalf("expected 3 ice servers, got %d", len(iceServers))
+    }
+    // STUN 服务器不需要认证信息
+    if stun := iceServers[0]; stun.URLs[0] != "stun:stun.l.google.com:19302" || stun.Username != "" || stun.Credential != nil {
+        t.Fatalf("unexpected stun server: %+v", stun)
+    }
+    // URL 中的认证信息优先, 密码可以包含冒号
+    if turn := iceServers[1]; turn.URLs[0] != "turn:turn.example.com:3478?transport=udp" || turn.Username != "alice:s3cr" || turn.Credential != "et" ||
+        turn.CredentialType != webrtc.ICECredentialTypePassword {
+        t.Fatalf("unexpected turn server: %+v", turn)
+    }
+    if turns := iceServers[2]; turns.URLs[0] != "turns:turn.example.com" || turns.Username != "bob" || turns.Credential != "pass" {
+        t.Fatalf("unexpected turns server: %+v", turns)
+    }
+
+    for _, value := range []string{"http://example.com", "turn:nocred@turn.example.com", "stun:"} {
+        if _, err := ParseICEServers(value, "", ""); err == nil {
+            t.Fatalf("expected error for %q", value)
+        }
+    }
+}
+
+func TestParseICETransportPolicy(t *testing.T) {
+    for value, expected := range map[string]webrtc.ICETransportPolicy{"": webrtc.ICETransportPolicyAll, "all": webrtc.ICETransportPolicyAll, "relay": webrtc.ICETransportPolicyRelay} {
+        policy, err := ParseICETransportPolicy(value)
+        if err != nil || policy != expected {
+            t.Fatalf("ParseICETransportPolicy(%q) = %s, %v", value, policy, err)
+        }
+    }
+    if _, err := ParseICETransportPolicy("host"); err == nil {
+        t.Fatal("expected error for unknown policy")
+    }
+
+    c := NewClient(&Option{
+        ICEServerAddr:      "stun:unused.example.com",
+        ICEServers:         []webrtc.ICEServer{{URLs: []string{"turn:turn.example.com"}, Username: "u", Credential: "p"}},
+        ICETransportPolicy: webrtc.ICETransportPolicyRelay,
+    })
+    config := c.webrtcConfiguration()
+    if len(config.ICEServers) != 1 || config.ICEServers[0].URLs[0] != "turn:turn.example.com" || config.ICETransportPolicy != webrtc.ICETransportPolicyRelay {
+        t.Fatalf("unexpected configuration: %+v", config)
+    }
+}
+
+func TestIssuedICEServers(t *testing.T) {
+    addr, shutdown := serveWith(t, "127.0.0.1:0", server.Options{
+        TURNURLs:   []string{"turn:turn.example.com:3478"},
+        TURNSecret: "turn-secret",
+        TURNTTL:    2 * time.Second,
+    })
+    defer shutdown()
+
+    c := NewClient(&Option{
+        SignalServerAddr: addr,
+        SignalServerPath: "/signal",
+        ICEServers:       []webrtc.ICEServer{{URLs: []string{"stun:stun.example.com"}}},
+        Cid:              "turn-peer",
+    })
+    defer c.Close()
+    if err := c.connectSignalServer(); err != nil {
+        t.Fatal(err)
+    }
+
+    // 注册后自动使用信令服务器下发的 TURN 临时认证信息
+    config := c.webrtcConfiguration()
+    if len(config.ICEServers) != 2 {
+        t.Fatalf("expected configured and issued ice servers, got: %+v", config.ICEServers)
+    }
+    turn := config.ICEServers[1]
+    if turn.URLs[0] != "turn:turn.example.com:3478" || !strings.HasSuffix(turn.Username, ":turn-peer") || turn.Credential == "" {
+        t.Fatalf("unexpected issued ice server: %+v", turn)
+    }
+    s, err := c.newSession("remote-peer", "", newSessionId(), false, config)
+    if err != nil {
+        t.Fatalf("issued ice server should be usable: %v", err)
+    }
+    defer s.Close()
+    c.addSession(s)
+
+    // 有效期过半时刷新, 长时间在线的客户端不会使用过期的 TURN 认证信息, 刷新后同步到已有的会话
+    waitFor(t, "ice servers refresh", func() bool {
+        return c.webrtcConfiguration().ICEServers[1].Username != turn.Username
+    })
+    waitFor(t, "session ice servers refresh", func() bool {
+        s.configMux.Lock()
+        defer s.configMux.Unlock()
+        iceServers := s.peerConn.GetConfiguration().ICEServers
+        return len(iceServers) == 2 && iceServers[1].Username != turn.Username
+    })
+}
+
+func TestParseNetworkTypes(t *testing.T) {
+    networkTypes, err := ParseNetworkTypes("udp6, tcp6")
+    if err != nil || len(networkTypes) != 2 || networkTypes[0] != webrtc.NetworkTypeUDP6 || networkTypes[1] != webrtc.NetworkTypeTCP6 {
+        t.Fatalf("ParseNetworkTypes = %v, %v", networkTypes, err)
+    }
+    if networkTypes, err = ParseNetworkTypes(""); err != nil || networkTypes != nil {
+        t.Fatalf("empty network types should not restrict, got %v, %v", networkTypes, err)
+    }
+    if _, err := ParseNetworkTypes("udp4,ipx"); err == nil {
+        t.Fatal("expected error for unknown network type")
+    }
+
+    // 只使用 IPv4 时不会收集到 IPv6 候选地址
+    c := NewClient(&Option{NetworkTypes: []webrtc.NetworkType{webrtc.NetworkTypeUDP4}})
+    defer c.Close()
+    peerConn, err := c.newPeerConnection(c.webrtcConfiguration())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer peerConn.Close()
+    gathered := webrtc.GatheringCompletePromise(peerConn)
+    if _, err := peerConn.CreateDataChannel("data", nil); err != nil {
+        t.Fatal(err)
+    }
+    offer, err := peerConn.CreateOffer(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := peerConn.SetLocalDescription(offer); err != nil {
+        t.Fatal(err)
+    }
+    <-gathered
+    for _, line := range strings.Split(peerConn.LocalDescription().SDP, "\r\n") {
+        if strings.HasPrefix(line, "a=candidate:") && (strings.Contains(line, " tcp ") || strings.Count(line, ":") > 1) {
+            t.Fatalf("unexpected candidate with network types udp4: %s", line)
+        }
+    }
+}
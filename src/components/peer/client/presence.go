@@ -0,0 +1,78 @@
+package client
+
+import (
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+)
+
+// QueryPresence 查询 Peer 是否在线
+func (c *Client) QueryPresence(cid string) (*message.Presence, error) {
+    presenceRequest := message.NewPresenceRequest(cid)
+    presenceResponse := message.PresenceResponse{}
+    if err := c.Call(&presenceRequest, &presenceResponse, c.requestTimeout); err != nil {
+        return nil, err
+    }
+    return &presenceResponse.Presence, nil
+}
+
+// WatchPresence 订阅 Peer 在线状态, 返回当前在线状态, 之后的上线、下线通过 OnPresenceChange 回调通知
+func (c *Client) WatchPresence(cid string) (*message.Presence, error) {
+    presence, err := c.subscribe(cid, false)
+    if err != nil {
+        return nil, err
+    }
+    c.presenceMux.Lock()
+    c.watching[cid] = true
+    c.presenceMux.Unlock()
+    return presence, nil
+}
+
+// UnwatchPresence 取消订阅 Peer 在线状态
+func (c *Client) UnwatchPresence(cid string) error {
+    c.presenceMux.Lock()
+    delete(c.watching, cid)
+    c.presenceMux.Unlock()
+    _, err := c.subscribe(cid, true)
+    return err
+}
+
+func (c *Client) subscribe(cid string, unsubscribe bool) (*message.Presence, error) {
+    subscribeRequest := message.NewSubscribeRequest(cid, unsubscribe)
+    subscribeResponse := message.SubscribeResponse{}
+    if err := c.Call(&subscribeRequest, &subscribeResponse, c.requestTimeout); err != nil {
+        return nil, err
+    }
+    return &subscribeResponse.Presence, nil
+}
+
+// OnPresenceChange 设置订阅的 Peer 在线状态变化回调
+func (c *Client) OnPresenceChange(f func(presence message.Presence)) {
+    c.presenceMux.Lock()
+    defer c.presenceMux.Unlock()
+    c.onPresenceHandler = f
+}
+
+func (c *Client) onPresence(presence message.Presence) {
+    c.presenceMux.Lock()
+    handler := c.onPresenceHandler
+    c.presenceMux.Unlock()
+    if handler != nil {
+        go handler(presence)
+    }
+}
+
+// OnPeerLeft 设置与本端协商过的 Peer 离开信令服务器的回调
+// 此时尚未完成的协商无法继续, 已建立的 P2P 连接不受影响
+func (c *Client) OnPeerLeft(f func(cid string)) {
+    c.presenceMux.Lock()
+    defer c.presenceMux.Unlock()
+    c.onPeerLeftHandler = f
+}
+
+func (c *Client) onPeerLeft(cid string) {
+    c.presenceMux.Lock()
+    handler := c.onPeerLeftHandler
+    c.presenceMux.Unlock()
+    if handler != nil {
+        go handler(cid)
+    }
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+    "github.com/pion/webrtc/v4"
+    "log"
+    "time"
+)
+
+const (
+    defaultICERestartAttempts = 5
+    defaultICERestartTimeout  = 10 * time.Second
+)
+
+// ICERestartPolicy P2P 连接断开或失败后 ICE 重启的重试策略
+type ICERestartPolicy struct {
+    MaxAttempts int           // 最多重启次数, 用完后放弃并关闭连接
+    Timeout     time.Duration // 每次重启等待连接恢复的时间
+}
+
+func newICERestartPolicy(option *Option) ICERestartPolicy {
+    policy := ICERestartPolicy{
+        MaxAttempts: option.ICERestartAttempts,
+        Timeout:     time.Duration(option.ICERestartTimeoutSec) * time.Second,
+    }
+    if policy.MaxAttempts == 0 {
+        policy.MaxAttempts = defaultICERestartAttempts
+    }
+    if policy.Timeout <= 0 {
+        policy.Timeout = defaultICERestartTimeout
+    }
+    return policy
+}
+
+// startICERestart 开始 ICE 重启, 已经在重启中时忽略
+// 只由 Offer 端发起, 避免两端同时发送 offer; Answer 端按正常流程回复新的 answer, 等待时间用完后同样放弃
+func (s *Session) startICERestart() {
+    policy := s.client.iceRestartPolicy
+    if policy.MaxAttempts < 0 {
+        return
+    }
+    if !s.iceRestarting.CompareAndSwap(false, true) {
+        return
+    }
+    go func() {
+        defer s.iceRestarting.Store(false)
+        if s.restartICE(policy) {
+            return
+        }
+        log.Printf("ICE restart failed after %d attempts, give up session %s\n", policy.MaxAttempts, s.id)
+        s.closeWithError(ErrICERestartFailed)
+    }()
+}
+
+// restartICE 按重试策略重启 ICE, 连接恢复或会话关闭返回 true
+func (s *Session) restartICE(policy ICERestartPolicy) bool {
+    for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+        // 清除上一次重启期间的连接通知
+        select {
+        case <-s.iceConnected:
+        default:
+        }
+        if s.peerConn.ConnectionState() == webrtc.PeerConnectionStateConnected {
+            return true
+        }
+
+        if s.offerer {
+            log.Printf("ICE restart, session=%s, attempt=%d\n", s.id, attempt)
+            // 使用最新的 TURN 认证信息, 会话建立后认证信息可能已经刷新
+            s.updateICEServers()
+            // 生成新的 ICE 凭证重新协商, 通过信令服务器转发给对端
+            if err := s.offer(&webrtc.OfferOptions{ICERestart: true}); err != nil {
+                log.Printf("send ICE restart offer failed: %v\n", err)
+            }
+        }
+        timer := time.NewTimer(policy.Timeout)
+        select {
+        case <-s.closeChan:
+            timer.Stop()
+            return true
+        case <-s.iceConnected:
+            timer.Stop()
+            log.Printf("ICE restart succeeded, session=%s, attempt=%d\n", s.id, attempt)
+            return true
+        case <-timer.C:
+        }
+    }
+    return false
+}
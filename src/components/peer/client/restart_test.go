@@ -0,0 +1,60 @@
+package client
+
+import (
+    "github.com/pion/webrtc/v4"
+    "testing"
+    "time"
+)
+
+func TestNewICERestartPolicy(t *testing.T) {
+    policy := newICERestartPolicy(&Option{})
+    if policy.MaxAttempts != defaultICERestartAttempts || policy.Timeout != defaultICERestartTimeout {
+        t.Fatalf("unexpected default policy: %+v", policy)
+    }
+    policy = newICERestartPolicy(&Option{ICERestartAttempts: -1, ICERestartTimeoutSec: 3})
+    if policy.MaxAttempts != -1 || policy.Timeout != 3*time.Second {
+        t.Fatalf("unexpected policy: %+v", policy)
+    }
+}
+
+func TestICERestartGiveUp(t *testing.T) {
+    addr, shutdown := serveAt(t, "127.0.0.1:0")
+    defer shutdown()
+
+    c := NewClient(&Option{
+        SignalServerAddr: addr,
+        SignalServerPath: "/signal",
+        PeerType:         PeerTypeOffer,
+        Cid:              "restart-peer",
+        AuthCode:         "666999",
+    })
+    c.iceRestartPolicy = ICERestartPolicy{MaxAttempts: 2, Timeout: 100 * time.Millisecond}
+    if err := c.connectSignalServer(); err != nil {
+        t.Fatal(err)
+    }
+    defer c.Close()
+
+    session, err := c.newSession("offline-peer", "123456", newSessionId(), true, c.webrtcConfiguration())
+    if err != nil {
+        t.Fatal(err)
+    }
+    c.addSession(session)
+
+    // 对端不在线, 重启 offer 无法送达, 重试策略用完后放弃并关闭会话, 不影响 Client
+    session.onConnectionStateChange(webrtc.PeerConnectionStateFailed)
+    session.onConnectionStateChange(webrtc.PeerConnectionStateDisconnected)
+    select {
+    case <-session.Done():
+    case <-time.After(5 * time.Second):
+        t.Fatal("session should give up after ICE restart attempts exhausted")
+    }
+    if err := session.Err(); err != ErrICERestartFailed {
+        t.Fatalf("unexpected close error: %v", err)
+    }
+    if len(c.Sessions()) != 0 {
+        t.Fatal("closed session should be removed")
+    }
+    if state := c.SignalState(); state != SignalStateConnected {
+        t.Fatalf("unexpected signal state: %s", state)
+    }
+}
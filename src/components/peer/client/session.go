@@ -0,0 +1,436 @@
+package client
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "github.com/pion/webrtc/v4"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "log"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const defaultGatherTimeout = 10 * time.Second // vanilla ICE 等待候选地址收集完成的最长时间
+
+// sessionKey 会话由对端 cid 和会话ID唯一确定
+type sessionKey struct {
+    cid string
+    id  string
+}
+
+// Session 与一个对端 Peer 的 P2P 会话, 每个会话有独立的 PeerConnection、DataChannel、候选地址缓存和生命周期
+// 同一个 Client 可以同时与多个 Peer(或同一个 Peer)建立多个会话
+type Session struct {
+    client         *Client
+    id             string                 // 会话ID, 由 Offer 端生成
+    remoteCid      string                 // 对端设备ID
+    remoteAuthCode string                 // 对端设备认证码, 仅 Offer 端使用
+    offerer        bool                   // 本端是否为 Offer 端
+    peerConn       *webrtc.PeerConnection // 与对端的 PeerConnection
+    configMux      sync.Mutex             // pion 读写 PeerConnection 配置不加锁, 更新 ICE 服务器时串行化
+    dataChannel    *webrtc.DataChannel    // 与对端Peer的数据通道, Answer 端在对端创建后才有, 通过 getDataChannel 读取
+    dataChannelMux sync.Mutex
+    candidates     candidateQueue // 双向候选地址队列
+    writable       chan struct{}  // DataChannel 写就绪后关闭
+    writableOnce   sync.Once
+    handlers       eventHandlers // P2P 连接和 DataChannel 状态回调
+    events         eventQueue    // 按顺序执行状态回调
+    files          fileTransfers // 通过 DataChannel 发送和接收的文件
+    iceRestarting  atomic.Bool   // 是否正在 ICE 重启
+    iceConnected   chan struct{} // P2P 连接(恢复)建立通知
+    closeChan      chan struct{} // 会话关闭后关闭
+    closeOnce      sync.Once
+    closeErr       error // 会话关闭原因, 主动关闭为 nil
+}
+
+func newSessionId() string {
+    b := make([]byte, 8)
+    _, _ = rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+func (c *Client) newSession(remoteCid, remoteAuthCode, id string, offerer bool, config webrtc.Configuration) (*Session, error) {
+    peerConn, err := c.newPeerConnection(config)
+    if err != nil {
+        return nil, err
+    }
+    s := &Session{
+        client:         c,
+        id:             id,
+        remoteCid:      remoteCid,
+        remoteAuthCode: remoteAuthCode,
+        offerer:        offerer,
+        peerConn:       peerConn,
+        writable:       make(chan struct{}),
+        iceConnected:   make(chan struct{}, 1),
+        closeChan:      make(chan struct{}),
+        files:          newFileTransfers(),
+    }
+    // 设置处理ICE返回候选地址事件
+    peerConn.OnICECandidate(s.onICECandidate)
+    // 设置处理ICE连接状态变化事件
+    peerConn.OnConnectionStateChange(s.onConnectionStateChange)
+    if offerer {
+        // 发起创建连接到对端（Peer）的数据通道
+        dataChannel, err := peerConn.CreateDataChannel("data", nil)
+        if err != nil {
+            _ = peerConn.Close()
+            return nil, err
+        }
+        s.onDataChannel(dataChannel)
+    } else {
+        // 设置成功建立 DataChannel 的监听
+        peerConn.OnDataChannel(s.onDataChannel)
+    }
+    return s, nil
+}
+
+// ID 会话ID
+func (s *Session) ID() string {
+    return s.id
+}
+
+// RemoteCid 对端设备ID
+func (s *Session) RemoteCid() string {
+    return s.remoteCid
+}
+
+// Done 会话关闭后关闭
+func (s *Session) Done() <-chan struct{} {
+    return s.closeChan
+}
+
+// Err 会话关闭原因, 会话未关闭或主动关闭时为 nil
+func (s *Session) Err() error {
+    select {
+    case <-s.closeChan:
+        return s.closeErr
+    default:
+        return nil
+    }
+}
+
+// Close 关闭会话, 不影响同一个 Client 的其他会话
+func (s *Session) Close() {
+    s.closeWithError(nil)
+}
+
+func (s *Session) closeWithError(err error) {
+    s.closeOnce.Do(func() {
+        s.closeErr = err
+        s.stopCandidates()
+        if err := s.peerConn.Close(); err != nil {
+            log.Printf("close peerConnection error: %v\n", err)
+        }
+        s.closeFileTransfers()
+        s.client.removeSession(s)
+        close(s.closeChan)
+        log.Printf("session %s with %s closed\n", s.id, s.remoteCid)
+    })
+}
+
+// offer 创建 offer 并经过信令服务器转发给对端, 等待信令服务器确认已转发
+func (s *Session) offer(options *webrtc.OfferOptions) error {
+    offerSdp, err := s.createOffer(options)
+    if err != nil {
+        return err
+    }
+    return s.client.Call(&offerSdp, nil, s.client.requestTimeout)
+}
+
+// createOffer 创建 offer 并设置为本端描述信息, vanilla ICE 模式下等待候选地址收集完成, offer 包含全部候选地址
+func (s *Session) createOffer(options *webrtc.OfferOptions) (message.SdpRequest, error) {
+    offerSd, err := s.peerConn.CreateOffer(options)
+    if err != nil {
+        return message.SdpRequest{}, err
+    }
+    // 设置本端描述信息
+    vanilla := s.client.vanillaICE
+    gatherComplete, err := s.setLocalDescription(offerSd, vanilla)
+    if err != nil {
+        return message.SdpRequest{}, err
+    }
+    if vanilla {
+        sd, err := s.waitGatherComplete(gatherComplete)
+        if err != nil {
+            return message.SdpRequest{}, err
+        }
+        offerSd = *sd
+    }
+    offerSdp := message.NewSdpRequest(offerSd, s.client.cid, s.remoteCid, s.remoteAuthCode)
+    offerSdp.SessionId = s.id
+    offerSdp.NoTrickle = vanilla
+    return offerSdp, nil
+}
+
+// handleSdp 处理对端经过信令服务器中转的 SDP 消息
+func (s *Session) handleSdp(sdpMessage message.SdpRequest) {
+    // 本地 peerConnection 记录远端的描述信息, 并添加之前暂存的对端候选地址
+    if err := s.setRemoteDescription(sdpMessage.Sd); err != nil {
+        log.Printf("SetRemoteDescription failed: %v", err)
+        return
+    }
+    if sdpMessage.Sd.Type == webrtc.SDPTypeOffer {
+        // 1 作为 Answer 端还需要创建 answer sdp 并经过信令服务器转发给 offer端
+        answer, err := s.peerConn.CreateAnswer(nil)
+        if err != nil {
+            log.Printf("CreateAnswer failed: %v", err)
+            return
+        }
+        // 本端使用 vanilla ICE 或对端不接收单独的候选地址时, 回复包含全部候选地址的 answer
+        vanilla := s.client.vanillaICE || sdpMessage.NoTrickle
+        gatherComplete, err := s.setLocalDescription(answer, vanilla)
+        if err != nil {
+            log.Printf("SetLocalDescription failed: %v", err)
+            return
+        }
+        if vanilla {
+            // 等待收集完成可能需要数秒, 不阻塞信令消息的处理
+            go func() {
+                sd, err := s.waitGatherComplete(gatherComplete)
+                if err != nil {
+                    log.Printf("wait ICE gathering failed, session=%s, err: %v\n", s.id, err)
+                    return
+                }
+                s.sendAnswer(*sd, true)
+            }()
+            return
+        }
+        s.sendAnswer(answer, false)
+    }
+    // 2 通过信令服务器向对端发送收到 SDP 前暂存的 ICE Candidate 信息
+    s.flushCandidates()
+}
+
+func (s *Session) sendAnswer(answer webrtc.SessionDescription, vanilla bool) {
+    answerSdp := message.NewSdpRequest(answer, s.client.cid, s.remoteCid, "")
+    answerSdp.SessionId = s.id
+    answerSdp.NoTrickle = vanilla
+    if err := s.client.sendOrQueue(answerSdp); err != nil {
+        log.Printf("send answer to %s failed, err: %v\n", s.remoteCid, err)
+    }
+}
+
+// setLocalDescription 设置本端描述信息, vanilla 为 true 时本轮候选地址不再单独发送, 返回收集完成通知
+func (s *Session) setLocalDescription(sd webrtc.SessionDescription, vanilla bool) (<-chan struct{}, error) {
+    s.candidates.mu.Lock()
+    s.candidates.complete = vanilla
+    s.candidates.mu.Unlock()
+    var gatherComplete <-chan struct{}
+    if vanilla {
+        gatherComplete = webrtc.GatheringCompletePromise(s.peerConn)
+    }
+    if err := s.peerConn.SetLocalDescription(sd); err != nil {
+        return nil, err
+    }
+    return gatherComplete, nil
+}
+
+// waitGatherComplete 等待候选地址收集完成, 返回包含全部候选地址的本端描述信息, 超时后使用已收集到的候选地址
+func (s *Session) waitGatherComplete(gatherComplete <-chan struct{}) (*webrtc.SessionDescription, error) {
+    timer := time.NewTimer(defaultGatherTimeout)
+    defer timer.Stop()
+    select {
+    case <-gatherComplete:
+    case <-timer.C:
+        log.Printf("ICE gathering timeout, send collected candidates, session=%s\n", s.id)
+    case <-s.closeChan:
+        return nil, ErrSessionClosed
+    }
+    return s.peerConn.LocalDescription(), nil
+}
+
+func (s *Session) onConnectionStateChange(state webrtc.PeerConnectionState) {
+    log.Printf("Peer Connection State has changed: %s, session=%s\n", state.String(), s.id)
+    s.emitPeerConnectionState(state)
+
+    switch state {
+    case webrtc.PeerConnectionStateConnected:
+        select {
+        case s.iceConnected <- struct{}{}:
+        default:
+        }
+    case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
+        // 网络切换等导致连接中断, 通过 ICE 重启重新收集候选地址恢复连接, 重试策略用完后才放弃
+        s.startICERestart()
+    case webrtc.PeerConnectionStateClosed:
+        // PeerConnection was explicitly closed. This usually happens from a DTLS CloseNotify
+        s.Close()
+    }
+}
+
+func (s *Session) onDataChannel(dataChannel *webrtc.DataChannel) {
+    log.Printf("New DataChannel establisted, label=%s, id=%d\n", dataChannel.Label(), dataChannel.ID())
+    s.dataChannelMux.Lock()
+    s.dataChannel = dataChannel
+    s.dataChannelMux.Unlock()
+
+    dataChannel.OnOpen(s.onOpen)
+    dataChannel.OnClose(s.onDataChannelClose)
+    dataChannel.OnMessage(s.onMessage)
+    // 文件传输的流量控制
+    dataChannel.SetBufferedAmountLowThreshold(fileBufferLowThreshold)
+    dataChannel.OnBufferedAmountLow(s.onBufferedAmountLow)
+}
+
+func (s *Session) getDataChannel() *webrtc.DataChannel {
+    s.dataChannelMux.Lock()
+    defer s.dataChannelMux.Unlock()
+    return s.dataChannel
+}
+
+// writableDataChannel 返回可写的 DataChannel, 会话已关闭返回 ErrSessionClosed, DataChannel 未打开返回 ErrNotWritable
+func (s *Session) writableDataChannel() (*webrtc.DataChannel, error) {
+    select {
+    case <-s.closeChan:
+        return nil, ErrSessionClosed
+    default:
+    }
+    select {
+    case <-s.writable:
+        return s.getDataChannel(), nil
+    default:
+        return nil, ErrNotWritable
+    }
+}
+
+func (s *Session) onOpen() {
+    dataChannel := s.getDataChannel()
+    log.Printf("DataChannel '%s'-'%d' open\n", dataChannel.Label(), dataChannel.ID())
+    // 写就绪
+    s.writableOnce.Do(func() {
+        close(s.writable)
+    })
+    s.emitDataChannelState(webrtc.DataChannelStateOpen)
+}
+
+func (s *Session) onDataChannelClose() {
+    log.Printf("DataChannel '%s' closed\n", s.getDataChannel().Label())
+    s.emitDataChannelState(webrtc.DataChannelStateClosed)
+}
+
+// WaitWritable 等待 DataChannel 可写, ctx 结束返回 ctx.Err(), 会话关闭返回 ErrSessionClosed
+func (s *Session) WaitWritable(ctx context.Context) error {
+    select {
+    case <-s.writable:
+        log.Println("DataChannel now is writable -> ")
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    case <-s.closeChan:
+        return ErrSessionClosed
+    }
+}
+
+// WriteText 发送文本消息, DataChannel 未打开返回 ErrNotWritable, 可先调用 WaitWritable 等待
+func (s *Session) WriteText(text string) error {
+    dataChannel, err := s.writableDataChannel()
+    if err != nil {
+        return err
+    }
+    return dataChannel.SendText(text)
+}
+
+// onMessage 二进制消息为文件传输帧, 文本消息交给消息回调
+func (s *Session) onMessage(msg webrtc.DataChannelMessage) {
+    if !msg.IsString {
+        s.handleFileFrame(msg.Data)
+        return
+    }
+    log.Printf("MMeta from DataChannel '%s': '%s'\n", s.getDataChannel().Label(), string(msg.Data))
+    s.emitDataChannelMessage(msg)
+}
+
+// Dial 向 toCid 发起新的会话, 对端不在线返回 ErrPeerOffline
+func (c *Client) Dial(toCid, toAuthCode string) (*Session, error) {
+    // 对端不在线时不发起连接
+    presence, err := c.QueryPresence(toCid)
+    if err != nil {
+        return nil, err
+    }
+    if !presence.Online {
+        return nil, ErrPeerOffline
+    }
+
+    s, err := c.newSession(toCid, toAuthCode, newSessionId(), true, c.dialConfiguration(toCid))
+    if err != nil {
+        return nil, err
+    }
+    c.addSession(s)
+    if err := s.offer(nil); err != nil {
+        s.closeWithError(err)
+        return nil, err
+    }
+    log.Printf("offer delivered to %s, session=%s\n", toCid, s.id)
+    return s, nil
+}
+
+// OnSession 设置新会话回调, 本端发起和对端发起的会话都会通知
+// 回调在会话开始协商前同步执行, 可以在回调中设置会话的事件回调, 不能阻塞
+func (c *Client) OnSession(f func(s *Session)) {
+    c.sessionsMux.Lock()
+    defer c.sessionsMux.Unlock()
+    c.onSessionHandler = f
+}
+
+// Sessions 返回当前所有会话
+func (c *Client) Sessions() []*Session {
+    c.sessionsMux.Lock()
+    defer c.sessionsMux.Unlock()
+    sessions := make([]*Session, 0, len(c.sessions))
+    for _, s := range c.sessions {
+        sessions = append(sessions, s)
+    }
+    return sessions
+}
+
+func (c *Client) addSession(s *Session) {
+    c.sessionsMux.Lock()
+    c.sessions[sessionKey{s.remoteCid, s.id}] = s
+    handler := c.onSessionHandler
+    c.sessionsMux.Unlock()
+    if handler != nil {
+        handler(s)
+    }
+}
+
+func (c *Client) removeSession(s *Session) {
+    c.sessionsMux.Lock()
+    defer c.sessionsMux.Unlock()
+    key := sessionKey{s.remoteCid, s.id}
+    if c.sessions[key] == s {
+        delete(c.sessions, key)
+    }
+}
+
+func (c *Client) getSession(cid, id string) *Session {
+    c.sessionsMux.Lock()
+    defer c.sessionsMux.Unlock()
+    return c.sessions[sessionKey{cid, id}]
+}
+
+// handleSdp 将 SDP 交给对应的会话处理, 对端发起的新会话收到 offer 时创建
+func (c *Client) handleSdp(sdpMessage message.SdpRequest) {
+    s := c.getSession(sdpMessage.From, sdpMessage.SessionId)
+    if s == nil {
+        if sdpMessage.Sd.Type != webrtc.SDPTypeOffer {
+            log.Printf("no session for sdp from %s, session=%s\n", sdpMessage.From, sdpMessage.SessionId)
+            return
+        }
+        var err error
+        s, err = c.newSession(sdpMessage.From, "", sdpMessage.SessionId, false, c.webrtcConfiguration())
+        if err != nil {
+            log.Printf("create session for %s failed: %v\n", sdpMessage.From, err)
+            return
+        }
+        c.addSession(s)
+        log.Printf("new session from %s, session=%s\n", sdpMessage.From, s.id)
+        // 先于 offer 到达的候选地址暂存到会话中, 设置对端描述信息后添加
+        for _, candidateMessage := range c.takeEarlyCandidates(sessionKey{s.remoteCid, s.id}) {
+            s.handleCandidate(candidateMessage)
+        }
+    }
+    s.handleSdp(sdpMessage)
+}
@@ -0,0 +1,197 @@
+package client
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "github.com/gorilla/websocket"
+    "github.com/pion/webrtc/v4"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "net/url"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestMultipleSessions(t *testing.T) {
+    addr, shutdown := serveAt(t, "127.0.0.1:0")
+    defer shutdown()
+
+    newConnectedClient := func(cid, authCode string) *Client {
+        c := NewClient(&Option{SignalServerAddr: addr, SignalServerPath: "/signal", Cid: cid, AuthCode: authCode})
+        if err := c.connectSignalServer(); err != nil {
+            t.Fatal(err)
+        }
+        t.Cleanup(c.Close)
+        return c
+    }
+    answer := newConnectedClient("answer-peer", "123456")
+    accepted := make(chan *Session, 3)
+    answer.OnSession(func(s *Session) {
+        accepted <- s
+    })
+
+    // 同一个 Peer 发起两个会话, 另一个 Peer 发起一个会话
+    offerA := newConnectedClient("offer-a", "")
+    offerB := newConnectedClient("offer-b", "")
+    var offered []*Session
+    for _, c := range []*Client{offerA, offerA, offerB} {
+        s, err := c.Dial("answer-peer", "123456")
+        if err != nil {
+            t.Fatal(err)
+        }
+        offered = append(offered, s)
+    }
+    if offered[0].ID() == offered[1].ID() {
+        t.Fatal("sessions should have different ids")
+    }
+
+    ids := make(map[string]string)
+    for i := 0; i < 3; i++ {
+        select {
+        case s := <-accepted:
+            ids[s.ID()] = s.RemoteCid()
+        case <-time.After(5 * time.Second):
+            t.Fatal("wait incoming session timeout")
+        }
+    }
+    for _, s := range offered {
+        if ids[s.ID()] != s.client.cid {
+            t.Fatalf("session %s from %s not accepted", s.ID(), s.client.cid)
+        }
+    }
+
+    // 每个会话分别完成 SDP 协商
+    deadline := time.Now().Add(5 * time.Second)
+    for _, s := range offered {
+        for s.peerConn.RemoteDescription() == nil {
+            if time.Now().After(deadline) {
+                t.Fatalf("session %s did not receive answer", s.ID())
+            }
+            time.Sleep(10 * time.Millisecond)
+        }
+    }
+
+    // 关闭一个会话不影响其他会话
+    offered[0].Close()
+    if n := len(offerA.Sessions()); n != 1 {
+        t.Fatalf("unexpected sessions of offer-a: %d", n)
+    }
+}
+
+func TestCandidateBatching(t *testing.T) {
+    addr, shutdown := serveAt(t, "127.0.0.1:0")
+    defer shutdown()
+
+    // 对端使用原始 WebSocket 连接, 观察收到的候选地址消息
+    u := url.URL{Scheme: "ws", Host: addr, Path: "/signal"}
+    remote, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer remote.Close()
+    if err := remote.WriteJSON(message.NewRegisterRequest("remote-peer", "123456")); err != nil {
+        t.Fatal(err)
+    }
+    readMessage := func(v interface{}) message.MMeta {
+        _ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+        _, msg, err := remote.ReadMessage()
+        if err != nil {
+            t.Fatal(err)
+        }
+        m := message.MMeta{}
+        if err := json.Unmarshal(msg, &m); err != nil {
+            t.Fatal(err)
+        }
+        if v != nil {
+            if err := json.Unmarshal(msg, v); err != nil {
+                t.Fatal(err)
+            }
+        }
+        return m
+    }
+    if m := readMessage(nil); m.Type != message.TypeRegisterResponse {
+        t.Fatalf("unexpected message type: %d", m.Type)
+    }
+
+    c := NewClient(&Option{SignalServerAddr: addr, SignalServerPath: "/signal", Cid: "local-peer"})
+    if err := c.connectSignalServer(); err != nil {
+        t.Fatal(err)
+    }
+    defer c.Close()
+    session, err := c.Dial("remote-peer", "123456")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // 回复 answer 后本端才会发送候选地址
+    offer := message.SdpRequest{}
+    if m := readMessage(&offer); m.Type != message.TypeSdpRequest {
+        t.Fatalf("unexpected message type: %d", m.Type)
+    }
+    peerConn, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer peerConn.Close()
+    if err := peerConn.SetRemoteDescription(offer.Sd); err != nil {
+        t.Fatal(err)
+    }
+    answer, err := peerConn.CreateAnswer(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := peerConn.SetLocalDescription(answer); err != nil {
+        t.Fatal(err)
+    }
+    answerSdp := message.NewSdpRequest(answer, "remote-peer", "local-peer", "")
+    answerSdp.SessionId = offer.SessionId
+    if err := remote.WriteJSON(answerSdp); err != nil {
+        t.Fatal(err)
+    }
+
+    // 候选地址批量到达, 最后一批带 end-of-candidates
+    offerUfrag := iceUfrag(offer.Sd.SDP)
+    for {
+        candidateRequest := message.CandidateRequest{}
+        m := readMessage(&candidateRequest)
+        if m.Type != message.TypeCandidateRequest {
+            continue
+        }
+        if candidateRequest.SessionId != session.ID() {
+            t.Fatalf("unexpected session id: %s", candidateRequest.SessionId)
+        }
+        for _, candidate := range candidateRequest.Candidates {
+            if candidate.SDPMid == nil || candidate.UsernameFragment == nil || *candidate.UsernameFragment != offerUfrag {
+                t.Fatalf("candidate without sdpMid or ufrag: %+v", candidate)
+            }
+        }
+        if candidateRequest.EndOfCandidates {
+            break
+        }
+    }
+}
+
+// Answer 端收到对端的 DataChannel 之前和会话关闭之后不能写
+func TestWriteTextNotWritable(t *testing.T) {
+    c := NewClient(&Option{Cid: "local-peer"})
+    defer c.Close()
+    s, err := c.newSession("remote-peer", "", newSessionId(), false, c.webrtcConfiguration())
+    if err != nil {
+        t.Fatal(err)
+    }
+    c.addSession(s)
+
+    if err := s.WriteText("hello"); !errors.Is(err, ErrNotWritable) {
+        t.Fatalf("expected not writable, got: %v", err)
+    }
+    s.Close()
+    if err := s.WriteText("hello"); !errors.Is(err, ErrSessionClosed) {
+        t.Fatalf("expected session closed, got: %v", err)
+    }
+    dir := t.TempDir()
+    writeRandomFile(t, dir, "data.bin", 1024)
+    if err := s.SendFile(context.Background(), filepath.Join(dir, "data.bin")); !errors.Is(err, ErrSessionClosed) {
+        t.Fatalf("expected session closed, got: %v", err)
+    }
+}
@@ -0,0 +1,222 @@
+package client
+
+import (
+    "github.com/gorilla/websocket"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "log"
+    "math/rand"
+    "net/url"
+    "time"
+)
+
+const (
+    minReconnectInterval     = 500 * time.Millisecond // 首次重连等待时间, 之后每次翻倍
+    defaultReconnectInterval = 30 * time.Second       // 默认最大重连等待时间
+    maxUnsentMessages        = 256                    // 断线期间最多缓存的待发送消息数
+)
+
+// SignalState 与信令服务器的连接状态
+type SignalState int
+
+const (
+    SignalStateNew SignalState = iota
+    SignalStateConnecting
+    SignalStateConnected
+    SignalStateReconnecting
+    SignalStateClosed
+)
+
+func (s SignalState) String() string {
+    switch s {
+    case SignalStateNew:
+        return "new"
+    case SignalStateConnecting:
+        return "connecting"
+    case SignalStateConnected:
+        return "connected"
+    case SignalStateReconnecting:
+        return "reconnecting"
+    case SignalStateClosed:
+        return "closed"
+    default:
+        return "unknown"
+    }
+}
+
+// SignalState 返回与信令服务器的连接状态
+func (c *Client) SignalState() SignalState {
+    c.stateMux.Lock()
+    defer c.stateMux.Unlock()
+    return c.signalState
+}
+
+// OnSignalStateChange 设置与信令服务器连接状态变化的回调
+func (c *Client) OnSignalStateChange(f func(state SignalState)) {
+    c.stateMux.Lock()
+    defer c.stateMux.Unlock()
+    c.onSignalStateHandler = f
+}
+
+// setSignalState 更新连接状态, 关闭后不再变化
+func (c *Client) setSignalState(state SignalState) {
+    c.stateMux.Lock()
+    if c.signalState == state || c.signalState == SignalStateClosed {
+        c.stateMux.Unlock()
+        return
+    }
+    c.signalState = state
+    // 持有 stateMux 时加入队列, 回调顺序和状态变化顺序一致
+    if handler := c.onSignalStateHandler; handler != nil {
+        c.signalEvents.push(func() {
+            handler(state)
+        })
+    }
+    c.stateMux.Unlock()
+
+    log.Printf("Signal State has changed: %s\n", state)
+}
+
+func (c *Client) dial() (*websocket.Conn, error) {
+    u := url.URL{Scheme: "ws", Host: c.signalServerConfig.SignalServerAddr, Path: c.signalServerConfig.SignalServerPath}
+    dialer := *websocket.DefaultDialer
+    if c.signalServerConfig.TLSConfig != nil {
+        u.Scheme = "wss"
+        dialer.TLSClientConfig = c.signalServerConfig.TLSConfig
+    }
+    log.Printf("connecting to signal server %s", u.String())
+    conn, _, err := dialer.Dial(u.String(), nil)
+    return conn, err
+}
+
+// connect 连接信令服务器并注册, 成功后发送断线期间缓存的消息
+func (c *Client) connect() error {
+    if c.SignalState() == SignalStateNew {
+        c.setSignalState(SignalStateConnecting)
+    }
+    conn, err := c.dial()
+    if err != nil {
+        return err
+    }
+    c.writeMux.Lock()
+    c.signalConn = conn
+    c.writeMux.Unlock()
+    go c.readLoop(conn)
+
+    // 上报本端信息到信令服务器, 需在开始监听信令服务器消息后发送才能收到响应
+    registerRequest := c.newRegisterRequest()
+    registerResponse := message.RegisterResponse{}
+    if err := c.Call(&registerRequest, &registerResponse, c.requestTimeout); err != nil {
+        _ = conn.Close()
+        return err
+    }
+    log.Printf("register peer info to signal server, cid=%s", c.cid)
+    // 信令服务器下发的 TURN 临时认证信息, 之后创建的 PeerConnection 使用
+    if len(registerResponse.ICEServers) > 0 {
+        log.Printf("signal server issued %d ice servers\n", len(registerResponse.ICEServers))
+    }
+    c.setIssuedICEServers(registerResponse.ICEServers, registerResponse.ICEServersTTL)
+
+    c.queueMux.Lock()
+    defer c.queueMux.Unlock()
+    c.setSignalState(SignalStateConnected)
+    c.flushUnsent()
+    return nil
+}
+
+// readLoop 监听信令服务器返回的消息, 已注册的连接断开后自动重连
+func (c *Client) readLoop(conn *websocket.Conn) {
+    for {
+        _, msg, err := conn.ReadMessage()
+        if err != nil {
+            log.Printf("read message from signal server failed: %v", err)
+            break
+        }
+        c.handleSignalMessage(msg)
+    }
+
+    c.stateMux.Lock()
+    c.writeMux.Lock()
+    lost := c.signalState == SignalStateConnected && c.signalConn == conn
+    c.writeMux.Unlock()
+    c.stateMux.Unlock()
+    if lost {
+        c.setSignalState(SignalStateReconnecting)
+        go c.reconnect()
+    }
+}
+
+// reconnect 按指数退避加随机抖动重连信令服务器, 直到成功或 Client 关闭
+func (c *Client) reconnect() {
+    interval := minReconnectInterval
+    for attempt := 1; ; attempt++ {
+        delay := interval/2 + time.Duration(rand.Int63n(int64(interval/2)+1))
+        log.Printf("reconnect to signal server in %v, attempt=%d", delay, attempt)
+        timer := time.NewTimer(delay)
+        select {
+        case <-c.closeChan:
+            timer.Stop()
+            return
+        case <-timer.C:
+        }
+
+        if err := c.connect(); err != nil {
+            log.Printf("reconnect to signal server failed: %v", err)
+            interval *= 2
+            if interval > c.reconnectMaxInterval {
+                interval = c.reconnectMaxInterval
+            }
+            continue
+        }
+        c.resubscribe()
+        return
+    }
+}
+
+// resubscribe 重连后恢复在线状态订阅, 并通知断线期间可能发生的变化
+func (c *Client) resubscribe() {
+    c.presenceMux.Lock()
+    cids := make([]string, 0, len(c.watching))
+    for cid := range c.watching {
+        cids = append(cids, cid)
+    }
+    c.presenceMux.Unlock()
+
+    for _, cid := range cids {
+        presence, err := c.subscribe(cid, false)
+        if err != nil {
+            log.Printf("resubscribe presence of %s failed: %v", cid, err)
+            continue
+        }
+        c.onPresence(*presence)
+    }
+}
+
+// sendOrQueue 发送消息给信令服务器, 未连接或发送失败时缓存, 重连后按顺序重新发送
+func (c *Client) sendOrQueue(v interface{}) error {
+    c.queueMux.Lock()
+    defer c.queueMux.Unlock()
+    if c.SignalState() == SignalStateConnected && len(c.unsent) == 0 {
+        err := c.writeJSON(v)
+        if err == nil {
+            return nil
+        }
+        log.Printf("send message to signal server failed, queued for retry: %v", err)
+    }
+    if len(c.unsent) >= maxUnsentMessages {
+        log.Printf("too many unsent messages, drop the oldest one")
+        c.unsent = c.unsent[1:]
+    }
+    c.unsent = append(c.unsent, v)
+    return nil
+}
+
+// flushUnsent 按顺序发送缓存的消息, 需持有 c.queueMux
+func (c *Client) flushUnsent() {
+    for len(c.unsent) > 0 {
+        if err := c.writeJSON(c.unsent[0]); err != nil {
+            log.Printf("resend message to signal server failed: %v", err)
+            return
+        }
+        c.unsent = c.unsent[1:]
+    }
+}
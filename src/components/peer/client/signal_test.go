@@ -0,0 +1,101 @@
+package client
+
+import (
+    "context"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "kwseeker.top/kwseeker/p2p/src/components/signal/server"
+    "net"
+    "testing"
+    "time"
+)
+
+// serveAt 在指定地址启动信令服务器, 返回关闭函数
+func serveAt(t *testing.T, addr string) (string, func()) {
+    return serveWith(t, addr, server.Options{})
+}
+
+// serveWith 使用指定配置在 addr 启动信令服务器
+func serveWith(t *testing.T, addr string, options server.Options) (string, func()) {
+    l, err := net.Listen("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv := server.NewServer(options)
+    go func() {
+        _ = srv.Serve(l)
+    }()
+    return l.Addr().String(), func() {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        defer cancel()
+        _ = srv.Shutdown(ctx)
+    }
+}
+
+func waitSignalState(t *testing.T, states chan SignalState, want SignalState) {
+    timeout := time.After(10 * time.Second)
+    for {
+        select {
+        case state := <-states:
+            if state == want {
+                return
+            }
+        case <-timeout:
+            t.Fatalf("wait signal state %s timeout", want)
+        }
+    }
+}
+
+func TestReconnect(t *testing.T) {
+    addr, shutdown := serveAt(t, "127.0.0.1:0")
+
+    c := NewClient(&Option{
+        SignalServerAddr: addr,
+        SignalServerPath: "/signal",
+        Cid:              "reconnect-peer",
+        AuthCode:         "123456",
+        ReconnectMaxSec:  1,
+    })
+    states := make(chan SignalState, 16)
+    c.OnSignalStateChange(func(state SignalState) {
+        states <- state
+    })
+    if err := c.connectSignalServer(); err != nil {
+        t.Fatal(err)
+    }
+    defer c.Close()
+    if state := c.SignalState(); state != SignalStateConnected {
+        t.Fatalf("unexpected signal state: %s", state)
+    }
+
+    // 信令服务器重启, 断线期间的消息暂存
+    shutdown()
+    waitSignalState(t, states, SignalStateReconnecting)
+    if err := c.sendOrQueue(message.NewCandidateRequest(nil, true, c.cid, "other-peer")); err != nil {
+        t.Fatal(err)
+    }
+    c.queueMux.Lock()
+    unsent := len(c.unsent)
+    c.queueMux.Unlock()
+    if unsent != 1 {
+        t.Fatalf("candidate should be queued, unsent=%d", unsent)
+    }
+
+    _, shutdown = serveAt(t, addr)
+    defer shutdown()
+    waitSignalState(t, states, SignalStateConnected)
+
+    // 重连后重新注册并发送暂存的消息
+    presence, err := c.QueryPresence("reconnect-peer")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !presence.Online {
+        t.Fatal("reconnect-peer should be registered again")
+    }
+    c.queueMux.Lock()
+    unsent = len(c.unsent)
+    c.queueMux.Unlock()
+    if unsent != 0 {
+        t.Fatalf("queued messages should be replayed, unsent=%d", unsent)
+    }
+}
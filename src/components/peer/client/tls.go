@@ -0,0 +1,33 @@
+package client
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "os"
+)
+
+// NewTLSConfig 创建连接信令服务器的 TLS 配置
+// caFile 为空时使用系统 CA; certFile 和 keyFile 不为空时提供客户端证书, 用于双向认证
+func NewTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+    tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+    if caFile != "" {
+        pem, err := os.ReadFile(caFile)
+        if err != nil {
+            return nil, err
+        }
+        rootCAs := x509.NewCertPool()
+        if !rootCAs.AppendCertsFromPEM(pem) {
+            return nil, errors.New("no certificate found in " + caFile)
+        }
+        tlsConfig.RootCAs = rootCAs
+    }
+    if certFile != "" && keyFile != "" {
+        cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+        if err != nil {
+            return nil, err
+        }
+        tlsConfig.Certificates = []tls.Certificate{cert}
+    }
+    return tlsConfig, nil
+}
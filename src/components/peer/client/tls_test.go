@@ -0,0 +1,47 @@
+package client
+
+import (
+    "encoding/pem"
+    "kwseeker.top/kwseeker/p2p/src/components/signal/server"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestConnectSignalServerTLS(t *testing.T) {
+    ts := httptest.NewTLSServer(server.NewServer(server.Options{}).Handler())
+    defer ts.Close()
+
+    // 使用测试服务器的自签名证书作为自定义 CA
+    caFile := filepath.Join(t.TempDir(), "ca.pem")
+    caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+    if err := os.WriteFile(caFile, caPem, 0600); err != nil {
+        t.Fatal(err)
+    }
+    tlsConfig, err := NewTLSConfig(caFile, "", "")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    c := NewClient(&Option{
+        SignalServerAddr: strings.TrimPrefix(ts.URL, "https://"),
+        SignalServerPath: "/signal",
+        SignalServerTLS:  tlsConfig,
+        Cid:              "tls-peer",
+        AuthCode:         "123456",
+    })
+    if err := c.connectSignalServer(); err != nil {
+        t.Fatal(err)
+    }
+    defer c.Close()
+
+    presence, err := c.QueryPresence("tls-peer")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !presence.Online {
+        t.Fatal("tls-peer should be online")
+    }
+}
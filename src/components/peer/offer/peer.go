@@ -1,10 +1,17 @@
 package main
 
 import (
-    "fmt"
+    "bufio"
+    "context"
+    "crypto/tls"
+    "kwseeker.top/kwseeker/p2p/src/components/ice/nat"
     "kwseeker.top/kwseeker/p2p/src/components/peer/client"
     "log"
     "os"
+    "os/signal"
+    "strings"
+    "sync"
+    "syscall"
 )
 
 //var ssa = flag.String("ssa", ":18900", "signal server addr")
@@ -19,30 +26,151 @@ func main() {
     if isa == "" {
         isa = "stun:stun.l.google.com:19302"
     }
-    log.Printf("ssa: %s, isa: %s\n", ssa, isa)
+    // ISA 可以是逗号分隔的多个 ICE 服务器, TURN 服务器认证信息写在 URL 中(turn:user:pass@host:port)
+    // 或通过 ISA_USERNAME/ISA_CREDENTIAL 统一指定, ICE_POLICY=relay 时只通过 TURN 中继连接
+    iceServers, err := client.ParseICEServers(isa, os.Getenv("ISA_USERNAME"), os.Getenv("ISA_CREDENTIAL"))
+    if err != nil {
+        log.Fatalf("parse ice servers, err: %v\n", err)
+    }
+    icePolicy, err := client.ParseICETransportPolicy(os.Getenv("ICE_POLICY"))
+    if err != nil {
+        log.Fatalf("parse ice transport policy, err: %v\n", err)
+    }
+    // ICE_NETWORK 限制收集候选地址的网络类型, 逗号分隔的 udp4/udp6/tcp4/tcp6, 比如只有 IPv6 可用时配置 udp6
+    networkTypes, err := client.ParseNetworkTypes(os.Getenv("ICE_NETWORK"))
+    if err != nil {
+        log.Fatalf("parse ice network types, err: %v\n", err)
+    }
+    log.Printf("ssa: %s, ice servers: %d, ice policy: %s, ice network: %v\n", ssa, len(iceServers), icePolicy, networkTypes)
+    token := os.Getenv("TOKEN") // 信令服务器启用认证后端时需要
+    // RECEIVE_DIR 接收对端发送的文件的目录, 默认 ./received
+    receiveDir := os.Getenv("RECEIVE_DIR")
+    if receiveDir == "" {
+        receiveDir = "received"
+    }
+    if err := os.MkdirAll(receiveDir, 0o755); err != nil {
+        log.Fatalf("create receive dir, err: %v\n", err)
+    }
+    // SSA_TLS=1 时使用 wss 连接信令服务器, SSA_CA 自定义 CA, SSA_CERT/SSA_KEY 客户端证书(双向认证)
+    var signalServerTLS *tls.Config
+    if os.Getenv("SSA_TLS") == "1" {
+        signalServerTLS, err = client.NewTLSConfig(os.Getenv("SSA_CA"), os.Getenv("SSA_CERT"), os.Getenv("SSA_KEY"))
+        if err != nil {
+            log.Fatalf("load signal server tls config, err: %v\n", err)
+        }
+    }
 
     option := &client.Option{
-        SignalServerAddr: ssa,
-        SignalServerPath: "/signal",
-        PingIntervalSec:  20,
-        ICEServerAddr:    isa,
-        PeerType:         client.PeerTypeOffer,
-        Cid:              "345 822 666", // 比如远程控制程序，每个终端都有一个设备码
-        AuthCode:         "666999",      // 临时密码
+        SignalServerAddr:   ssa,
+        SignalServerPath:   "/signal",
+        SignalServerTLS:    signalServerTLS,
+        PingIntervalSec:    20,
+        ICEServers:         iceServers,
+        ICETransportPolicy: icePolicy,
+        NetworkTypes:       networkTypes,
+        VanillaICE:         os.Getenv("VANILLA_ICE") == "1", // 信令按消息计费时不使用 trickle ICE, 减少信令消息
+        PeerType:           client.PeerTypeOffer,
+        Cid:                "345 822 666", // 比如远程控制程序，每个终端都有一个设备码
+        AuthCode:           "666999",      // 临时密码
+        Token:              token,
+        ReceiveDir:         receiveDir,
     }
 
     toCid := "345 822 232"
     toAuthCode := "123456"
+    // 收到 SIGINT/SIGTERM 后关闭连接并退出
+    ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+    defer stop()
+
+    // NAT_STUN 配置支持 RFC 5780 的 STUN 服务器时检测本端 NAT 行为, 注册时上报, 发起连接前据此预测是否需要中继
+    // IPv4 和 IPv6 分别检测, 优先上报 IPv4 的结果, 只有 IPv6 可用时上报 IPv6 的结果
+    if natStun := os.Getenv("NAT_STUN"); natStun != "" {
+        dualStack := nat.DiscoverDualStack(ctx, natStun, nat.Options{})
+        if behavior := dualStack.Preferred(); behavior == nil {
+            log.Printf("discover nat behavior failed, ipv4 err: %s, ipv6 err: %s\n", dualStack.IPv4Error, dualStack.IPv6Error)
+        } else {
+            log.Printf("nat behavior: network=%s, mapping=%s, filtering=%s\n", behavior.Network, behavior.Mapping, behavior.Filtering)
+            option.NATBehavior = behavior
+        }
+    }
+
     answerPeer := client.NewClient(option)
-    go answerPeer.RunAsOffer(&toCid, &toAuthCode)
-
-    // 等待 DataChannel 继续
-    answerPeer.WaitWritable()
-    answerPeer.WriteText("Hello, I am AnswerPeer, cid=" + option.Cid)
-    var text string
-    for {
-        // 读取终端输入
-        _, _ = fmt.Scan(&text)
-        answerPeer.WriteText(option.Cid + " >>> " + text)
+
+    // 每个会话的 DataChannel 可写后发送问候
+    answerPeer.OnSession(func(session *client.Session) {
+        session.OnFileProgress(newProgressLogger(session))
+        go func() {
+            if err := session.WaitWritable(ctx); err != nil {
+                return
+            }
+            if err := session.WriteText("Hello, I am AnswerPeer, cid=" + option.Cid); err != nil {
+                log.Printf("send text error: %v\n", err)
+            }
+        }()
+    })
+    // 从终端读取输入发送给所有会话的对端, "send <path>" 发送文件
+    go func() {
+        scanner := bufio.NewScanner(os.Stdin)
+        for scanner.Scan() {
+            text := strings.TrimSpace(scanner.Text())
+            if text == "" {
+                continue
+            }
+            if path, ok := strings.CutPrefix(text, "send "); ok {
+                for _, session := range answerPeer.Sessions() {
+                    go sendFile(ctx, session, strings.TrimSpace(path))
+                }
+                continue
+            }
+            for _, session := range answerPeer.Sessions() {
+                if err := session.WriteText(option.Cid + " >>> " + text); err != nil {
+                    log.Printf("send text to %s error: %v\n", session.RemoteCid(), err)
+                }
+            }
+        }
+    }()
+
+    if err := answerPeer.RunAsOffer(ctx, &toCid, &toAuthCode); err != nil {
+        log.Fatalf("peer exited, err: %v\n", err)
+    }
+    log.Println("peer exited")
+}
+
+// sendFile 发送文件, 失败后重新执行 send 命令从断点继续
+func sendFile(ctx context.Context, session *client.Session, path string) {
+    if err := session.SendFile(ctx, path); err != nil {
+        log.Printf("send file %s to %s error: %v\n", path, session.RemoteCid(), err)
+    }
+}
+
+// newProgressLogger 文件传输进度每 10% 打印一次
+func newProgressLogger(session *client.Session) func(client.FileProgress) {
+    percents := make(map[string]int64)
+    var mu sync.Mutex // 发送和接收的进度回调可能同时执行
+    return func(progress client.FileProgress) {
+        mu.Lock()
+        defer mu.Unlock()
+        direction := "receive"
+        if progress.Sending {
+            direction = "send"
+        }
+        if progress.Done {
+            delete(percents, progress.ID)
+            if progress.Err != nil {
+                log.Printf("%s file %s with %s failed, err: %v\n", direction, progress.Name, session.RemoteCid(), progress.Err)
+            } else {
+                log.Printf("%s file %s with %s done, path: %s\n", direction, progress.Name, session.RemoteCid(), progress.Path)
+            }
+            return
+        }
+        percent := int64(100)
+        if progress.Size > 0 {
+            percent = progress.Transferred * 100 / progress.Size
+        }
+        if last, ok := percents[progress.ID]; ok && percent/10 == last/10 {
+            return
+        }
+        percents[progress.ID] = percent
+        log.Printf("%s file %s with %s: %d%% (%d/%d)\n", direction, progress.Name, session.RemoteCid(), percent, progress.Transferred, progress.Size)
     }
 }
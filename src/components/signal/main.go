@@ -1,13 +1,139 @@
 package main
 
 import (
+    "context"
+    "errors"
     "flag"
     "kwseeker.top/kwseeker/p2p/src/components/signal/server"
+    "log"
+    "os"
+    "os/signal"
+    "strings"
+    "syscall"
+    "time"
 )
 
 var signalServerAddr = flag.String("addr", ":18900", "http service address")
+var idleTimeout = flag.Duration("idle", 60*time.Second, "evict clients idle for longer than this, 0 to disable")
+var authMode = flag.String("auth", "none", "register authenticator: none, static or token")
+var authFile = flag.String("auth-file", "", "JSON file of cid -> secret, for -auth=static")
+var authSecret = flag.String("auth-secret", "", "HMAC secret for signed tokens, for -auth=token")
+var certFile = flag.String("cert", "", "TLS certificate file, serve wss when set with -key, reloaded on change")
+var keyFile = flag.String("key", "", "TLS private key file")
+var clientCAFile = flag.String("client-ca", "", "CA file to verify client certificates (mutual TLS)")
+var turnURLs = flag.String("turn-urls", "", "comma separated TURN server URLs handed out to registered clients")
+var turnSecret = flag.String("turn-secret", "", "secret shared with the TURN server to sign ephemeral credentials")
+var turnTTL = flag.Duration("turn-ttl", 24*time.Hour, "lifetime of the ephemeral TURN credentials")
+var turnUDPAddr = flag.String("turn-udp", "", "start the embedded STUN/TURN server on this UDP address, e.g. :3478")
+var turnTCPAddr = flag.String("turn-tcp", "", "start the embedded TURN server on this TCP address")
+var turnPublicIP = flag.String("turn-public-ip", "", "public IP of the embedded TURN server, defaults to the outbound IP")
+var turnRealm = flag.String("turn-realm", "p2p", "realm of the embedded TURN server")
+var turnMinPort = flag.Uint("turn-min-port", 0, "minimum relay port of the embedded TURN server")
+var turnMaxPort = flag.Uint("turn-max-port", 0, "maximum relay port of the embedded TURN server")
+var turnAllowPrivate = flag.Bool("turn-allow-private", false, "allow the embedded TURN server to relay to loopback, private and link-local peers")
 
 func main() {
     flag.Parse()
-    server.NewServer(signalServerAddr).Run()
+    idle := *idleTimeout
+    if idle == 0 {
+        idle = -1
+    }
+    // 内置 STUN/TURN 服务器和信令服务器使用同一个 TURN 密钥, 未配置 -turn-urls 时下发内置服务器地址
+    urls := splitList(*turnURLs)
+    turnServer := newTURNServer()
+    if turnServer != nil && len(urls) == 0 {
+        urls = turnServer.URLs()
+    }
+    signalServer := server.NewServer(server.Options{
+        Addr:          *signalServerAddr,
+        IdleTimeout:   idle,
+        Authenticator: newAuthenticator(),
+        CertFile:      *certFile,
+        KeyFile:       *keyFile,
+        ClientCAFile:  *clientCAFile,
+        TURNURLs:      urls,
+        TURNSecret:    *turnSecret,
+        TURNTTL:       *turnTTL,
+    })
+
+    // 收到退出信号后优雅关闭, 通知所有客户端断开
+    shutdownDone := make(chan struct{})
+    go func() {
+        defer close(shutdownDone)
+        sigChan := make(chan os.Signal, 1)
+        signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+        sig := <-sigChan
+        log.Printf("Received signal: %v. Shutting down...\n", sig)
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        defer cancel()
+        if err := signalServer.Shutdown(ctx); err != nil {
+            log.Printf("Signal server shutdown err: %v\n", err)
+        }
+        if turnServer != nil {
+            if err := turnServer.Close(); err != nil {
+                log.Printf("TURN server close err: %v\n", err)
+            }
+        }
+    }()
+
+    if err := signalServer.Run(); !errors.Is(err, server.ErrServerClosed) {
+        log.Fatalf("Signal server start failed at %s, err:%v\n", *signalServerAddr, err)
+    }
+    <-shutdownDone
+}
+
+func newAuthenticator() server.Authenticator {
+    switch *authMode {
+    case "none":
+        return server.AllowAllAuthenticator{}
+    case "static":
+        auth, err := server.NewStaticAuthenticator(*authFile)
+        if err != nil {
+            log.Fatalf("Load auth file %s failed, err: %v\n", *authFile, err)
+        }
+        return auth
+    case "token":
+        if *authSecret == "" {
+            log.Fatalln("-auth-secret is required for -auth=token")
+        }
+        return server.NewTokenAuthenticator([]byte(*authSecret))
+    default:
+        log.Fatalf("Unknown auth mode: %s\n", *authMode)
+        return nil
+    }
+}
+
+// newTURNServer 配置了 -turn-udp 或 -turn-tcp 时启动内置 STUN/TURN 服务器
+func newTURNServer() *server.TURNServer {
+    if *turnUDPAddr == "" && *turnTCPAddr == "" {
+        return nil
+    }
+    if *turnSecret == "" {
+        log.Println("-turn-secret is not set, embedded server only serves STUN")
+    }
+    turnServer, err := server.NewTURNServer(server.TURNServerOptions{
+        UDPAddr:           *turnUDPAddr,
+        TCPAddr:           *turnTCPAddr,
+        PublicIP:          *turnPublicIP,
+        Realm:             *turnRealm,
+        Secret:            *turnSecret,
+        RelayMinPort:      uint16(*turnMinPort),
+        RelayMaxPort:      uint16(*turnMaxPort),
+        AllowPrivatePeers: *turnAllowPrivate,
+    })
+    if err != nil {
+        log.Fatalf("TURN server start failed, err: %v\n", err)
+    }
+    return turnServer
+}
+
+// splitList 解析逗号分隔的列表, 忽略空项
+func splitList(value string) []string {
+    var list []string
+    for _, item := range strings.Split(value, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            list = append(list, item)
+        }
+    }
+    return list
 }
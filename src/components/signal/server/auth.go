@@ -0,0 +1,131 @@
+package server
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+var (
+    ErrUnknownCid     = errors.New("unknown cid")
+    ErrInvalidToken   = errors.New("invalid token")
+    ErrTokenExpired   = errors.New("token expired")
+    ErrAuthCodeFailed = errors.New("auth code mismatch")
+)
+
+// Authenticator 认证后端, 信令服务器在客户端注册和发起连接(offer)时调用
+type Authenticator interface {
+    // AuthenticateRegister 校验注册的设备身份, 返回错误则拒绝注册
+    // 通过校验才能注册或替换 cid 已有的注册信息, 防止设备 ID 被冒用
+    AuthenticateRegister(registerBody message.RegisterBody) error
+    // AuthenticateOffer 校验来源 Peer 是否可以向目标 Peer 发起连接, targetAuthCode 为目标 Peer 注册时的认证码
+    AuthenticateOffer(sdpBody message.SdpBody, targetAuthCode string) error
+}
+
+// checkAuthCode 比较 offer 中的认证码和目标 Peer 注册时的认证码
+func checkAuthCode(sdpBody message.SdpBody, targetAuthCode string) error {
+    if subtle.ConstantTimeCompare([]byte(sdpBody.AuthCode), []byte(targetAuthCode)) != 1 {
+        return ErrAuthCodeFailed
+    }
+    return nil
+}
+
+// AllowAllAuthenticator 任意 cid 都可以注册, 同 cid 后注册的替换先注册的
+type AllowAllAuthenticator struct{}
+
+func (AllowAllAuthenticator) AuthenticateRegister(message.RegisterBody) error {
+    return nil
+}
+
+func (AllowAllAuthenticator) AuthenticateOffer(sdpBody message.SdpBody, targetAuthCode string) error {
+    return checkAuthCode(sdpBody, targetAuthCode)
+}
+
+// StaticAuthenticator 只允许配置文件中的 cid 注册, 注册时 Token 需要和 cid 对应的密钥一致
+type StaticAuthenticator struct {
+    secrets map[string]string // cid -> 密钥
+}
+
+// NewStaticAuthenticator 从 JSON 文件加载 cid 和密钥, 格式: {"cid": "secret"}
+func NewStaticAuthenticator(path string) (*StaticAuthenticator, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    secrets := make(map[string]string)
+    if err := json.Unmarshal(data, &secrets); err != nil {
+        return nil, err
+    }
+    return &StaticAuthenticator{secrets: secrets}, nil
+}
+
+func (a *StaticAuthenticator) AuthenticateRegister(registerBody message.RegisterBody) error {
+    secret, ok := a.secrets[registerBody.Cid]
+    if !ok {
+        return ErrUnknownCid
+    }
+    if subtle.ConstantTimeCompare([]byte(registerBody.Token), []byte(secret)) != 1 {
+        return ErrInvalidToken
+    }
+    return nil
+}
+
+func (a *StaticAuthenticator) AuthenticateOffer(sdpBody message.SdpBody, targetAuthCode string) error {
+    return checkAuthCode(sdpBody, targetAuthCode)
+}
+
+// TokenAuthenticator 注册时 Token 需要是共享密钥签发的、未过期的 HMAC 签名令牌, 适合由业务服务为设备签发身份
+type TokenAuthenticator struct {
+    secret []byte
+    now    func() time.Time
+}
+
+func NewTokenAuthenticator(secret []byte) *TokenAuthenticator {
+    return &TokenAuthenticator{
+        secret: secret,
+        now:    time.Now,
+    }
+}
+
+// GenerateToken 为 cid 签发有效期至 expiry 的令牌, 格式: 过期时间戳(秒).HMAC-SHA256(cid:过期时间戳)
+func GenerateToken(secret []byte, cid string, expiry time.Time) string {
+    expires := strconv.FormatInt(expiry.Unix(), 10)
+    return expires + "." + hex.EncodeToString(signToken(secret, cid, expires))
+}
+
+func signToken(secret []byte, cid, expires string) []byte {
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte(cid + ":" + expires))
+    return mac.Sum(nil)
+}
+
+func (a *TokenAuthenticator) AuthenticateRegister(registerBody message.RegisterBody) error {
+    expires, signature, ok := strings.Cut(registerBody.Token, ".")
+    if !ok {
+        return ErrInvalidToken
+    }
+    expiry, err := strconv.ParseInt(expires, 10, 64)
+    if err != nil {
+        return ErrInvalidToken
+    }
+    mac, err := hex.DecodeString(signature)
+    if err != nil || !hmac.Equal(mac, signToken(a.secret, registerBody.Cid, expires)) {
+        return ErrInvalidToken
+    }
+    if a.now().Unix() >= expiry {
+        return ErrTokenExpired
+    }
+    return nil
+}
+
+func (a *TokenAuthenticator) AuthenticateOffer(sdpBody message.SdpBody, targetAuthCode string) error {
+    return checkAuthCode(sdpBody, targetAuthCode)
+}
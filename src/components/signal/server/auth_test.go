@@ -0,0 +1,67 @@
+package server
+
+import (
+    "errors"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestStaticAuthenticator(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "secrets.json")
+    if err := os.WriteFile(path, []byte(`{"345 822 232": "s3cret"}`), 0600); err != nil {
+        t.Fatal(err)
+    }
+    auth, err := NewStaticAuthenticator(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if err := auth.AuthenticateRegister(message.RegisterBody{Cid: "345 822 232", Token: "s3cret"}); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if err := auth.AuthenticateRegister(message.RegisterBody{Cid: "345 822 232", Token: "guess"}); !errors.Is(err, ErrInvalidToken) {
+        t.Fatalf("expected invalid token, got: %v", err)
+    }
+    if err := auth.AuthenticateRegister(message.RegisterBody{Cid: "345 822 666", Token: "s3cret"}); !errors.Is(err, ErrUnknownCid) {
+        t.Fatalf("expected unknown cid, got: %v", err)
+    }
+
+    if err := auth.AuthenticateOffer(message.SdpBody{AuthCode: "123456"}, "123456"); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if err := auth.AuthenticateOffer(message.SdpBody{AuthCode: "000000"}, "123456"); !errors.Is(err, ErrAuthCodeFailed) {
+        t.Fatalf("expected auth code failed, got: %v", err)
+    }
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+    secret := []byte("signal-secret")
+    now := time.Unix(1700000000, 0)
+    auth := NewTokenAuthenticator(secret)
+    auth.now = func() time.Time { return now }
+
+    token := GenerateToken(secret, "345 822 232", now.Add(time.Hour))
+    if err := auth.AuthenticateRegister(message.RegisterBody{Cid: "345 822 232", Token: token}); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    // 令牌不能用于其他 cid
+    if err := auth.AuthenticateRegister(message.RegisterBody{Cid: "345 822 666", Token: token}); !errors.Is(err, ErrInvalidToken) {
+        t.Fatalf("expected invalid token, got: %v", err)
+    }
+    // 其他密钥签发的令牌
+    forged := GenerateToken([]byte("other"), "345 822 232", now.Add(time.Hour))
+    if err := auth.AuthenticateRegister(message.RegisterBody{Cid: "345 822 232", Token: forged}); !errors.Is(err, ErrInvalidToken) {
+        t.Fatalf("expected invalid token, got: %v", err)
+    }
+    if err := auth.AuthenticateRegister(message.RegisterBody{Cid: "345 822 232", Token: "garbage"}); !errors.Is(err, ErrInvalidToken) {
+        t.Fatalf("expected invalid token, got: %v", err)
+    }
+
+    now = now.Add(2 * time.Hour)
+    if err := auth.AuthenticateRegister(message.RegisterBody{Cid: "345 822 232", Token: token}); !errors.Is(err, ErrTokenExpired) {
+        t.Fatalf("expected token expired, got: %v", err)
+    }
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+    "sync"
+    "time"
+)
+
+const (
+    defaultMaxAuthFails       = 5               // 统计窗口内同一来源允许的最大认证失败次数
+    defaultMaxTargetAuthFails = 20              // 统计窗口内同一目标允许的最大认证失败次数
+    defaultAuthFailWindow     = time.Minute     // 认证失败统计窗口
+    defaultAuthLockout        = 5 * time.Minute // 超过失败次数后的封禁时长
+    limiterSweepThreshold     = 1024            // 记录数超过该值时清理过期记录
+)
+
+// authLimiter 认证失败限流器
+// 按 key(来源 IP 或目标 cid)统计认证失败次数，窗口内失败次数过多则封禁一段时间，防止暴力破解 6 位认证码
+type authLimiter struct {
+    maxFails int
+    window   time.Duration
+    lockout  time.Duration
+    records  map[string]*failRecord // key -> 失败记录
+    mu       sync.Mutex
+    now      func() time.Time
+}
+
+type failRecord struct {
+    fails        int       // 当前窗口内失败次数
+    windowStart  time.Time // 当前窗口开始时间
+    blockedUntil time.Time // 封禁截止时间
+}
+
+func newAuthLimiter(maxFails int, window, lockout time.Duration) *authLimiter {
+    return &authLimiter{
+        maxFails: maxFails,
+        window:   window,
+        lockout:  lockout,
+        records:  make(map[string]*failRecord),
+        now:      time.Now,
+    }
+}
+
+// allow key 当前是否允许进行认证
+func (l *authLimiter) allow(key string) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    record, ok := l.records[key]
+    if !ok {
+        return true
+    }
+    return !l.now().Before(record.blockedUntil)
+}
+
+// fail 记录一次认证失败，返回 key 是否因此被封禁
+func (l *authLimiter) fail(key string) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    now := l.now()
+    if len(l.records) >= limiterSweepThreshold {
+        l.sweep(now)
+    }
+
+    record, ok := l.records[key]
+    if !ok || now.Sub(record.windowStart) > l.window {
+        record = &failRecord{windowStart: now}
+        l.records[key] = record
+    }
+    record.fails++
+    if record.fails >= l.maxFails {
+        record.blockedUntil = now.Add(l.lockout)
+        // 封禁期结束后重新开始计数
+        record.fails = 0
+        record.windowStart = record.blockedUntil
+        return true
+    }
+    return false
+}
+
+// sweep 清理已过期的记录，需持有锁
+func (l *authLimiter) sweep(now time.Time) {
+    for key, record := range l.records {
+        if now.Sub(record.windowStart) > l.window && !now.Before(record.blockedUntil) {
+            delete(l.records, key)
+        }
+    }
+}
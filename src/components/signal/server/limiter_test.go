@@ -0,0 +1,41 @@
+package server
+
+import (
+    "testing"
+    "time"
+)
+
+func TestAuthLimiter(t *testing.T) {
+    now := time.Unix(0, 0)
+    limiter := newAuthLimiter(3, time.Minute, 5*time.Minute)
+    limiter.now = func() time.Time { return now }
+
+    for i := 0; i < 2; i++ {
+        if limiter.fail("c1") {
+            t.Fatalf("blocked after %d failures", i+1)
+        }
+    }
+    if !limiter.fail("c1") {
+        t.Fatal("expected block after 3 failures")
+    }
+    if limiter.allow("c1") {
+        t.Fatal("c1 should be blocked")
+    }
+    if !limiter.allow("c2") {
+        t.Fatal("c2 should not be affected by c1")
+    }
+
+    // 封禁期过后恢复
+    now = now.Add(5 * time.Minute)
+    if !limiter.allow("c1") {
+        t.Fatal("c1 should be allowed after lockout")
+    }
+
+    // 窗口过期后重新计数
+    limiter.fail("c2")
+    limiter.fail("c2")
+    now = now.Add(2 * time.Minute)
+    if limiter.fail("c2") {
+        t.Fatal("failures outside window should not be counted")
+    }
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+    "encoding/json"
+    "kwseeker.top/kwseeker/p2p/src/components/ice/nat"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "log"
+    "net"
+)
+
+// 查询两个 Peer 的连通性预测, 发起方需先注册, 目标 Peer 需在线
+func (s *Server) handleConnectivity(clientConn *ClientConn, msg []byte) {
+    connectivityRequest := message.ConnectivityRequest{}
+    if err := json.Unmarshal(msg, &connectivityRequest); err != nil {
+        log.Println(err)
+        clientConn.reply(message.NewConnectivityFailedResponse(connectivityRequest,
+            message.NewError(message.ErrCodeMalformed, "invalid connectivity request")))
+        return
+    }
+    if !clientConn.registeredAs(connectivityRequest.From) {
+        clientConn.reply(message.NewConnectivityFailedResponse(connectivityRequest,
+            message.NewError(message.ErrCodeNotRegistered, "query connectivity before register")))
+        return
+    }
+    target, ok := s.getConnection(connectivityRequest.To)
+    if !ok {
+        clientConn.reply(message.NewConnectivityFailedResponse(connectivityRequest,
+            message.NewError(message.ErrCodeTargetOffline, "target peer is offline")))
+        return
+    }
+    connectivity := predictConnectivity(clientConn.info().nat, target.info().nat, publicIP(clientConn), publicIP(target))
+    log.Printf("Connectivity from %s to %s: %s\n", connectivityRequest.From, connectivityRequest.To, connectivity)
+    clientConn.reply(message.NewConnectivityResponse(connectivityRequest, connectivity))
+}
+
+// publicIP Peer 的外部 IP, 优先使用 NAT 检测得到的外部地址, 否则使用信令连接的来源 IP
+func publicIP(clientConn *ClientConn) net.IP {
+    if nat := clientConn.info().nat; nat != nil && nat.ExternalAddr != "" {
+        if host, _, err := net.SplitHostPort(nat.ExternalAddr); err == nil {
+            if ip := net.ParseIP(host); ip != nil {
+                return ip
+            }
+        }
+    }
+    return clientConn.remoteIP
+}
+
+// predictConnectivity 根据双方的 NAT 行为预测能否打洞直连
+// 映射行为与目标地址相关(对称型 NAT)的一方, 打洞时使用的外部端口对端无法预知:
+// 双方都是对称型 NAT, 或一方是对称型而另一方的过滤行为与端口相关时, 打洞基本不可能成功, 需要 TURN 中继
+func predictConnectivity(from, to *message.NATInfo, fromIP, toIP net.IP) message.Connectivity {
+    if fromIP != nil && fromIP.Equal(toIP) {
+        return message.ConnectivitySameLAN
+    }
+    if !knownBehavior(from) || !knownBehavior(to) {
+        return message.ConnectivityUnknown
+    }
+    fromSymmetric, toSymmetric := symmetric(from), symmetric(to)
+    switch {
+    case fromSymmetric && toSymmetric:
+        return message.ConnectivityRelay
+    case fromSymmetric && to.Filtering == string(nat.AddressAndPortDependent):
+        return message.ConnectivityRelay
+    case toSymmetric && from.Filtering == string(nat.AddressAndPortDependent):
+        return message.ConnectivityRelay
+    default:
+        return message.ConnectivityDirect
+    }
+}
+
+func knownBehavior(info *message.NATInfo) bool {
+    if info == nil {
+        return false
+    }
+    if !info.NAT {
+        return true
+    }
+    known := func(behavior string) bool {
+        switch nat.Behavior(behavior) {
+        case nat.EndpointIndependent, nat.AddressDependent, nat.AddressAndPortDependent:
+            return true
+        }
+        return false
+    }
+    return known(info.Mapping) && known(info.Filtering)
+}
+
+// symmetric 映射行为与目标地址相关, 没有 NAT 时不是对称型
+func symmetric(info *message.NATInfo) bool {
+    return info.NAT && info.Mapping != string(nat.EndpointIndependent)
+}
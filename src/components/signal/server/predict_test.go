@@ -0,0 +1,84 @@
+package server
+
+import (
+    "github.com/gorilla/websocket"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "net"
+    "testing"
+)
+
+func TestPredictConnectivity(t *testing.T) {
+    public := &message.NATInfo{NAT: false, Mapping: "endpoint-independent", Filtering: "endpoint-independent"}
+    fullCone := &message.NATInfo{NAT: true, Mapping: "endpoint-independent", Filtering: "endpoint-independent"}
+    portRestricted := &message.NATInfo{NAT: true, Mapping: "endpoint-independent", Filtering: "address-and-port-dependent"}
+    symmetric := &message.NATInfo{NAT: true, Mapping: "address-and-port-dependent", Filtering: "address-and-port-dependent"}
+    unknown := &message.NATInfo{NAT: true, Mapping: "unknown", Filtering: "unknown"}
+    ipA, ipB := net.ParseIP("203.0.113.1"), net.ParseIP("198.51.100.1")
+
+    cases := []struct {
+        name     string
+        from, to *message.NATInfo
+        toIP     net.IP
+        expected message.Connectivity
+    }{
+        {"same public ip", symmetric, symmetric, ipA, message.ConnectivitySameLAN},
+        {"not reported", nil, fullCone, ipB, message.ConnectivityUnknown},
+        {"unknown behavior", unknown, fullCone, ipB, message.ConnectivityUnknown},
+        {"public to symmetric", public, symmetric, ipB, message.ConnectivityDirect},
+        {"full cone to symmetric", fullCone, symmetric, ipB, message.ConnectivityDirect},
+        {"port restricted cones", portRestricted, portRestricted, ipB, message.ConnectivityDirect},
+        {"symmetric to port restricted", symmetric, portRestricted, ipB, message.ConnectivityRelay},
+        {"port restricted to symmetric", portRestricted, symmetric, ipB, message.ConnectivityRelay},
+        {"symmetric to symmetric", symmetric, symmetric, ipB, message.ConnectivityRelay},
+    }
+    for _, c := range cases {
+        if connectivity := predictConnectivity(c.from, c.to, ipA, c.toIP); connectivity != c.expected {
+            t.Errorf("%s: expected %s, got %s", c.name, c.expected, connectivity)
+        }
+    }
+}
+
+func TestConnectivityQuery(t *testing.T) {
+    t.Parallel()
+    _, ts := newTestServer(t)
+
+    register := func(cid string, info *message.NATInfo) *websocket.Conn {
+        conn := dialTestServer(t, ts.URL+"/signal")
+        registerRequest := message.NewRegisterRequest(cid, "123456")
+        registerRequest.NAT = info
+        if err := conn.WriteJSON(registerRequest); err != nil {
+            t.Fatal(err)
+        }
+        readType(t, conn, message.TypeRegisterResponse, &message.RegisterResponse{})
+        return conn
+    }
+    c1 := register("predict-c1", &message.NATInfo{NAT: true, Mapping: "address-and-port-dependent", Filtering: "address-and-port-dependent", ExternalAddr: "203.0.113.1:4000"})
+    defer c1.Close()
+    c2 := register("predict-c2", &message.NATInfo{NAT: true, Mapping: "address-dependent", Filtering: "address-dependent", ExternalAddr: "198.51.100.1:5000"})
+    defer c2.Close()
+    c3 := register("predict-c3", nil)
+    defer c3.Close()
+
+    query := func(conn *websocket.Conn, from, to string) message.ConnectivityResponse {
+        if err := conn.WriteJSON(message.NewConnectivityRequest(from, to)); err != nil {
+            t.Fatal(err)
+        }
+        connectivityResponse := message.ConnectivityResponse{}
+        readType(t, conn, message.TypeConnectivityResponse, &connectivityResponse)
+        return connectivityResponse
+    }
+    if resp := query(c1, "predict-c1", "predict-c2"); !resp.Success || resp.Connectivity != message.ConnectivityRelay {
+        t.Fatalf("unexpected response: %+v", resp)
+    }
+    // 一方没有上报 NAT 行为
+    if resp := query(c3, "predict-c3", "predict-c1"); resp.Connectivity != message.ConnectivityUnknown {
+        t.Fatalf("unexpected response: %+v", resp)
+    }
+    if resp := query(c1, "predict-c1", "predict-offline"); resp.Success || resp.Error.Code != message.ErrCodeTargetOffline {
+        t.Fatalf("unexpected response: %+v", resp)
+    }
+    // 不能以其他 cid 查询
+    if resp := query(c1, "predict-c2", "predict-c1"); resp.Success || resp.Error.Code != message.ErrCodeNotRegistered {
+        t.Fatalf("unexpected response: %+v", resp)
+    }
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+    "encoding/json"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "log"
+    "net/http"
+)
+
+// watcherSet 订阅某个 cid 在线状态的客户端连接
+type watcherSet map[*ClientConn]struct{}
+
+// presenceLocked 查询 cid 的在线状态, 需持有 s.mu
+func (s *Server) presenceLocked(cid string) message.Presence {
+    clientConn, ok := s.connections[cid]
+    if !ok {
+        return message.Presence{Cid: cid}
+    }
+    reg := clientConn.info()
+    return message.Presence{
+        Cid:          cid,
+        Online:       true,
+        RegisteredAt: reg.registeredAt.UnixMilli(),
+        Metadata:     reg.metadata,
+    }
+}
+
+func (s *Server) presence(cid string) message.Presence {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.presenceLocked(cid)
+}
+
+// watch 订阅 cid 的在线状态, 返回当前在线状态
+func (s *Server) watch(watcher *ClientConn, cid string) message.Presence {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    watchers, ok := s.watchers[cid]
+    if !ok {
+        watchers = make(watcherSet)
+        s.watchers[cid] = watchers
+    }
+    watchers[watcher] = struct{}{}
+    return s.presenceLocked(cid)
+}
+
+// unwatch 取消订阅 cid 的在线状态, 返回当前在线状态
+func (s *Server) unwatch(watcher *ClientConn, cid string) message.Presence {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if watchers, ok := s.watchers[cid]; ok {
+        delete(watchers, watcher)
+        if len(watchers) == 0 {
+            delete(s.watchers, cid)
+        }
+    }
+    return s.presenceLocked(cid)
+}
+
+// unwatchAllLocked 客户端连接移除时清理其所有订阅, 需持有 s.mu
+func (s *Server) unwatchAllLocked(watcher *ClientConn) {
+    for cid, watchers := range s.watchers {
+        delete(watchers, watcher)
+        if len(watchers) == 0 {
+            delete(s.watchers, cid)
+        }
+    }
+}
+
+// notifyPresence 向订阅者推送在线状态变化, 不能持有 s.mu 调用(写失败时会移除连接)
+func (s *Server) notifyPresence(presence message.Presence) {
+    s.mu.Lock()
+    watchers := make([]*ClientConn, 0, len(s.watchers[presence.Cid]))
+    for watcher := range s.watchers[presence.Cid] {
+        watchers = append(watchers, watcher)
+    }
+    s.mu.Unlock()
+
+    event := message.NewPresenceEvent(presence)
+    for _, watcher := range watchers {
+        if err := watcher.checkAndWriteJSON(event); err != nil {
+            log.Printf("Notify presence of %s to %s failed, err: %v\n", presence.Cid, watcher.info().cid, err)
+        }
+    }
+}
+
+// 查询 Peer 在线状态
+func (s *Server) handlePresence(clientConn *ClientConn, msg []byte) {
+    presenceRequest := message.PresenceRequest{}
+    if err := json.Unmarshal(msg, &presenceRequest); err != nil {
+        log.Println(err)
+        clientConn.reply(message.NewPresenceFailedResponse(presenceRequest,
+            message.NewError(message.ErrCodeMalformed, "invalid presence request")))
+        return
+    }
+    clientConn.reply(message.NewPresenceResponse(presenceRequest, s.presence(presenceRequest.Cid)))
+}
+
+// 订阅、取消订阅 Peer 在线状态, 订阅者需先注册, 连接移除时自动取消订阅
+func (s *Server) handleSubscribe(clientConn *ClientConn, msg []byte) {
+    subscribeRequest := message.SubscribeRequest{}
+    if err := json.Unmarshal(msg, &subscribeRequest); err != nil {
+        log.Println(err)
+        clientConn.reply(message.NewSubscribeFailedResponse(subscribeRequest,
+            message.NewError(message.ErrCodeMalformed, "invalid subscribe request")))
+        return
+    }
+    if current, ok := s.getConnection(clientConn.info().cid); !ok || current != clientConn {
+        clientConn.reply(message.NewSubscribeFailedResponse(subscribeRequest,
+            message.NewError(message.ErrCodeNotRegistered, "subscribe before register")))
+        return
+    }
+
+    var presence message.Presence
+    if subscribeRequest.Unsubscribe {
+        presence = s.unwatch(clientConn, subscribeRequest.Cid)
+    } else {
+        presence = s.watch(clientConn, subscribeRequest.Cid)
+    }
+    clientConn.reply(message.NewSubscribeResponse(subscribeRequest, presence))
+}
+
+// presenceHandler HTTP 查询 Peer 在线状态, GET /presence?cid=xxx
+func (s *Server) presenceHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    cid := r.URL.Query().Get("cid")
+    if cid == "" {
+        http.Error(w, "cid is required", http.StatusBadRequest)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(s.presence(cid)); err != nil {
+        log.Printf("Write presence response failed, err: %v\n", err)
+    }
+}
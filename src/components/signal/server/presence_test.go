@@ -0,0 +1,80 @@
+package server
+
+import (
+    "encoding/json"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "net/http"
+    "testing"
+)
+
+func TestPresence(t *testing.T) {
+    t.Parallel()
+    srv, ts := newTestServer(t)
+
+    watcher := dialTestServer(t, ts.URL+"/signal")
+    defer watcher.Close()
+    if err := watcher.WriteJSON(message.NewRegisterRequest("presence-watcher", "111111")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, watcher, message.TypeRegisterResponse, &message.RegisterResponse{})
+
+    subscribeResponse := message.SubscribeResponse{}
+    if err := watcher.WriteJSON(message.NewSubscribeRequest("presence-target", false)); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, watcher, message.TypeSubscribeResponse, &subscribeResponse)
+    if !subscribeResponse.Success || subscribeResponse.Presence.Online {
+        t.Fatalf("unexpected subscribe response: %+v", subscribeResponse)
+    }
+
+    // 上线
+    target := dialTestServer(t, ts.URL+"/signal")
+    registerRequest := message.NewRegisterRequest("presence-target", "222222")
+    registerRequest.Metadata = map[string]string{"name": "laptop"}
+    if err := target.WriteJSON(registerRequest); err != nil {
+        t.Fatal(err)
+    }
+    event := message.PresenceEvent{}
+    readType(t, watcher, message.TypePresenceEvent, &event)
+    if !event.Online || event.Metadata["name"] != "laptop" {
+        t.Fatalf("unexpected online event: %+v", event)
+    }
+
+    presenceResponse := message.PresenceResponse{}
+    if err := watcher.WriteJSON(message.NewPresenceRequest("presence-target")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, watcher, message.TypePresenceResponse, &presenceResponse)
+    if !presenceResponse.Online || presenceResponse.RegisteredAt == 0 {
+        t.Fatalf("unexpected presence response: %+v", presenceResponse)
+    }
+
+    resp, err := http.Get(ts.URL + "/presence?cid=presence-target")
+    if err != nil {
+        t.Fatal(err)
+    }
+    presence := message.Presence{}
+    if err := json.NewDecoder(resp.Body).Decode(&presence); err != nil {
+        t.Fatal(err)
+    }
+    _ = resp.Body.Close()
+    if !presence.Online || presence.Metadata["name"] != "laptop" {
+        t.Fatalf("unexpected http presence: %+v", presence)
+    }
+
+    // 下线
+    srv.removeConnection(mustGetConnection(t, srv, "presence-target"))
+    event = message.PresenceEvent{}
+    readType(t, watcher, message.TypePresenceEvent, &event)
+    if event.Online || event.Cid != "presence-target" {
+        t.Fatalf("unexpected offline event: %+v", event)
+    }
+}
+
+func mustGetConnection(t *testing.T, srv *Server, cid string) *ClientConn {
+    clientConn, ok := srv.getConnection(cid)
+    if !ok {
+        t.Fatalf("client conn %s not found", cid)
+    }
+    return clientConn
+}
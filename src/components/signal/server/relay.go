@@ -0,0 +1,182 @@
+package server
+
+import (
+    "errors"
+    "fmt"
+    "github.com/pion/logging"
+    "github.com/pion/turn/v4"
+    "log"
+    "net"
+    "strconv"
+)
+
+const defaultTURNRealm = "p2p"
+
+// TURNServerOptions 内置 STUN/TURN 服务器配置
+type TURNServerOptions struct {
+    UDPAddr      string // UDP 监听地址, 比如 :3478, 为空不监听 UDP
+    TCPAddr      string // TCP 监听地址, 为空不监听 TCP
+    PublicIP     string // 对外公布的地址, 用于生成 URL 和中继地址, 默认使用监听地址的 IP
+    Realm        string // TURN 认证域, 默认 p2p
+    Secret       string // 与信令服务器共享的 TURN 密钥, 校验注册响应中下发的临时认证信息, 为空时只提供 STUN 服务
+    RelayMinPort uint16 // 中继端口范围, 都为 0 时随机分配
+    RelayMaxPort uint16
+    // AllowPrivatePeers 允许中继到回环、内网、链路本地和未指定地址, 默认拒绝, 防止客户端通过中继访问服务器所在的内网
+    AllowPrivatePeers bool
+}
+
+// TURNServer 内置 STUN/TURN 服务器, 和信令服务器一起部署时不再依赖外部 STUN/TURN 服务
+// TURN 认证使用 TURN REST API 临时认证信息(用户名为 "过期时间戳:cid"), 和信令服务器注册响应下发的认证信息一致
+type TURNServer struct {
+    server *turn.Server
+    urls   []string
+}
+
+func NewTURNServer(options TURNServerOptions) (*TURNServer, error) {
+    if options.UDPAddr == "" && options.TCPAddr == "" {
+        return nil, errors.New("turn server needs a UDP or TCP listen address")
+    }
+    if options.Realm == "" {
+        options.Realm = defaultTURNRealm
+    }
+
+    var udpConn net.PacketConn
+    var tcpListener net.Listener
+    closeAll := func() {
+        if udpConn != nil {
+            _ = udpConn.Close()
+        }
+        if tcpListener != nil {
+            _ = tcpListener.Close()
+        }
+    }
+    var err error
+    if options.UDPAddr != "" {
+        if udpConn, err = net.ListenPacket("udp4", options.UDPAddr); err != nil {
+            return nil, err
+        }
+    }
+    if options.TCPAddr != "" {
+        if tcpListener, err = net.Listen("tcp4", options.TCPAddr); err != nil {
+            closeAll()
+            return nil, err
+        }
+    }
+
+    publicIP := net.ParseIP(options.PublicIP)
+    if options.PublicIP != "" && publicIP == nil {
+        closeAll()
+        return nil, fmt.Errorf("invalid turn public ip %q", options.PublicIP)
+    }
+
+    config := turn.ServerConfig{
+        Realm:         options.Realm,
+        LoggerFactory: logging.NewDefaultLoggerFactory(),
+    }
+    // 未配置密钥时拒绝所有 TURN 分配请求, STUN Binding 请求不需要认证
+    config.AuthHandler = func(string, string, net.Addr) ([]byte, bool) {
+        return nil, false
+    }
+    if options.Secret != "" {
+        config.AuthHandler = turn.LongTermTURNRESTAuthHandler(options.Secret, nil)
+    }
+
+    var urls []string
+    if udpConn != nil {
+        ip, port := advertisedAddr(udpConn.LocalAddr(), publicIP)
+        config.PacketConnConfigs = []turn.PacketConnConfig{{
+            PacketConn:            udpConn,
+            RelayAddressGenerator: relayAddressGenerator(ip, options),
+            PermissionHandler:     permissionHandler(options.AllowPrivatePeers),
+        }}
+        hostPort := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+        urls = append(urls, "stun:"+hostPort, "turn:"+hostPort+"?transport=udp")
+    }
+    if tcpListener != nil {
+        ip, port := advertisedAddr(tcpListener.Addr(), publicIP)
+        config.ListenerConfigs = []turn.ListenerConfig{{
+            Listener:              tcpListener,
+            RelayAddressGenerator: relayAddressGenerator(ip, options),
+            PermissionHandler:     permissionHandler(options.AllowPrivatePeers),
+        }}
+        urls = append(urls, "turn:"+net.JoinHostPort(ip.String(), strconv.Itoa(port))+"?transport=tcp")
+    }
+
+    server, err := turn.NewServer(config)
+    if err != nil {
+        closeAll()
+        return nil, err
+    }
+    log.Printf("TURN server start at %v, realm=%s\n", urls, options.Realm)
+    return &TURNServer{server: server, urls: urls}, nil
+}
+
+// URLs 返回客户端使用的 STUN/TURN 地址, 可以作为信令服务器 Options.TURNURLs 下发给客户端
+func (t *TURNServer) URLs() []string {
+    return t.urls
+}
+
+// Close 关闭监听并释放所有中继分配
+func (t *TURNServer) Close() error {
+    return t.server.Close()
+}
+
+// advertisedAddr 对外公布的 IP 和端口, 未配置公布地址且监听在任意地址时使用本机出口 IP
+func advertisedAddr(addr net.Addr, publicIP net.IP) (net.IP, int) {
+    var ip net.IP
+    var port int
+    switch a := addr.(type) {
+    case *net.UDPAddr:
+        ip, port = a.IP, a.Port
+    case *net.TCPAddr:
+        ip, port = a.IP, a.Port
+    }
+    if publicIP != nil {
+        return publicIP, port
+    }
+    if ip == nil || ip.IsUnspecified() {
+        ip = outboundIP()
+    }
+    return ip, port
+}
+
+// outboundIP 本机访问外网使用的 IP, 获取失败时返回回环地址
+func outboundIP() net.IP {
+    conn, err := net.Dial("udp4", "192.0.2.1:9")
+    if err != nil {
+        return net.IPv4(127, 0, 0, 1)
+    }
+    defer conn.Close()
+    return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// permissionHandler 校验 CreatePermission 和 ChannelBind 请求的对端地址, allowPrivate 为 false 时拒绝非公网地址
+func permissionHandler(allowPrivate bool) turn.PermissionHandler {
+    return func(clientAddr net.Addr, peerIP net.IP) bool {
+        if allowPrivate || !isPrivatePeer(peerIP) {
+            return true
+        }
+        log.Printf("TURN permission to %s denied, client=%s\n", peerIP, clientAddr)
+        return false
+    }
+}
+
+// isPrivatePeer 对端是否是回环、内网、链路本地或未指定地址
+func isPrivatePeer(ip net.IP) bool {
+    return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+func relayAddressGenerator(ip net.IP, options TURNServerOptions) turn.RelayAddressGenerator {
+    if options.RelayMinPort != 0 && options.RelayMaxPort != 0 {
+        return &turn.RelayAddressGeneratorPortRange{
+            RelayAddress: ip,
+            Address:      "0.0.0.0",
+            MinPort:      options.RelayMinPort,
+            MaxPort:      options.RelayMaxPort,
+        }
+    }
+    return &turn.RelayAddressGeneratorStatic{
+        RelayAddress: ip,
+        Address:      "0.0.0.0",
+    }
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+    "github.com/pion/turn/v4"
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+func newTURNClient(t *testing.T, serverAddr, username, password string) *turn.Client {
+    conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    client, err := turn.NewClient(&turn.ClientConfig{
+        STUNServerAddr: serverAddr,
+        TURNServerAddr: serverAddr,
+        Username:       username,
+        Password:       password,
+        Conn:           conn,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := client.Listen(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        client.Close()
+        _ = conn.Close()
+    })
+    return client
+}
+
+func TestTURNServer(t *testing.T) {
+    turnServer, err := NewTURNServer(TURNServerOptions{UDPAddr: "127.0.0.1:0", TCPAddr: "127.0.0.1:0", Secret: "secret"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer turnServer.Close()
+
+    urls := turnServer.URLs()
+    if len(urls) != 3 || !strings.HasPrefix(urls[0], "stun:127.0.0.1:") || !strings.HasSuffix(urls[2], "?transport=tcp") {
+        t.Fatalf("unexpected urls: %v", urls)
+    }
+    serverAddr := strings.TrimPrefix(urls[0], "stun:")
+
+    // 使用信令服务器下发的临时认证信息分配中继地址
+    iceServers := newTURNConfig(urls, "secret", time.Minute).iceServers("c1", time.Now())
+    client := newTURNClient(t, serverAddr, iceServers[0].Username, iceServers[0].Credential.(string))
+    mapped, err := client.SendBindingRequest()
+    if err != nil {
+        t.Fatalf("stun binding: %v", err)
+    }
+    if !strings.HasPrefix(mapped.String(), "127.0.0.1:") {
+        t.Fatalf("unexpected mapped address: %v", mapped)
+    }
+    relayConn, err := client.Allocate()
+    if err != nil {
+        t.Fatalf("allocate: %v", err)
+    }
+    _ = relayConn.Close()
+
+    // 密钥不一致的认证信息被拒绝
+    forged := newTURNConfig(urls, "other", time.Minute).iceServers("c1", time.Now())
+    client = newTURNClient(t, serverAddr, forged[0].Username, forged[0].Credential.(string))
+    if _, err := client.Allocate(); err == nil {
+        t.Fatal("allocate should fail with forged credential")
+    }
+}
+
+// 默认拒绝中继到回环、内网等地址, 防止通过中继访问服务器所在的内网
+func TestTURNPermission(t *testing.T) {
+    for _, allowPrivate := range []bool{false, true} {
+        turnServer, err := NewTURNServer(TURNServerOptions{UDPAddr: "127.0.0.1:0", Secret: "secret", AllowPrivatePeers: allowPrivate})
+        if err != nil {
+            t.Fatal(err)
+        }
+        serverAddr := strings.TrimPrefix(turnServer.URLs()[0], "stun:")
+        iceServers := newTURNConfig(turnServer.URLs(), "secret", time.Minute).iceServers("c1", time.Now())
+        client := newTURNClient(t, serverAddr, iceServers[0].Username, iceServers[0].Credential.(string))
+        relayConn, err := client.Allocate()
+        if err != nil {
+            t.Fatalf("allocate: %v", err)
+        }
+
+        // 公网地址总是允许
+        if _, err := relayConn.WriteTo([]byte("ping"), &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9}); err != nil {
+            t.Fatalf("write to public peer: %v", err)
+        }
+        for _, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(10, 0, 0, 1), net.IPv4(192, 168, 1, 1), net.IPv4(169, 254, 169, 254), net.IPv4zero} {
+            _, err := relayConn.WriteTo([]byte("ping"), &net.UDPAddr{IP: ip, Port: 9})
+            if allowPrivate && err != nil {
+                t.Fatalf("write to %s should be allowed: %v", ip, err)
+            }
+            if !allowPrivate && err == nil {
+                t.Fatalf("write to %s should be denied", ip)
+            }
+        }
+        _ = relayConn.Close()
+        _ = turnServer.Close()
+    }
+}
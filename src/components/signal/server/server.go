@@ -1,111 +1,421 @@
 package server
 
 import (
+    "context"
+    "crypto/tls"
     "encoding/json"
+    "errors"
+    "fmt"
     "github.com/gorilla/websocket"
+    "github.com/pion/webrtc/v4"
     "kwseeker.top/kwseeker/p2p/src/components/message"
     "log"
+    "net"
     "net/http"
     "sync"
     "sync/atomic"
+    "time"
 )
 
-var (
-    SignalServer *Server // SignalServer 单例
-    once         sync.Once
-    counter      int32 // 历史连接数统计，同时作为客户端连接 ver 值来源，用于区分 cid 相同的连接
+const (
+    defaultPath        = "/signal"
+    defaultIdleTimeout = 60 * time.Second // 默认客户端空闲超时时间
 )
 
+var ErrServerClosed = errors.New("signal server closed")
+
+// Options 信令服务器配置
+type Options struct {
+    Addr          string        // Run 监听地址
+    Path          string        // WebSocket 信令路由, 默认 /signal
+    IdleTimeout   time.Duration // 客户端超过该时间没有任何消息则移除注册信息, 0 使用默认值 60s, <0 不检测
+    Authenticator Authenticator // 注册和发起连接时的认证后端, 默认 AllowAllAuthenticator
+    CertFile      string        // TLS 证书, 和 KeyFile 都配置时使用 wss, 文件更新后自动重新加载
+    KeyFile       string        // TLS 私钥
+    ClientCAFile  string        // 客户端证书 CA, 配置后要求客户端提供证书(双向认证)
+    TURNURLs      []string      // TURN 服务器地址, 和 TURNSecret 都配置时在注册响应中下发
+    TURNSecret    string        // 与 TURN 服务器共享的密钥, 用于生成 TURN REST API 临时认证信息
+    TURNTTL       time.Duration // TURN 临时认证信息有效期, 默认 24h
+}
+
 // Server 信令服务器
 // 实现 Peer SDP信息 和 Candidate 候选地址的记录以及在 Peer 间转发
 // 为实现双向和实时转发，使用 Socket 协议通信
 type Server struct {
-    addr        string
-    connections map[string]*ClientConn // 客户端连接, cid -> ClientConn
-    mu          sync.Mutex
+    addr         string
+    path         string
+    connections  map[string]*ClientConn // 已注册的客户端连接, cid -> ClientConn
+    conns        map[*ClientConn]bool   // 所有客户端连接, 包括未注册的, 关闭时通知断开
+    connWg       sync.WaitGroup         // 等待所有客户端连接读循环退出
+    authLimiter  *authLimiter           // 认证失败限流, 按来源 IP 统计
+    peerLimiter  *authLimiter           // 认证失败限流, 按目标 cid 统计, 防止从多个来源暴力破解同一个 Peer 的认证码, 只限制 offer
+    idleTimeout  time.Duration          // 客户端超过该时间没有任何消息则移除注册信息, <=0 不检测
+    watchers     map[string]watcherSet  // 在线状态订阅, 被订阅的 cid -> 订阅者
+    auth         Authenticator          // 注册和发起连接时的认证后端
+    certFile     string
+    keyFile      string
+    clientCAFile string
+    turn         turnConfig // TURN 临时认证信息配置
+    counter      int32      // 历史连接数统计，同时作为客户端连接 ver 值来源，用于区分 cid 相同的连接
+    handler      http.Handler
+    httpServer   *http.Server
+    done         chan struct{} // 关闭信号
+    closed       bool
+    mu           sync.Mutex
 }
 
-func NewServer(addr *string) *Server {
-    once.Do(func() {
-        SignalServer = &Server{
-            addr:        *addr,
-            connections: make(map[string]*ClientConn),
-        }
-    })
-    return SignalServer
-}
+func NewServer(options Options) *Server {
+    s := &Server{
+        addr:         options.Addr,
+        path:         options.Path,
+        connections:  make(map[string]*ClientConn),
+        conns:        make(map[*ClientConn]bool),
+        authLimiter:  newAuthLimiter(defaultMaxAuthFails, defaultAuthFailWindow, defaultAuthLockout),
+        peerLimiter:  newAuthLimiter(defaultMaxTargetAuthFails, defaultAuthFailWindow, defaultAuthLockout),
+        idleTimeout:  options.IdleTimeout,
+        watchers:     make(map[string]watcherSet),
+        auth:         options.Authenticator,
+        certFile:     options.CertFile,
+        keyFile:      options.KeyFile,
+        clientCAFile: options.ClientCAFile,
+        turn:         newTURNConfig(options.TURNURLs, options.TURNSecret, options.TURNTTL),
+        done:         make(chan struct{}),
+    }
+    if s.path == "" {
+        s.path = defaultPath
+    }
+    if s.idleTimeout == 0 {
+        s.idleTimeout = defaultIdleTimeout
+    }
+    if s.auth == nil {
+        s.auth = AllowAllAuthenticator{}
+    }
 
-// Run 信令服务器启动运行
-func (s *Server) Run() {
     // WebSocket 连接一个路由每次都会新开一个连接，而实现 SDP Candidate 信息转发需要复用连接，
     // 所以需要在同一个路由中处理 SDP Candidate 信息转发, 不同的消息通过消息类型区分并分发处理
-    http.HandleFunc("/signal", dispatchHandler)
+    mux := http.NewServeMux()
+    mux.HandleFunc(s.path, s.dispatchHandler)
+    mux.HandleFunc("/presence", s.presenceHandler)
+    s.handler = mux
 
-    log.Printf("Signal server start at %s\n", s.addr)
-    err := http.ListenAndServe(s.addr, nil)
+    if s.idleTimeout > 0 {
+        go s.evictIdleConnections()
+    }
+    return s
+}
+
+// Handler 返回信令服务的 http.Handler, 可以挂载到已有的 HTTP 服务中
+func (s *Server) Handler() http.Handler {
+    return s.handler
+}
+
+// Run 在 Options.Addr 上启动信令服务器, 阻塞直到出错或 Shutdown
+func (s *Server) Run() error {
+    l, err := net.Listen("tcp", s.addr)
     if err != nil {
-        log.Fatalf("Signal server start failed at %s, err:%v\n", s.addr, err)
-        return
+        return err
+    }
+    return s.Serve(l)
+}
+
+// Serve 在指定的 Listener 上启动信令服务器, 阻塞直到出错或 Shutdown, Shutdown 后返回 ErrServerClosed
+// 配置了证书时在 Listener 上启用 TLS
+func (s *Server) Serve(l net.Listener) error {
+    if s.certFile != "" && s.keyFile != "" {
+        tlsConfig, err := s.newTLSConfig()
+        if err != nil {
+            _ = l.Close()
+            return err
+        }
+        l = tls.NewListener(l, tlsConfig)
+    }
+    httpServer := &http.Server{Handler: s.handler}
+    s.mu.Lock()
+    if s.closed {
+        s.mu.Unlock()
+        _ = l.Close()
+        return ErrServerClosed
+    }
+    s.httpServer = httpServer
+    s.mu.Unlock()
+
+    log.Printf("Signal server start at %s\n", l.Addr())
+    if err := httpServer.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+        return err
+    }
+    return ErrServerClosed
+}
+
+// Shutdown 停止接受新连接, 通知所有客户端连接关闭并等待断开
+// ctx 结束前还未断开的连接会被强制关闭并返回 ctx.Err()
+func (s *Server) Shutdown(ctx context.Context) error {
+    s.mu.Lock()
+    if !s.closed {
+        s.closed = true
+        close(s.done)
+    }
+    httpServer := s.httpServer
+    conns := make([]*ClientConn, 0, len(s.conns))
+    for clientConn := range s.conns {
+        conns = append(conns, clientConn)
+    }
+    s.mu.Unlock()
+
+    var err error
+    if httpServer != nil {
+        err = httpServer.Shutdown(ctx)
+    }
+    for _, clientConn := range conns {
+        clientConn.closeGracefully()
+    }
+
+    drained := make(chan struct{})
+    go func() {
+        s.connWg.Wait()
+        close(drained)
+    }()
+    select {
+    case <-drained:
+    case <-ctx.Done():
+        for _, clientConn := range conns {
+            _ = clientConn.conn.Close()
+        }
+        <-drained
+        err = ctx.Err()
+    }
+    return err
+}
+
+// addConn 记录新的客户端连接, 服务器已关闭时返回 false
+func (s *Server) addConn(clientConn *ClientConn) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.closed {
+        return false
     }
+    s.conns[clientConn] = true
+    s.connWg.Add(1)
+    return true
+}
+
+func (s *Server) removeConn(clientConn *ClientConn) {
+    s.removeConnection(clientConn)
+    s.mu.Lock()
+    delete(s.conns, clientConn)
+    s.mu.Unlock()
+    s.connWg.Done()
 }
 
 func (s *Server) getConnection(cid string) (*ClientConn, bool) {
-    //s.mu.Lock()
-    //defer s.mu.Unlock()
+    s.mu.Lock()
+    defer s.mu.Unlock()
     clientConn, ok := s.connections[cid]
     return clientConn, ok
 }
 
+// removeConnection 删除注册信息并关闭连接
 func (s *Server) removeConnection(clientConn *ClientConn) {
     s.mu.Lock()
-    defer s.mu.Unlock()
-    currentConn, ok := s.connections[clientConn.cid]
-    if ok {
-        err := clientConn.conn.Close()
-        if err != nil {
+    removed := s.removeConnectionLocked(clientConn)
+    s.mu.Unlock()
+    if removed {
+        s.notifyRemoved(clientConn)
+    }
+}
+
+// removeConnectionLocked 需持有 s.mu, 返回是否删除了 cid 的注册信息, 删除后需调用 notifyRemoved
+func (s *Server) removeConnectionLocked(clientConn *ClientConn) bool {
+    removed := s.unregisterLocked(clientConn)
+    if err := clientConn.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+        log.Printf("Close client conn %s failed, err: %v\n", clientConn.info().cid, err)
+    }
+    return removed
+}
+
+// unregisterLocked 需持有 s.mu, 只删除注册信息不关闭连接, 返回是否删除了 cid 的注册信息
+func (s *Server) unregisterLocked(clientConn *ClientConn) bool {
+    s.unwatchAllLocked(clientConn)
+    reg := clientConn.info()
+    currentConn, ok := s.connections[reg.cid]
+    if !ok || currentConn.info().ver != reg.ver {
+        return false
+    }
+    delete(s.connections, reg.cid)
+    log.Printf("Removed client conn %s\n", reg.cid)
+    return true
+}
+
+// notifyRemoved 通知订阅者 Peer 下线, 并通知与其协商过的 Peer 其已离开, 不能持有 s.mu 调用
+func (s *Server) notifyRemoved(clientConn *ClientConn) {
+    removedCid := clientConn.info().cid
+    s.notifyPresence(message.Presence{Cid: removedCid})
+
+    clientConn.peers.Range(func(key, _ interface{}) bool {
+        cid := key.(string)
+        clientConn.peers.Delete(cid)
+        clientConn.granted.Delete(cid)
+        peerConn, ok := s.getConnection(cid)
+        if !ok {
+            return true
+        }
+        // 对端不再允许接收已离开的 cid 的 SDP, 即使该 cid 重新注册也需要重新协商
+        peerConn.peers.Delete(removedCid)
+        peerConn.granted.Delete(removedCid)
+        if err := peerConn.checkAndWriteJSON(message.NewPeerLeftEvent(removedCid)); err != nil {
+            log.Printf("Notify peer left of %s to %s failed, err: %v\n", removedCid, cid, err)
+        }
+        return true
+    })
+}
+
+// evictIdleConnections 定期移除超时没有任何消息的客户端连接
+// 半断开的 TCP 连接在写失败前不会被发现，依靠应用层心跳判断客户端是否存活
+func (s *Server) evictIdleConnections() {
+    ticker := time.NewTicker(s.idleTimeout / 2)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.done:
             return
+        case <-ticker.C:
         }
-        if currentConn.ver == clientConn.ver {
-            delete(s.connections, clientConn.cid)
+        var idleConns []*ClientConn
+        s.mu.Lock()
+        for _, clientConn := range s.connections {
+            if clientConn.idleFor() > s.idleTimeout {
+                idleConns = append(idleConns, clientConn)
+            }
+        }
+        s.mu.Unlock()
+
+        for _, clientConn := range idleConns {
+            log.Printf("Client conn %s idle for %v, evicted\n", clientConn.info().cid, clientConn.idleFor())
+            s.removeConnection(clientConn)
         }
-        log.Printf("Removed client conn %s\n", clientConn.cid)
     }
 }
 
 // ClientConn 客户端连接信息
+// 每个 WebSocket 连接对应一个 ClientConn, 注册后才有 cid, 且注册后不能更换 cid
 type ClientConn struct {
-    cid      string // Peer A 要连接 Peer B 的话需要先通过 cid + authCode 校验
-    authCode string
+    server   *Server
     conn     *websocket.Conn
     mu       sync.Mutex // 防止并发读写出现混乱
-    ver      int32
+    reg      atomic.Pointer[registration]
+    remoteIP net.IP       // 客户端连接的来源 IP
+    granted  sync.Map     // 已通过 authCode 校验、可以向本端回复 SDP 的对端 cid
+    peers    sync.Map     // 与本端交换过 SDP 的对端 cid, 本端离开时通知对端
+    lastSeen atomic.Int64 // 最后一次收到消息的时间(纳秒)
+    status   atomic.Value // 客户端心跳上报的状态 message.HeartbeatBody
+}
+
+// registration 连接的注册信息, 创建后不再修改
+// 重新注册时在 s.mu 下整体替换, 其他连接的 goroutine 读取到的总是一份完整的注册信息
+type registration struct {
+    cid          string // Peer A 要连接 Peer B 的话需要先通过 cid + authCode 校验
+    authCode     string
+    ver          int32
+    metadata     map[string]string // 注册时上报的公开信息
+    nat          *message.NATInfo  // 注册时上报的 NAT 行为
+    registeredAt time.Time
+}
+
+// unregistered 尚未注册的连接的注册信息
+var unregistered = &registration{}
+
+// info 返回连接当前的注册信息, 未注册时返回空的注册信息
+func (c *ClientConn) info() *registration {
+    if reg := c.reg.Load(); reg != nil {
+        return reg
+    }
+    return unregistered
+}
+
+// registeredAs 当前连接是否以 cid 注册, 防止冒用其他 Peer 的 cid 发送消息
+func (c *ClientConn) registeredAs(cid string) bool {
+    current, ok := c.server.getConnection(cid)
+    return ok && current == c
+}
+
+// touch 收到客户端消息时更新最后活跃时间
+func (c *ClientConn) touch() {
+    c.lastSeen.Store(time.Now().UnixNano())
+}
+
+// idleFor 距最后一次收到消息的时长
+func (c *ClientConn) idleFor() time.Duration {
+    return time.Since(time.Unix(0, c.lastSeen.Load()))
 }
 
 func (c *ClientConn) checkAndWriteJSON(v interface{}) error {
     c.mu.Lock()
     defer c.mu.Unlock()
-    log.Printf("checkAndWriteJSON: %v", v)
+    log.Printf("checkAndWriteJSON: %v", redact(v))
     err := c.conn.WriteJSON(v)
     if websocket.IsCloseError(err) {
         log.Println("Client conn closed!")
-        SignalServer.removeConnection(c)
+        c.server.removeConnection(c)
     }
     return err
 }
 
+// redact 日志中隐藏消息中的认证信息, 注册响应和 ICE 服务器响应只记录摘要
+func redact(v interface{}) interface{} {
+    switch response := v.(type) {
+    case message.RegisterResponse:
+        return fmt.Sprintf("register response, id=%s, cid=%s, success=%v, iceServers=%d",
+            response.Id, response.Cid, response.Success, len(response.ICEServers))
+    case message.ICEServersResponse:
+        return fmt.Sprintf("ice servers response, id=%s, cid=%s, success=%v, iceServers=%d",
+            response.Id, response.Cid, response.Success, len(response.ICEServers))
+    }
+    raw, err := json.Marshal(v)
+    if err != nil {
+        return fmt.Sprintf("%T", v)
+    }
+    return message.Redact(raw)
+}
+
+// closeGracefully 通知客户端关闭连接, 客户端回复关闭帧后读循环退出
+func (c *ClientConn) closeGracefully() {
+    msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown")
+    if err := c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+        log.Printf("Write close message to %s failed, err: %v\n", c.info().cid, err)
+    }
+}
+
+// reply 向本端返回响应，返回失败只记录日志
+func (c *ClientConn) reply(v interface{}) {
+    if err := c.checkAndWriteJSON(v); err != nil {
+        log.Printf("Reply failed, err: %v\n", err)
+    }
+}
+
 var ugr = websocket.Upgrader{
     CheckOrigin: func(r *http.Request) bool {
         return true // 允许所有跨域请求
     },
 }
 
-func dispatchHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) dispatchHandler(w http.ResponseWriter, r *http.Request) {
     // 协议升级为 WebSocket
     conn, err := ugr.Upgrade(w, r, nil)
     if err != nil {
         log.Println("Upgrade error:", err)
         return
     }
+    clientConn := &ClientConn{server: s, conn: conn}
+    if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+        clientConn.remoteIP = addr.IP
+    }
+    clientConn.touch()
+    if !s.addConn(clientConn) {
+        clientConn.closeGracefully()
+        _ = conn.Close()
+        return
+    }
+    // 连接断开后删除注册信息
+    defer s.removeConn(clientConn)
 
     for {
         // 阻塞读取客户端消息
@@ -114,136 +424,320 @@ func dispatchHandler(w http.ResponseWriter, r *http.Request) {
             log.Println("Read error:", err)
             break
         }
-        log.Printf("dispatchHandler received: %s", msg)
+        clientConn.touch()
         // m 转成 MMeta
         m := message.MMeta{}
         if err := json.Unmarshal(msg, &m); err != nil {
             log.Println(err)
-            break
+            clientConn.reply(message.NewErrorResponse("", message.NewError(message.ErrCodeMalformed, "invalid message")))
+            continue
         }
+        // 注册和 SDP 消息包含认证码和 Token, 不记录原文
+        log.Printf("dispatchHandler received: %s", message.Redact(msg))
 
         switch m.Type {
         case message.TypeRegisterRequest:
-            go registerPeerConn(msg, conn)
+            s.registerPeerConn(clientConn, msg)
             break
         case message.TypeRegisterResponse:
             break
-        //case message.TypeHeartbeatRequest:
-        //    handleHeartbeat()
-        //    break
+        case message.TypeUnregisterRequest:
+            s.handleUnregister(clientConn, msg)
+            break
+        case message.TypeHeartbeatRequest:
+            s.handleHeartbeat(clientConn, msg)
+            break
+        case message.TypeHeartbeatResponse:
+            break
         case message.TypeSdpRequest:
-            handleSdp(msg)
+            s.handleSdp(clientConn, msg)
             break
         case message.TypeSdpResponse:
             break
         case message.TypeCandidateRequest:
-            handleCandidate(msg)
+            s.handleCandidate(clientConn, msg)
             break
         case message.TypeCandidateResponse:
             break
+        case message.TypePresenceRequest:
+            s.handlePresence(clientConn, msg)
+            break
+        case message.TypeSubscribeRequest:
+            s.handleSubscribe(clientConn, msg)
+            break
+        case message.TypeConnectivityRequest:
+            s.handleConnectivity(clientConn, msg)
+            break
+        case message.TypeICEServersRequest:
+            s.handleICEServers(clientConn, msg)
+            break
         default:
             log.Println("Unknown message type!")
+            clientConn.reply(message.NewErrorResponse(m.Id, message.NewError(message.ErrCodeMalformed, "unknown message type")))
         }
     }
 }
 
 // 上报 Peer 节点信息
-func registerPeerConn(msg []byte, conn *websocket.Conn) {
+func (s *Server) registerPeerConn(clientConn *ClientConn, msg []byte) {
     registerRequest := message.RegisterRequest{}
     if err := json.Unmarshal(msg, &registerRequest); err != nil {
         log.Println(err)
+        clientConn.reply(message.NewRegisterFailedResponse(registerRequest,
+            message.NewError(message.ErrCodeMalformed, "invalid register request")))
+        return
+    }
+    if registerRequest.Cid == "" {
+        log.Println("Register cid is empty!")
+        clientConn.reply(message.NewRegisterFailedResponse(registerRequest,
+            message.NewError(message.ErrCodeMalformed, "cid is required")))
+        return
+    }
+
+    // 校验设备身份, 按来源 IP 统计认证失败, 认证失败次数过多的来源暂时拒绝注册
+    // 不按 cid 统计, 否则任何人都可以用错误的 Token 让某个设备无法注册
+    source := sourceKey(clientConn.conn)
+    if !s.authLimiter.allow(source) {
+        log.Printf("Too many register auth failures, cid=%s, source=%s\n", registerRequest.Cid, source)
+        clientConn.reply(message.NewRegisterFailedResponse(registerRequest,
+            message.NewError(message.ErrCodeRateLimited, "too many auth failures, try again later")))
+        return
+    }
+    if err := s.auth.AuthenticateRegister(registerRequest.RegisterBody); err != nil {
+        log.Printf("Register auth failed, cid=%s, err: %v\n", registerRequest.Cid, err)
+        s.authLimiter.fail(source)
+        clientConn.reply(message.NewRegisterFailedResponse(registerRequest,
+            message.NewError(message.ErrCodeAuthFailed, err.Error())))
         return
     }
 
     // 记录Peer连接信息
-    SignalServer.mu.Lock()
-    cc, b := SignalServer.getConnection(registerRequest.Cid)
+    s.mu.Lock()
+    if cid := clientConn.info().cid; cid != "" && cid != registerRequest.Cid {
+        s.mu.Unlock()
+        log.Printf("Client conn already registered as %s\n", cid)
+        clientConn.reply(message.NewRegisterFailedResponse(registerRequest,
+            message.NewError(message.ErrCodeMalformed, "connection already registered as another cid")))
+        return
+    }
+    cc, b := s.connections[registerRequest.Cid]
     // 先删除旧连接如果存在的话
-    if b && cc != nil {
-        SignalServer.removeConnection(cc)
+    replaced := false
+    if b && cc != clientConn {
+        replaced = s.removeConnectionLocked(cc)
     }
-    clientConn := &ClientConn{
-        cid:      registerRequest.Cid,
-        authCode: registerRequest.AuthCode,
-        conn:     conn,
-        ver:      atomic.AddInt32(&counter, 1),
+    clientConn.reg.Store(&registration{
+        cid:          registerRequest.Cid,
+        authCode:     registerRequest.AuthCode,
+        ver:          atomic.AddInt32(&s.counter, 1),
+        metadata:     registerRequest.Metadata,
+        nat:          registerRequest.NAT,
+        registeredAt: time.Now(),
+    })
+    s.connections[registerRequest.Cid] = clientConn
+    presence := s.presenceLocked(registerRequest.Cid)
+    s.mu.Unlock()
+
+    // 通知订阅者 Peer 上线
+    if replaced {
+        s.notifyRemoved(cc)
     }
-    SignalServer.connections[registerRequest.Cid] = clientConn
-    SignalServer.mu.Unlock()
+    s.notifyPresence(presence)
 
-    // 响应
-    err := clientConn.checkAndWriteJSON(message.NewRegisterResponse(registerRequest, true))
+    // 响应, 同时下发 TURN 临时认证信息
+    registerResponse := message.NewRegisterResponse(registerRequest, true)
+    registerResponse.ICEServers = s.turn.iceServers(registerRequest.Cid, time.Now())
+    registerResponse.ICEServersTTL = s.turn.ttlSeconds()
+    err := clientConn.checkAndWriteJSON(registerResponse)
     if err != nil {
         log.Printf("Response register response failed, err: %v\n", err)
         return
     }
 }
 
-//func handleHeartbeat() {
-//}
+// 客户端主动注销, 立即删除注册信息但不关闭连接, 连接由客户端关闭
+func (s *Server) handleUnregister(clientConn *ClientConn, msg []byte) {
+    unregisterRequest := message.UnregisterRequest{}
+    if err := json.Unmarshal(msg, &unregisterRequest); err != nil {
+        log.Println(err)
+        clientConn.reply(message.NewUnregisterFailedResponse(unregisterRequest,
+            message.NewError(message.ErrCodeMalformed, "invalid unregister request")))
+        return
+    }
+    s.mu.Lock()
+    removed := unregisterRequest.Cid == clientConn.info().cid && s.unregisterLocked(clientConn)
+    s.mu.Unlock()
+    if !removed {
+        clientConn.reply(message.NewUnregisterFailedResponse(unregisterRequest,
+            message.NewError(message.ErrCodeNotRegistered, "cid "+unregisterRequest.Cid+" is not registered")))
+        return
+    }
+    s.notifyRemoved(clientConn)
+    clientConn.reply(message.NewUnregisterResponse(unregisterRequest, true))
+}
+
+// 处理心跳, 记录客户端上报的状态
+func (s *Server) handleHeartbeat(clientConn *ClientConn, msg []byte) {
+    heartbeatRequest := message.HeartbeatRequest{}
+    if err := json.Unmarshal(msg, &heartbeatRequest); err != nil {
+        log.Println(err)
+        clientConn.reply(message.NewHeartbeatFailedResponse(heartbeatRequest,
+            message.NewError(message.ErrCodeMalformed, "invalid heartbeat request")))
+        return
+    }
+    // 连接已被移除(比如空闲超时)或未注册, 客户端需要重新注册
+    if !clientConn.registeredAs(heartbeatRequest.Cid) {
+        clientConn.reply(message.NewHeartbeatFailedResponse(heartbeatRequest,
+            message.NewError(message.ErrCodeNotRegistered, "cid "+heartbeatRequest.Cid+" is not registered")))
+        return
+    }
+    clientConn.status.Store(heartbeatRequest.HeartbeatBody)
+    clientConn.reply(message.NewHeartbeatResponse(heartbeatRequest, true))
+}
+
+// 刷新 TURN 临时认证信息, 客户端在有效期过半时请求, 避免长时间在线后 TURN 认证信息过期
+func (s *Server) handleICEServers(clientConn *ClientConn, msg []byte) {
+    iceServersRequest := message.ICEServersRequest{}
+    if err := json.Unmarshal(msg, &iceServersRequest); err != nil {
+        log.Println(err)
+        clientConn.reply(message.NewICEServersFailedResponse(iceServersRequest,
+            message.NewError(message.ErrCodeMalformed, "invalid ice servers request")))
+        return
+    }
+    if !clientConn.registeredAs(iceServersRequest.Cid) {
+        clientConn.reply(message.NewICEServersFailedResponse(iceServersRequest,
+            message.NewError(message.ErrCodeNotRegistered, "cid "+iceServersRequest.Cid+" is not registered")))
+        return
+    }
+    clientConn.reply(message.NewICEServersResponse(iceServersRequest,
+        s.turn.iceServers(iceServersRequest.Cid, time.Now()), s.turn.ttlSeconds()))
+}
+
+// sourceKey 认证失败限流的来源 key, 使用连接的来源 IP, 更换 cid 或重新连接不能绕过限流
+func sourceKey(conn *websocket.Conn) string {
+    if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+        return "ip:" + addr.IP.String()
+    }
+    return "addr:" + conn.RemoteAddr().String()
+}
 
 // 处理SDP信令, 解析信令内容，并转发给目标Peer
-func handleSdp(msg []byte) {
+func (s *Server) handleSdp(fromConn *ClientConn, msg []byte) {
     sdpRequest := message.SdpRequest{}
     if err := json.Unmarshal(msg, &sdpRequest); err != nil {
         log.Println(err)
+        fromConn.reply(message.NewSdpFailedResponse(sdpRequest,
+            message.NewError(message.ErrCodeMalformed, "invalid sdp request")))
+        return
+    }
+    log.Printf("handleSdp: From=%s, To=%s, type=%s\n", sdpRequest.From, sdpRequest.To, sdpRequest.Sd.Type)
+    // From 必须是当前连接注册的 cid
+    if !fromConn.registeredAs(sdpRequest.From) {
+        log.Printf("Client conn is not registered as %s!\n", sdpRequest.From)
+        fromConn.reply(message.NewSdpFailedResponse(sdpRequest,
+            message.NewError(message.ErrCodeNotRegistered, "connection is not registered as "+sdpRequest.From)))
+        return
+    }
+
+    // 认证失败次数过多的来源暂时拒绝处理
+    source := sourceKey(fromConn.conn)
+    if !s.authLimiter.allow(source) {
+        log.Printf("Too many auth failures, from=%s, to=%s\n", sdpRequest.From, sdpRequest.To)
+        fromConn.reply(message.NewSdpFailedResponse(sdpRequest,
+            message.NewError(message.ErrCodeRateLimited, "too many auth failures, try again later")))
         return
     }
-    log.Printf("handleSdp: From=%s, To=%s, sd=%s\n", sdpRequest.From, sdpRequest.To, sdpRequest.Sd)
 
     // 校验参数中cid和authCode和目标peer实际的authCode
-    clientConn, b := SignalServer.getConnection(sdpRequest.To)
+    clientConn, b := s.getConnection(sdpRequest.To)
     if !b {
         log.Println("Client conn not found!")
+        fromConn.reply(message.NewSdpFailedResponse(sdpRequest,
+            message.NewError(message.ErrCodeTargetOffline, "target peer "+sdpRequest.To+" is offline")))
+        return
+    }
+    if sdpRequest.Sd.Type == webrtc.SDPTypeOffer {
+        // 认证失败次数过多的目标暂时拒绝新的 offer, 目标回复的 answer 不受影响, 否则攻击者可以让目标无法回复任何连接
+        if !s.peerLimiter.allow(sdpRequest.To) {
+            log.Printf("Too many auth failures, from=%s, to=%s\n", sdpRequest.From, sdpRequest.To)
+            fromConn.reply(message.NewSdpFailedResponse(sdpRequest,
+                message.NewError(message.ErrCodeRateLimited, "too many auth failures, try again later")))
+            return
+        }
+        if err := s.auth.AuthenticateOffer(sdpRequest.SdpBody, clientConn.info().authCode); err != nil {
+            log.Printf("AuthCode check failed! err: %v\n", err)
+            if s.authLimiter.fail(source) {
+                log.Printf("Too many auth failures, block from=%s\n", source)
+            }
+            if s.peerLimiter.fail(sdpRequest.To) {
+                log.Printf("Too many auth failures, block to=%s\n", sdpRequest.To)
+            }
+            fromConn.reply(message.NewSdpFailedResponse(sdpRequest,
+                message.NewError(message.ErrCodeAuthFailed, "auth code mismatch")))
+            return
+        }
+        // 校验成功不清除失败记录, 否则攻击者可以穿插向自己的 Peer 发送正确的 offer 绕过限流
+        // 记录目标 Peer 可以向来源 Peer 回复 answer
+        fromConn.granted.Store(sdpRequest.To, true)
+    } else if _, ok := clientConn.granted.Load(sdpRequest.From); !ok {
+        // answer 等只能发给之前通过校验向自己发送过 offer 的 Peer
+        log.Println("SDP not granted!")
+        s.authLimiter.fail(source)
+        fromConn.reply(message.NewSdpFailedResponse(sdpRequest,
+            message.NewError(message.ErrCodeAuthFailed, "no authorized offer from target peer")))
         return
     }
-    //if sdpRequest.AuthCode != clientConn.authCode {   //TODO
-    //    log.Println("AuthCode check failed!")
-    //    return
-    //}
+
     // SDP 转发给目标 Peer, 暂时不管目标 Peer 是否处理成功 TODO
     err := clientConn.checkAndWriteJSON(sdpRequest)
     if err != nil {
         log.Println("SDP relay failed!")
+        fromConn.reply(message.NewSdpFailedResponse(sdpRequest,
+            message.NewError(message.ErrCodeInternal, "sdp relay failed")))
         return
     }
 
+    fromConn.peers.Store(clientConn.info().cid, true)
+    clientConn.peers.Store(fromConn.info().cid, true)
+
     // 向来源端返回正常响应
-    fromConn, b := SignalServer.getConnection(sdpRequest.From)
-    if !b {
-        log.Println("Client conn not found!")
-        return
-    }
     if err = fromConn.checkAndWriteJSON(message.NewSdpResponse(sdpRequest, true)); err != nil {
         log.Println("SDP relay response failed!")
         return
     }
 }
 
-func handleCandidate(msg []byte) {
+func (s *Server) handleCandidate(fromConn *ClientConn, msg []byte) {
     candidateRequest := message.CandidateRequest{}
     if err := json.Unmarshal(msg, &candidateRequest); err != nil {
         log.Println(err)
+        fromConn.reply(message.NewCandidateFailedResponse(candidateRequest,
+            message.NewError(message.ErrCodeMalformed, "invalid candidate request")))
+        return
+    }
+    log.Printf("handleCandidate: From=%s, To=%s, candidates=%d, end=%v\n",
+        candidateRequest.From, candidateRequest.To, len(candidateRequest.Candidates), candidateRequest.EndOfCandidates)
+    if !fromConn.registeredAs(candidateRequest.From) {
+        log.Printf("Client conn is not registered as %s!\n", candidateRequest.From)
+        fromConn.reply(message.NewCandidateFailedResponse(candidateRequest,
+            message.NewError(message.ErrCodeNotRegistered, "connection is not registered as "+candidateRequest.From)))
         return
     }
-    log.Printf("handleCandidate: From=%s, To=%s, candidate=%s\n",
-        candidateRequest.From, candidateRequest.To, candidateRequest.Candidate)
 
-    toConn, b := SignalServer.getConnection(candidateRequest.To)
+    toConn, b := s.getConnection(candidateRequest.To)
     if !b {
         log.Println("Client conn not found!")
+        fromConn.reply(message.NewCandidateFailedResponse(candidateRequest,
+            message.NewError(message.ErrCodeTargetOffline, "target peer "+candidateRequest.To+" is offline")))
         return
     }
     if err := toConn.checkAndWriteJSON(candidateRequest); err != nil {
         log.Println("Candidate relay failed!")
+        fromConn.reply(message.NewCandidateFailedResponse(candidateRequest,
+            message.NewError(message.ErrCodeInternal, "candidate relay failed")))
         return
     }
 
-    fromConn, b := SignalServer.getConnection(candidateRequest.From)
-    if !b {
-        log.Println("Client conn not found!")
-        return
-    }
     if err := fromConn.checkAndWriteJSON(message.NewCandidateResponse(candidateRequest, true)); err != nil {
         log.Println("Candidate relay response failed!")
         return
@@ -1,99 +1,478 @@
 package server
 
 import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
     "github.com/gorilla/websocket"
+    "github.com/pion/webrtc/v4"
     "kwseeker.top/kwseeker/p2p/src/components/message"
     "log"
+    "net"
     "net/http"
+    "net/http/httptest"
     "net/url"
+    "os"
+    "path/filepath"
+    "strings"
     "testing"
     "time"
 )
 
-func TestPeerConnectServer(t *testing.T) {
-    //t.SkipNow()
+// newTestServer 启动随机端口的信令服务器, 测试结束后关闭
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+    return newTestServerWithOptions(t, Options{})
+}
 
-    addr := "localhost:18901"
-    // 启动服务端
-    go func() {
-        NewServer(&addr).Run()
-    }()
+func newTestServerWithOptions(t *testing.T, options Options) (*Server, *httptest.Server) {
+    srv := NewServer(options)
+    ts := httptest.NewServer(srv.Handler())
+    t.Cleanup(func() {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        defer cancel()
+        _ = srv.Shutdown(ctx)
+        ts.Close()
+    })
+    return srv, ts
+}
 
-    time.Sleep(100 * time.Millisecond)
-    u := url.URL{Scheme: "ws", Host: addr, Path: "/signal"}
-    log.Printf("connecting to %s", u.String())
-    // 启动两个Peer C1
-    c1, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+func dialTestServer(t *testing.T, serverUrl string) *websocket.Conn {
+    conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(serverUrl, "http"), nil)
     if err != nil {
         t.Fatalf("dial: %v", err)
     }
+    return conn
+}
+
+// readType 读取消息直到收到指定类型
+func readType(t *testing.T, conn *websocket.Conn, typ int, v interface{}) {
+    _ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    for {
+        _, msg, err := conn.ReadMessage()
+        if err != nil {
+            t.Fatalf("read: %v", err)
+        }
+        m := message.MMeta{}
+        if err := json.Unmarshal(msg, &m); err != nil {
+            t.Fatalf("unmarshal: %v", err)
+        }
+        if m.Type == typ {
+            if err := json.Unmarshal(msg, v); err != nil {
+                t.Fatalf("unmarshal: %v", err)
+            }
+            return
+        }
+    }
+}
+
+func TestPeerConnectServer(t *testing.T) {
+    t.Parallel()
+    _, ts := newTestServer(t)
+
+    // 启动两个Peer C1
+    c1 := dialTestServer(t, ts.URL+"/signal")
     defer c1.Close()
     // C2
-    c2, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+    c2 := dialTestServer(t, ts.URL+"/signal")
+    defer c2.Close()
+
+    registerResponse := message.RegisterResponse{}
+    if err := c1.WriteJSON(message.NewRegisterRequest("c1", "c1code")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, c1, message.TypeRegisterResponse, &registerResponse)
+    if !registerResponse.Success {
+        t.Fatalf("c1 register failed: %v", registerResponse.Err())
+    }
+    // 同一个连接不能再注册为其他 cid
+    if err := c1.WriteJSON(message.NewRegisterRequest("c2", "c2code")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, c1, message.TypeRegisterResponse, &registerResponse)
+    if registerResponse.Success {
+        t.Fatal("c1 conn should not register as c2")
+    }
+    if err := c2.WriteJSON(message.NewRegisterRequest("c2", "c2code")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, c2, message.TypeRegisterResponse, &registerResponse)
+    if !registerResponse.Success {
+        t.Fatalf("c2 register failed: %v", registerResponse.Err())
+    }
+
+    // 认证码错误
+    sd := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0"}
+    sdpResponse := message.SdpResponse{}
+    if err := c1.WriteJSON(message.NewSdpRequest(sd, "c1", "c2", "wrong")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, c1, message.TypeSdpResponse, &sdpResponse)
+    if sdpResponse.Success || sdpResponse.Error.Code != message.ErrCodeAuthFailed {
+        t.Fatalf("expected auth failed, got: %+v", sdpResponse.Result)
+    }
+
+    // offer 转发给 c2, c2 回复 answer
+    if err := c1.WriteJSON(message.NewSdpRequest(sd, "c1", "c2", "c2code")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, c1, message.TypeSdpResponse, &sdpResponse)
+    if !sdpResponse.Success {
+        t.Fatalf("offer relay failed: %v", sdpResponse.Err())
+    }
+    sdpRequest := message.SdpRequest{}
+    readType(t, c2, message.TypeSdpRequest, &sdpRequest)
+    if sdpRequest.From != "c1" || sdpRequest.Sd.Type != webrtc.SDPTypeOffer {
+        t.Fatalf("unexpected offer: %+v", sdpRequest)
+    }
+    answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "v=0"}
+    if err := c2.WriteJSON(message.NewSdpRequest(answer, "c2", "c1", "")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, c1, message.TypeSdpRequest, &sdpRequest)
+    if sdpRequest.From != "c2" || sdpRequest.Sd.Type != webrtc.SDPTypeAnswer {
+        t.Fatalf("unexpected answer: %+v", sdpRequest)
+    }
+}
+
+// 同一个 cid 使用错误 Token 注册不能替换已注册的设备, 响应中不返回 Token
+func TestRegisterReplaceWithBadToken(t *testing.T) {
+    t.Parallel()
+    path := filepath.Join(t.TempDir(), "secrets.json")
+    if err := os.WriteFile(path, []byte(`{"device": "s3cret"}`), 0600); err != nil {
+        t.Fatal(err)
+    }
+    auth, err := NewStaticAuthenticator(path)
     if err != nil {
-        t.Fatalf("dial: %v", err)
+        t.Fatal(err)
     }
-    defer c2.Close()
+    srv, ts := newTestServerWithOptions(t, Options{Authenticator: auth})
 
-    err = c1.WriteJSON(message.NewRegisterRequest("c1", "c1code"))
+    device := dialTestServer(t, ts.URL+"/signal")
+    defer device.Close()
+    registerRequest := message.NewRegisterRequest("device", "123456")
+    registerRequest.Token = "s3cret"
+    if err := device.WriteJSON(registerRequest); err != nil {
+        t.Fatal(err)
+    }
+    registerResponse := message.RegisterResponse{}
+    readType(t, device, message.TypeRegisterResponse, &registerResponse)
+    if !registerResponse.Success {
+        t.Fatalf("device register failed: %v", registerResponse.Err())
+    }
+    if registerResponse.Token != "" || registerResponse.AuthCode != "" {
+        t.Fatalf("register response should not contain credentials: %+v", registerResponse.RegisterBody)
+    }
+    registered, _ := srv.getConnection("device")
+
+    attacker := dialTestServer(t, ts.URL+"/signal")
+    defer attacker.Close()
+    registerRequest.Token = "guess"
+    if err := attacker.WriteJSON(registerRequest); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, attacker, message.TypeRegisterResponse, &registerResponse)
+    if registerResponse.Success || registerResponse.Error.Code != message.ErrCodeAuthFailed {
+        t.Fatalf("expected auth failed, got: %+v", registerResponse.Result)
+    }
+    if current, ok := srv.getConnection("device"); !ok || current != registered {
+        t.Fatal("registered device should not be replaced")
+    }
+    // 已注册的设备仍然可以正常使用
+    heartbeatResponse := message.HeartbeatResponse{}
+    if err := device.WriteJSON(message.NewHeartbeatRequest("device", "", time.Now().Unix())); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, device, message.TypeHeartbeatResponse, &heartbeatResponse)
+    if !heartbeatResponse.Success {
+        t.Fatalf("heartbeat failed: %v", heartbeatResponse.Err())
+    }
+}
+
+// 超过空闲时间没有任何消息的客户端被移除, 持续发送心跳的客户端保持注册
+func TestIdleEviction(t *testing.T) {
+    t.Parallel()
+    srv, ts := newTestServerWithOptions(t, Options{IdleTimeout: 200 * time.Millisecond})
+
+    silent := dialTestServer(t, ts.URL+"/signal")
+    defer silent.Close()
+    active := dialTestServer(t, ts.URL+"/signal")
+    defer active.Close()
+    if err := silent.WriteJSON(message.NewRegisterRequest("idle-silent", "111111")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, silent, message.TypeRegisterResponse, &message.RegisterResponse{})
+    if err := active.WriteJSON(message.NewRegisterRequest("idle-active", "222222")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, active, message.TypeRegisterResponse, &message.RegisterResponse{})
+
+    heartbeatResponse := message.HeartbeatResponse{}
+    for i := 0; i < 12; i++ {
+        time.Sleep(50 * time.Millisecond)
+        if err := active.WriteJSON(message.NewHeartbeatRequest("idle-active", "", time.Now().Unix())); err != nil {
+            t.Fatal(err)
+        }
+        readType(t, active, message.TypeHeartbeatResponse, &heartbeatResponse)
+        if !heartbeatResponse.Success {
+            t.Fatalf("heartbeat failed: %v", heartbeatResponse.Err())
+        }
+    }
+    if _, ok := srv.getConnection("idle-silent"); ok {
+        t.Fatal("silent client should be evicted")
+    }
+    if _, ok := srv.getConnection("idle-active"); !ok {
+        t.Fatal("active client should stay registered")
+    }
+}
+
+func TestShutdown(t *testing.T) {
+    t.Parallel()
+    srv := NewServer(Options{})
+    l, err := net.Listen("tcp", "127.0.0.1:0")
     if err != nil {
-        return
+        t.Fatal(err)
     }
-    err = c1.WriteJSON(message.NewRegisterRequest("c2", "c2code"))
+    serveErr := make(chan error, 1)
+    go func() {
+        serveErr <- srv.Serve(l)
+    }()
+
+    u := url.URL{Scheme: "ws", Host: l.Addr().String(), Path: "/signal"}
+    c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
     if err != nil {
-        return
+        t.Fatalf("dial: %v", err)
+    }
+    defer c.Close()
+    if err := c.WriteJSON(message.NewRegisterRequest("c1", "c1code")); err != nil {
+        t.Fatal(err)
     }
+    readType(t, c, message.TypeRegisterResponse, &message.RegisterResponse{})
 
+    // 客户端收到关闭帧后自动回复, 服务器等待连接断开
+    clientErr := make(chan error, 1)
     go func() {
         for {
-            log.Println("c1 listen")
-            _, m, err := c1.ReadMessage()
-            if err != nil {
-                t.Errorf("read: %v", err)
+            if _, _, err := c.ReadMessage(); err != nil {
+                clientErr <- err
                 return
             }
-            log.Printf("c1 received: %s", m)
         }
     }()
+    ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+    defer cancel()
+    if err := srv.Shutdown(ctx); err != nil {
+        t.Fatalf("shutdown: %v", err)
+    }
+    if err := <-serveErr; !errors.Is(err, ErrServerClosed) {
+        t.Fatalf("expected ErrServerClosed, got: %v", err)
+    }
+    if err := <-clientErr; !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+        t.Fatalf("expected going away close, got: %v", err)
+    }
+    if _, ok := srv.getConnection("c1"); ok {
+        t.Fatal("c1 should be removed after shutdown")
+    }
+}
+
+func TestUnregister(t *testing.T) {
+    t.Parallel()
+    srv, ts := newTestServer(t)
+
+    offer := dialTestServer(t, ts.URL+"/signal")
+    defer offer.Close()
+    answer := dialTestServer(t, ts.URL+"/signal")
+    defer answer.Close()
+    if err := offer.WriteJSON(message.NewRegisterRequest("unregister-offer", "111111")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, offer, message.TypeRegisterResponse, &message.RegisterResponse{})
+    if err := answer.WriteJSON(message.NewRegisterRequest("unregister-answer", "222222")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, answer, message.TypeRegisterResponse, &message.RegisterResponse{})
+
+    sd := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0"}
+    if err := offer.WriteJSON(message.NewSdpRequest(sd, "unregister-offer", "unregister-answer", "222222")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, answer, message.TypeSdpRequest, &message.SdpRequest{})
+
+    // answer 注销后 offer 收到通知
+    unregisterResponse := message.UnregisterResponse{}
+    if err := answer.WriteJSON(message.NewUnregisterRequest("unregister-answer")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, answer, message.TypeUnregisterResponse, &unregisterResponse)
+    if !unregisterResponse.Success {
+        t.Fatalf("unregister failed: %v", unregisterResponse.Err())
+    }
+    peerLeftEvent := message.PeerLeftEvent{}
+    readType(t, offer, message.TypePeerLeftEvent, &peerLeftEvent)
+    if peerLeftEvent.Cid != "unregister-answer" {
+        t.Fatalf("unexpected peer left event: %+v", peerLeftEvent)
+    }
+    if _, ok := srv.getConnection("unregister-answer"); ok {
+        t.Fatal("answer should be unregistered")
+    }
+
+    // 连接断开后删除注册信息
+    _ = offer.Close()
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+        if _, ok := srv.getConnection("unregister-offer"); !ok {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("offer should be removed after conn closed")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+// 目标 Peer 认证失败次数过多时只拒绝发给它的 offer, 它主动发起的连接收到的 answer 照常转发
+func TestTargetLockoutAllowsAnswer(t *testing.T) {
+    t.Parallel()
+    srv, ts := newTestServer(t)
+
+    victim := dialTestServer(t, ts.URL+"/signal")
+    defer victim.Close()
+    peer := dialTestServer(t, ts.URL+"/signal")
+    defer peer.Close()
+    if err := victim.WriteJSON(message.NewRegisterRequest("lockout-victim", "111111")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, victim, message.TypeRegisterResponse, &message.RegisterResponse{})
+    if err := peer.WriteJSON(message.NewRegisterRequest("lockout-peer", "222222")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, peer, message.TypeRegisterResponse, &message.RegisterResponse{})
+
+    // 模拟其他来源对 victim 的暴力破解
+    for i := 0; i < defaultMaxTargetAuthFails; i++ {
+        srv.peerLimiter.fail("lockout-victim")
+    }
+    sd := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0"}
+    sdpResponse := message.SdpResponse{}
+    if err := peer.WriteJSON(message.NewSdpRequest(sd, "lockout-peer", "lockout-victim", "111111")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, peer, message.TypeSdpResponse, &sdpResponse)
+    if sdpResponse.Success || sdpResponse.Error.Code != message.ErrCodeRateLimited {
+        t.Fatalf("offer to locked target should be rate limited, got: %+v", sdpResponse.Result)
+    }
+
+    // victim 仍然可以主动连接其他 Peer
+    if err := victim.WriteJSON(message.NewSdpRequest(sd, "lockout-victim", "lockout-peer", "222222")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, peer, message.TypeSdpRequest, &message.SdpRequest{})
+    answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "v=0"}
+    if err := peer.WriteJSON(message.NewSdpRequest(answer, "lockout-peer", "lockout-victim", "")); err != nil {
+        t.Fatal(err)
+    }
+    sdpResponse = message.SdpResponse{}
+    readType(t, peer, message.TypeSdpResponse, &sdpResponse)
+    if !sdpResponse.Success {
+        t.Fatalf("answer to locked target should be relayed: %v", sdpResponse.Err())
+    }
+    relayed := message.SdpRequest{}
+    readType(t, victim, message.TypeSdpRequest, &relayed)
+    if relayed.Sd.Type != webrtc.SDPTypeAnswer {
+        t.Fatalf("unexpected relayed sdp: %+v", relayed.SdpBody)
+    }
+}
+
+// 重新注册与其他连接读取注册信息并发进行, 使用 -race 运行
+func TestReRegisterWhileOffering(t *testing.T) {
+    t.Parallel()
+    _, ts := newTestServer(t)
 
+    offer := dialTestServer(t, ts.URL+"/signal")
+    defer offer.Close()
+    answer := dialTestServer(t, ts.URL+"/signal")
+    defer answer.Close()
+    if err := offer.WriteJSON(message.NewRegisterRequest("reregister-offer", "111111")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, offer, message.TypeRegisterResponse, &message.RegisterResponse{})
+    if err := answer.WriteJSON(message.NewRegisterRequest("reregister-answer", "222222")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, answer, message.TypeRegisterResponse, &message.RegisterResponse{})
+
+    stop := make(chan struct{})
+    done := make(chan error, 1)
     go func() {
+        sd := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0"}
         for {
-            log.Println("c2 listen")
-            _, m, err := c2.ReadMessage()
-            if err != nil {
-                t.Errorf("read: %v", err)
+            select {
+            case <-stop:
+                done <- nil
+                return
+            default:
+            }
+            if err := offer.WriteJSON(message.NewSdpRequest(sd, "reregister-offer", "reregister-answer", "222222")); err != nil {
+                done <- err
                 return
             }
-            log.Printf("c2 received: %s", m)
         }
     }()
+    for i := 0; i < 10; i++ {
+        if err := answer.WriteJSON(message.NewRegisterRequest("reregister-answer", "222222")); err != nil {
+            t.Fatal(err)
+        }
+        registerResponse := message.RegisterResponse{}
+        readType(t, answer, message.TypeRegisterResponse, &registerResponse)
+        if !registerResponse.Success {
+            t.Fatalf("re-register failed: %v", registerResponse.Err())
+        }
+    }
+    close(stop)
+    if err := <-done; err != nil {
+        t.Fatal(err)
+    }
+}
 
-    select {}
+// 日志中不出现认证码、Token 和 TURN 临时密码
+func TestRedact(t *testing.T) {
+    sd := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0"}
+    sdpRequest := message.NewSdpRequest(sd, "c1", "c2", "secret-code")
+    registerRequest := message.NewRegisterRequest("c1", "secret-code")
+    registerRequest.Token = "secret-token"
+    raw, err := json.Marshal(registerRequest)
+    if err != nil {
+        t.Fatal(err)
+    }
+    logged := []string{
+        fmt.Sprint(redact(sdpRequest)),
+        fmt.Sprint(redact(message.NewSdpResponse(sdpRequest, true))),
+        fmt.Sprint(redact(message.ICEServersResponse{ICEServers: []webrtc.ICEServer{{Username: "c1", Credential: "secret-credential"}}})),
+        message.Redact(raw),
+    }
+    for _, line := range logged {
+        if strings.Contains(line, "secret") {
+            t.Fatalf("credential leaked: %s", line)
+        }
+    }
+    if !strings.Contains(logged[0], `"to":"c2"`) {
+        t.Fatalf("redacted message should keep other fields: %s", logged[0])
+    }
 }
 
 // WebSocket 连接每一个路由都是一个新的连接，每个连接都需要额外进行协议升级
 // 所有此处场景，如果想要使用 WebSocket 复用连接，转发 SDP 和 Candidate 信息需要通过同一个路由实现，
 // 可以在这个路由内部，自行实现不同命令分发处理
 func TestWebSocketCS(t *testing.T) {
-    go func() {
-        http.HandleFunc("/echo", echoHandler)   // 注册 /echo 路由
-        http.HandleFunc("/hello", helloHandler) // 注册 /hello 路由
-        log.Println("WebSocket server is running on ws://localhost:8080/echo")
-        if err := http.ListenAndServe(":8080", nil); err != nil {
-            log.Fatal("Server error:", err)
-        }
-    }()
-
-    // 等待1s
-    time.Sleep(1 * time.Second)
+    t.Parallel()
+    mux := http.NewServeMux()
+    mux.HandleFunc("/echo", echoHandler)   // 注册 /echo 路由
+    mux.HandleFunc("/hello", helloHandler) // 注册 /hello 路由
+    ts := httptest.NewServer(mux)
+    defer ts.Close()
+    log.Printf("WebSocket server is running on %s/echo", ts.URL)
 
-    addr := "localhost:8080"
-    u := url.URL{Scheme: "ws", Host: addr, Path: "/echo"}
-    log.Printf("connecting to %s", u.String())
-    c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-    if err != nil {
-        t.Fatalf("dial: %v", err)
-    }
+    c := dialTestServer(t, ts.URL+"/echo")
     defer c.Close()
     // 设置读取超时
     //if err := c.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
@@ -101,26 +480,30 @@ func TestWebSocketCS(t *testing.T) {
     //    return
     //}
 
-    go func() {
-        for {
-            // 读取响应
-            _, m, err := c.ReadMessage()
-            if err != nil {
-                t.Errorf("read: %v\n", err)
-                return
-            }
-            log.Printf("recv: %s", m)
-        }
-    }()
-
-    //time.Ticker 每秒发送一次消息
-    ticker := time.NewTicker(1 * time.Second)
+    //time.Ticker 定时发送消息
+    ticker := time.NewTicker(10 * time.Millisecond)
     defer ticker.Stop()
-    for range ticker.C {
-        err = c.WriteMessage(websocket.TextMessage, []byte("hello"))
+    for i := 0; i < 3; i++ {
+        <-ticker.C
+        err := c.WriteMessage(websocket.TextMessage, []byte("hello"))
         if err != nil {
             t.Fatalf("write: %v", err)
         }
+        // 读取响应
+        _, m, err := c.ReadMessage()
+        if err != nil {
+            t.Fatalf("read: %v", err)
+        }
+        log.Printf("recv: %s", m)
+        if string(m) != "hello" {
+            t.Fatalf("unexpected echo: %s", m)
+        }
+    }
+
+    hello := dialTestServer(t, ts.URL+"/hello")
+    defer hello.Close()
+    if _, m, err := hello.ReadMessage(); err != nil || !strings.HasPrefix(string(m), "Hello!") {
+        t.Fatalf("unexpected welcome message: %s, err: %v", m, err)
     }
 }
 
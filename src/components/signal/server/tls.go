@@ -0,0 +1,119 @@
+package server
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "log"
+    "os"
+    "sync"
+    "time"
+)
+
+const defaultCertCheckInterval = 10 * time.Second // 检查证书文件是否变化的间隔
+
+// newTLSConfig 根据配置的证书创建 TLS 配置, 配置了客户端 CA 时要求客户端提供证书(双向认证)
+func (s *Server) newTLSConfig() (*tls.Config, error) {
+    reloader, err := newCertReloader(s.certFile, s.keyFile)
+    if err != nil {
+        return nil, err
+    }
+    tlsConfig := &tls.Config{
+        MinVersion:     tls.VersionTLS12,
+        GetCertificate: reloader.GetCertificate,
+    }
+    if s.clientCAFile != "" {
+        pem, err := os.ReadFile(s.clientCAFile)
+        if err != nil {
+            return nil, err
+        }
+        clientCAs := x509.NewCertPool()
+        if !clientCAs.AppendCertsFromPEM(pem) {
+            return nil, errors.New("no certificate found in " + s.clientCAFile)
+        }
+        tlsConfig.ClientCAs = clientCAs
+        tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+    }
+    return tlsConfig, nil
+}
+
+// certReloader 证书文件变化后自动重新加载, 更新证书无需重启信令服务器
+type certReloader struct {
+    certFile      string
+    keyFile       string
+    cert          *tls.Certificate
+    modTime       time.Time     // 当前证书文件的修改时间
+    checkedAt     time.Time     // 最后一次检查文件的时间
+    checkInterval time.Duration // 检查文件是否变化的间隔, 避免每次握手都读取文件
+    mu            sync.Mutex
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+    r := &certReloader{
+        certFile:      certFile,
+        keyFile:       keyFile,
+        checkInterval: defaultCertCheckInterval,
+    }
+    modTime, err := r.latestModTime()
+    if err != nil {
+        return nil, err
+    }
+    if err := r.load(modTime); err != nil {
+        return nil, err
+    }
+    return r, nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    now := time.Now()
+    if now.Sub(r.checkedAt) >= r.checkInterval {
+        r.checkedAt = now
+        r.reloadIfChanged()
+    }
+    return r.cert, nil
+}
+
+// reloadIfChanged 证书文件有更新时重新加载, 加载失败继续使用旧证书, 需持有 r.mu
+func (r *certReloader) reloadIfChanged() {
+    modTime, err := r.latestModTime()
+    if err != nil {
+        log.Printf("Stat cert file failed, err: %v\n", err)
+        return
+    }
+    if !modTime.After(r.modTime) {
+        return
+    }
+    if err := r.load(modTime); err != nil {
+        log.Printf("Reload cert failed, keep using the old one, err: %v\n", err)
+        return
+    }
+    log.Printf("Reloaded cert %s\n", r.certFile)
+}
+
+func (r *certReloader) load(modTime time.Time) error {
+    cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+    if err != nil {
+        return err
+    }
+    r.cert = &cert
+    r.modTime = modTime
+    return nil
+}
+
+// latestModTime 证书和私钥文件中较新的修改时间
+func (r *certReloader) latestModTime() (time.Time, error) {
+    certInfo, err := os.Stat(r.certFile)
+    if err != nil {
+        return time.Time{}, err
+    }
+    keyInfo, err := os.Stat(r.keyFile)
+    if err != nil {
+        return time.Time{}, err
+    }
+    if keyInfo.ModTime().After(certInfo.ModTime()) {
+        return keyInfo.ModTime(), nil
+    }
+    return certInfo.ModTime(), nil
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+    "context"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "github.com/gorilla/websocket"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "math/big"
+    "net"
+    "net/url"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// writeSelfSignedCert 生成自签名证书和私钥文件, 返回证书 PEM
+func writeSelfSignedCert(t *testing.T, certFile, keyFile, commonName string, usage x509.ExtKeyUsage) []byte {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber:          serial,
+        Subject:               pkix.Name{CommonName: commonName},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(time.Hour),
+        KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+        ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+        BasicConstraintsValid: true,
+        IsCA:                  true,
+        IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyDer, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+    if err := os.WriteFile(certFile, certPem, 0600); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+        t.Fatal(err)
+    }
+    return certPem
+}
+
+func certPool(t *testing.T, certPem []byte) *x509.CertPool {
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(certPem) {
+        t.Fatal("append cert failed")
+    }
+    return pool
+}
+
+// serveTLS 启动启用 TLS 的信令服务器, 返回监听地址
+func serveTLS(t *testing.T, options Options) string {
+    srv := NewServer(options)
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    go func() {
+        _ = srv.Serve(l)
+    }()
+    t.Cleanup(func() {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        defer cancel()
+        _ = srv.Shutdown(ctx)
+    })
+    return l.Addr().String()
+}
+
+func dialTLS(addr string, tlsConfig *tls.Config) (*websocket.Conn, error) {
+    dialer := *websocket.DefaultDialer
+    dialer.TLSClientConfig = tlsConfig
+    u := url.URL{Scheme: "wss", Host: addr, Path: "/signal"}
+    conn, _, err := dialer.Dial(u.String(), nil)
+    return conn, err
+}
+
+func TestServeTLS(t *testing.T) {
+    t.Parallel()
+    dir := t.TempDir()
+    certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+    serverPem := writeSelfSignedCert(t, certFile, keyFile, "signal-server", x509.ExtKeyUsageServerAuth)
+    addr := serveTLS(t, Options{CertFile: certFile, KeyFile: keyFile})
+
+    if _, err := dialTLS(addr, &tls.Config{}); err == nil {
+        t.Fatal("dial should fail without trusting the self-signed cert")
+    }
+    conn, err := dialTLS(addr, &tls.Config{RootCAs: certPool(t, serverPem)})
+    if err != nil {
+        t.Fatalf("dial: %v", err)
+    }
+    defer conn.Close()
+    registerResponse := message.RegisterResponse{}
+    if err := conn.WriteJSON(message.NewRegisterRequest("c1", "c1code")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, conn, message.TypeRegisterResponse, &registerResponse)
+    if !registerResponse.Success {
+        t.Fatalf("register failed: %v", registerResponse.Err())
+    }
+}
+
+func TestServeMutualTLS(t *testing.T) {
+    t.Parallel()
+    dir := t.TempDir()
+    certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+    serverPem := writeSelfSignedCert(t, certFile, keyFile, "signal-server", x509.ExtKeyUsageServerAuth)
+    clientCertFile, clientKeyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+    writeSelfSignedCert(t, clientCertFile, clientKeyFile, "peer", x509.ExtKeyUsageClientAuth)
+    addr := serveTLS(t, Options{CertFile: certFile, KeyFile: keyFile, ClientCAFile: clientCertFile})
+
+    tlsConfig := &tls.Config{RootCAs: certPool(t, serverPem)}
+    if conn, err := dialTLS(addr, tlsConfig); err == nil {
+        // TLS 1.3 客户端证书校验失败在握手后才能发现
+        _, _, err = conn.ReadMessage()
+        if err == nil {
+            t.Fatal("connection without client cert should be rejected")
+        }
+        _ = conn.Close()
+    }
+
+    clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tlsConfig.Certificates = []tls.Certificate{clientCert}
+    conn, err := dialTLS(addr, tlsConfig)
+    if err != nil {
+        t.Fatalf("dial with client cert: %v", err)
+    }
+    _ = conn.Close()
+}
+
+func TestCertReloader(t *testing.T) {
+    t.Parallel()
+    dir := t.TempDir()
+    certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+    writeSelfSignedCert(t, certFile, keyFile, "first", x509.ExtKeyUsageServerAuth)
+    reloader, err := newCertReloader(certFile, keyFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    reloader.checkInterval = 0
+
+    commonName := func() string {
+        cert, err := reloader.GetCertificate(nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        leaf, err := x509.ParseCertificate(cert.Certificate[0])
+        if err != nil {
+            t.Fatal(err)
+        }
+        return leaf.Subject.CommonName
+    }
+    if name := commonName(); name != "first" {
+        t.Fatalf("unexpected cert: %s", name)
+    }
+
+    // 证书文件更新后自动加载新证书
+    writeSelfSignedCert(t, certFile, keyFile, "second", x509.ExtKeyUsageServerAuth)
+    future := time.Now().Add(time.Minute)
+    for _, f := range []string{certFile, keyFile} {
+        if err := os.Chtimes(f, future, future); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if name := commonName(); name != "second" {
+        t.Fatalf("cert not reloaded: %s", name)
+    }
+
+    // 新证书无效时继续使用旧证书
+    if err := os.WriteFile(keyFile, []byte("broken"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    future = future.Add(time.Minute)
+    if err := os.Chtimes(keyFile, future, future); err != nil {
+        t.Fatal(err)
+    }
+    if name := commonName(); name != "second" {
+        t.Fatalf("broken cert should be ignored: %s", name)
+    }
+}
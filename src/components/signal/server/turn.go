@@ -0,0 +1,64 @@
+package server
+
+import (
+    "crypto/hmac"
+    "crypto/sha1"
+    "encoding/base64"
+    "github.com/pion/webrtc/v4"
+    "strconv"
+    "time"
+)
+
+const defaultTURNTTL = 24 * time.Hour // 默认 TURN 临时认证信息有效期
+
+// turnConfig TURN REST API 风格的临时认证信息配置
+// 用户名为 "过期时间戳:cid", 密码为 base64(HMAC-SHA1(secret, 用户名)), TURN 服务器(比如 coturn use-auth-secret)用相同密钥校验,
+// 设备上不需要保存长期有效的 TURN 密码
+type turnConfig struct {
+    urls   []string
+    secret []byte
+    ttl    time.Duration
+}
+
+func newTURNConfig(urls []string, secret string, ttl time.Duration) turnConfig {
+    if ttl <= 0 {
+        ttl = defaultTURNTTL
+    }
+    return turnConfig{
+        urls:   urls,
+        secret: []byte(secret),
+        ttl:    ttl,
+    }
+}
+
+// iceServers 为注册的 cid 生成 TURN 临时认证信息, 未配置 TURN 时返回 nil
+func (t turnConfig) iceServers(cid string, now time.Time) []webrtc.ICEServer {
+    if len(t.urls) == 0 || len(t.secret) == 0 {
+        return nil
+    }
+    username, credential := turnCredential(t.secret, cid, now.Add(t.ttl))
+    return []webrtc.ICEServer{
+        {
+            URLs:           t.urls,
+            Username:       username,
+            Credential:     credential,
+            CredentialType: webrtc.ICECredentialTypePassword,
+        },
+    }
+}
+
+// ttlSeconds 下发的 TURN 临时认证信息有效期(秒), 未配置 TURN 时返回 0
+func (t turnConfig) ttlSeconds() int64 {
+    if len(t.urls) == 0 || len(t.secret) == 0 {
+        return 0
+    }
+    return int64(t.ttl / time.Second)
+}
+
+// turnCredential 生成在 expiry 过期的 TURN 用户名和密码
+func turnCredential(secret []byte, cid string, expiry time.Time) (string, string) {
+    username := strconv.FormatInt(expiry.Unix(), 10) + ":" + cid
+    mac := hmac.New(sha1.New, secret)
+    mac.Write([]byte(username))
+    return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha1"
+    "encoding/base64"
+    "kwseeker.top/kwseeker/p2p/src/components/message"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestTURNCredential(t *testing.T) {
+    now := time.Unix(1700000000, 0)
+    turn := newTURNConfig([]string{"turn:turn.example.com:3478"}, "secret", time.Hour)
+    iceServers := turn.iceServers("c1", now)
+    if len(iceServers) != 1 {
+        t.Fatalf("expected 1 ice server, got %d", len(iceServers))
+    }
+    // 用户名为过期时间戳:cid, 密码为 base64(HMAC-SHA1(secret, 用户名)), 和 coturn use-auth-secret 一致
+    username := strconv.FormatInt(now.Add(time.Hour).Unix(), 10) + ":c1"
+    mac := hmac.New(sha1.New, []byte("secret"))
+    mac.Write([]byte(username))
+    if iceServers[0].Username != username || iceServers[0].Credential != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+        t.Fatalf("unexpected credential: %+v", iceServers[0])
+    }
+
+    // 未配置密钥时不下发
+    if iceServers := newTURNConfig([]string{"turn:turn.example.com"}, "", 0).iceServers("c1", now); iceServers != nil {
+        t.Fatalf("expected no ice servers, got: %+v", iceServers)
+    }
+}
+
+func TestRegisterIssuesTURNCredential(t *testing.T) {
+    t.Parallel()
+    srv := NewServer(Options{TURNURLs: []string{"turn:turn.example.com:3478"}, TURNSecret: "secret"})
+    ts := httptest.NewServer(srv.Handler())
+    defer ts.Close()
+    defer func() {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        defer cancel()
+        _ = srv.Shutdown(ctx)
+    }()
+
+    conn := dialTestServer(t, ts.URL+"/signal")
+    defer conn.Close()
+    if err := conn.WriteJSON(message.NewRegisterRequest("turn-c1", "123456")); err != nil {
+        t.Fatal(err)
+    }
+    registerResponse := message.RegisterResponse{}
+    readType(t, conn, message.TypeRegisterResponse, &registerResponse)
+    if !registerResponse.Success || len(registerResponse.ICEServers) != 1 {
+        t.Fatalf("unexpected register response: %+v", registerResponse)
+    }
+    iceServer := registerResponse.ICEServers[0]
+    expiry, err := strconv.ParseInt(strings.TrimSuffix(iceServer.Username, ":turn-c1"), 10, 64)
+    if err != nil || time.Until(time.Unix(expiry, 0)) < defaultTURNTTL-time.Minute {
+        t.Fatalf("unexpected username: %s", iceServer.Username)
+    }
+    if credential, _ := iceServer.Credential.(string); credential == "" {
+        t.Fatalf("missing credential: %+v", iceServer)
+    }
+    if registerResponse.ICEServersTTL != int64(defaultTURNTTL/time.Second) {
+        t.Fatalf("unexpected ttl: %d", registerResponse.ICEServersTTL)
+    }
+
+    // 过期前刷新, 不需要重新注册
+    iceServersResponse := message.ICEServersResponse{}
+    if err := conn.WriteJSON(message.NewICEServersRequest("turn-c1")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, conn, message.TypeICEServersResponse, &iceServersResponse)
+    if !iceServersResponse.Success || len(iceServersResponse.ICEServers) != 1 || iceServersResponse.ICEServersTTL != registerResponse.ICEServersTTL {
+        t.Fatalf("unexpected ice servers response: %+v", iceServersResponse)
+    }
+    if !strings.HasSuffix(iceServersResponse.ICEServers[0].Username, ":turn-c1") {
+        t.Fatalf("unexpected username: %s", iceServersResponse.ICEServers[0].Username)
+    }
+
+    // 未注册的连接不能获取
+    other := dialTestServer(t, ts.URL+"/signal")
+    defer other.Close()
+    if err := other.WriteJSON(message.NewICEServersRequest("turn-c1")); err != nil {
+        t.Fatal(err)
+    }
+    readType(t, other, message.TypeICEServersResponse, &iceServersResponse)
+    if iceServersResponse.Success || iceServersResponse.Error.Code != message.ErrCodeNotRegistered {
+        t.Fatalf("expected not registered, got: %+v", iceServersResponse.Result)
+    }
+}